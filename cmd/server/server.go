@@ -1,32 +1,59 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/capture"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/graphite"
+	"github.com/infrawatch/sg-core/pkg/graphiteserver"
+	"github.com/infrawatch/sg-core/pkg/handler"
+	"github.com/infrawatch/sg-core/pkg/httpserver"
 	"github.com/infrawatch/sg-core/pkg/inetserver"
+	"github.com/infrawatch/sg-core/pkg/influx"
+	"github.com/infrawatch/sg-core/pkg/influxserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/otlp"
+	"github.com/infrawatch/sg-core/pkg/otlpserver"
+	"github.com/infrawatch/sg-core/pkg/plugin"
+	"github.com/infrawatch/sg-core/pkg/replay"
+	"github.com/infrawatch/sg-core/pkg/statsd"
+	"github.com/infrawatch/sg-core/pkg/statsdserver"
+	"github.com/infrawatch/sg-core/pkg/streamserver"
+	"github.com/infrawatch/sg-core/pkg/transport"
 	"github.com/infrawatch/sg-core/pkg/unixserver"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const unixSocketPath string = "/tmp/smartgateway"
 
-func startPromHTTP(host string, port int) (registry *prometheus.Registry) {
+// startPromHTTP serves the metrics of the returned registry, stop is called
+// when the server fails
+func startPromHTTP(host string, port int, logLevelWritable bool, logger logging.Logger, stop func()) (registry *prometheus.Registry) {
 	registry = prometheus.NewRegistry()
 
 	//Set up Metric Exporter
 	handler := http.NewServeMux()
 	handler.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	handler.Handle("/loglevel", logging.LevelHandler(logger, logLevelWritable))
 	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte(`<html>
                                 <head><title>Collectd Exporter</title></head>
@@ -36,20 +63,67 @@ func startPromHTTP(host string, port int) (registry *prometheus.Registry) {
                                 </body>
 								</html>`))
 		if err != nil {
-			log.Printf("HTTP: %v", err)
+			logger.Error("failed to write HTTP response", "err", err)
 		}
 	})
 
 	//run exporter fro prometheus to scrape
 	go func() {
 		metricsURL := fmt.Sprintf("%s:%d", host, port)
-		log.Printf("Metric server at : %s\n", metricsURL)
-		log.Fatal(http.ListenAndServe(metricsURL, handler))
+		logger.Info("metric server started", "address", metricsURL)
+		logger.Error("metric server stopped", "err", http.ListenAndServe(metricsURL, handler))
+		stop()
 	}()
 
 	return
 }
 
+// streamFlags adds framing and limit flags of stream listeners to fs, the
+// returned function builds their config after parsing
+func streamFlags(fs *flag.FlagSet) func() (streamserver.Config, error) {
+	framing := fs.String("framing", streamserver.FramingNewline.String(), "Message framing: newline or length (4-byte big endian prefix)")
+	maxMessageSize := fs.Int("maxmsgsize", streamserver.DefaultMaxMessageSize, "Max message size in bytes, connections sending larger messages are closed")
+	idleTimeout := fs.Duration("idletimeout", streamserver.DefaultIdleTimeout, "Close connections without messages for this long, 0 disables")
+	maxConnections := fs.Int("maxconns", 0, "Max concurrent connections, 0 is unlimited")
+	return func() (streamserver.Config, error) {
+		f, err := streamserver.ParseFraming(*framing)
+		return streamserver.Config{
+			Framing:        f,
+			MaxMessageSize: *maxMessageSize,
+			IdleTimeout:    *idleTimeout,
+			MaxConnections: *maxConnections,
+		}, err
+	}
+}
+
+// httpFlags adds path, authentication, TLS and limit flags of http listeners
+// to fs, the returned function builds their config after parsing
+func httpFlags(fs *flag.FlagSet, path string, pathUsage string) func() (httpserver.Config, error) {
+	urlPath := fs.String("path", path, pathUsage)
+	user := fs.String("user", "", "Basic auth user name, empty disables authentication")
+	passwordFile := fs.String("passwordfile", "", "File containing the basic auth password")
+	tlsCert := fs.String("tlscert", "", "TLS certificate file, enables TLS together with -tlskey")
+	tlsKey := fs.String("tlskey", "", "TLS private key file")
+	maxBody := fs.Int64("maxbody", httpserver.DefaultMaxBodySize, "Max request body size in bytes")
+	return func() (httpserver.Config, error) {
+		cfg := httpserver.Config{
+			Path:        *urlPath,
+			Username:    *user,
+			CertFile:    *tlsCert,
+			KeyFile:     *tlsKey,
+			MaxBodySize: *maxBody,
+		}
+		if *passwordFile != "" {
+			password, err := os.ReadFile(*passwordFile)
+			if err != nil {
+				return cfg, fmt.Errorf("could not read password file: %w", err)
+			}
+			cfg.Password = strings.TrimSpace(string(password))
+		}
+		return cfg, nil
+	}
+}
+
 func main() {
 	if os.Getenv("DEBUG") != "" {
 		runtime.SetBlockProfileRate(20)
@@ -58,6 +132,16 @@ func main() {
 
 	inetCommand := flag.NewFlagSet("inet", flag.ExitOnError)
 	unixCommand := flag.NewFlagSet("unix", flag.ExitOnError)
+	tcpCommand := flag.NewFlagSet("tcp", flag.ExitOnError)
+	unixStreamCommand := flag.NewFlagSet("unixstream", flag.ExitOnError)
+	httpCommand := flag.NewFlagSet("http", flag.ExitOnError)
+	graphiteCommand := flag.NewFlagSet("graphite", flag.ExitOnError)
+	statsdCommand := flag.NewFlagSet("statsd", flag.ExitOnError)
+	influxCommand := flag.NewFlagSet("influx", flag.ExitOnError)
+	otlpCommand := flag.NewFlagSet("otlp", flag.ExitOnError)
+	transportCommand := flag.NewFlagSet("transport", flag.ExitOnError)
+	replayCommand := flag.NewFlagSet("replay", flag.ExitOnError)
+	trainCommand := flag.NewFlagSet("train-dictionary", flag.ExitOnError)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [options] <command> [options]\n", os.Args[0])
@@ -66,12 +150,51 @@ func main() {
 		inetCommand.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nusage: %s [options] unix [options]\n\n", os.Args[0])
 		unixCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] tcp [options]\n\n", os.Args[0])
+		tcpCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] unixstream [options]\n\n", os.Args[0])
+		unixStreamCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] http [options]\n\n", os.Args[0])
+		httpCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] graphite [options]\n\n", os.Args[0])
+		graphiteCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] statsd [options]\n\n", os.Args[0])
+		statsdCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] influx [options]\n\n", os.Args[0])
+		influxCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] otlp [options]\n\n", os.Args[0])
+		otlpCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] transport [options]\n\n", os.Args[0])
+		transportCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] replay [options]\n\n", os.Args[0])
+		replayCommand.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nusage: %s [options] train-dictionary [options]\n\n", os.Args[0])
+		trainCommand.PrintDefaults()
 	}
 	promhost := flag.String("promhost", "localhost", "Prometheus scrape host.")
 	promport := flag.Int("promport", 8081, "Prometheus scrape port.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
-	capture := flag.Bool("capture", false, "Catpure json output.")
+	captureEnabled := flag.Bool("capture", false, "Catpure json output.")
+	capturePath := flag.String("capturepath", "cd-capture.txt", "Capture file path, compression extension is appended.")
+	captureMaxSize := flag.Int64("capturemaxsize", 0, "Rotate capture file after this many bytes, 0 disables.")
+	captureMaxAge := flag.Duration("capturemaxage", 0, "Rotate capture file after this long, 0 disables.")
+	captureMaxFiles := flag.Int("capturemaxfiles", 0, "Number of rotated capture files kept, 0 keeps all.")
+	captureCompression := flag.String("capturecompression", "none", "Capture file compression: none, gzip or zstd.")
+	dictionary := flag.String("dictionary", "", "zstd dictionary used for compressed capture files and datagrams.")
+	captureQueue := flag.Int("capturequeue", capture.DefaultQueueSize, "Messages buffered for capture before dropping.")
+	captureDrop := flag.String("capturedrop", "newest", "Messages dropped when the capture queue is full: newest or oldest.")
 	usetimestamp := flag.Bool("usetimestamp", false, "Propagate collectd timestamps to prometheus metrics (requires reliable time sync)")
+	loglevel := flag.String("loglevel", "info", "Log level: debug, info, warn or error. Shown by /loglevel on the metrics port.")
+	loglevelWritable := flag.Bool("loglevelwritable", false, "Allow changing the log level at runtime with PUT or POST /loglevel on the metrics port.")
+	logformat := flag.String("logformat", "logfmt", "Log output format: logfmt or json.")
+	logratelimit := flag.Int("logratelimit", 10, "Max number of identical log messages per second, 0 disables limiting.")
+	stats := flag.Bool("stats", false, "Periodically log received msg and metric counts.")
+	naming := flag.String("naming", cdmetrics.NamingLegacy.String(), "Metric and label naming scheme, sg-legacy or collectd_exporter.")
+	emptyLabels := flag.String("emptylabels", "base", "Labels of empty collectd instances, base exports them as \"base\", omit leaves them out.")
+	typesDB := flag.String("typesdb", "", "Comma separated collectd types.db files, required to decode PUTVAL messages.")
+	badPayloadSample := flag.Uint64("badpayloadsample", 0, "Log every n-th rejected payload, 0 disables logging payloads.")
+	plugins := flag.String("plugins", "", "JSON file naming Go plugins registering message formats and their config, see examples/plugin")
+	hostgrace := flag.Duration("hostgrace", cdmetrics.DefaultHostGracePeriod, "Time a host which stopped reporting is kept exported with sg_host_up 0")
 
 	// Add Flags for net command
 	// parse command line option
@@ -81,6 +204,82 @@ func main() {
 	// Add Flags for shared command
 	socketPath := unixCommand.String("path", unixSocketPath, "Path/file for the shared memeory socket")
 
+	// Add Flags for stream commands
+	tcpIPAddress := tcpCommand.String("ip", "127.0.0.1", "Listening IP address")
+	tcpPort := tcpCommand.Int("port", 0, "Port to use, otherwise OS will choose")
+	tcpConfig := streamFlags(tcpCommand)
+	unixStreamPath := unixStreamCommand.String("path", unixSocketPath, "Path/file for the stream socket")
+	unixStreamConfig := streamFlags(unixStreamCommand)
+
+	// Add Flags for http command
+	httpIPAddress := httpCommand.String("ip", "127.0.0.1", "Listening IP address")
+	httpPort := httpCommand.Int("port", 8080, "Listening port")
+	httpConfig := httpFlags(httpCommand, httpserver.DefaultPath, "URL path collectd write_http posts to")
+
+	// Add Flags for message formats of generic listeners
+	formats := make(map[*flag.FlagSet]*string)
+	for _, fs := range []*flag.FlagSet{inetCommand, unixCommand, tcpCommand, unixStreamCommand, httpCommand, transportCommand} {
+		formats[fs] = fs.String("format", "collectd", "Message format: "+strings.Join(handler.Formats(), ", "))
+	}
+	// expiry of series of formats other than collectd, whose series expire by their interval
+	staleTimes := make(map[*flag.FlagSet]*time.Duration)
+	for _, fs := range []*flag.FlagSet{inetCommand, unixCommand, tcpCommand, unixStreamCommand, httpCommand, influxCommand, otlpCommand, transportCommand, replayCommand} {
+		staleTimes[fs] = fs.Duration("staletime", cdmetrics.DefaultStaleTime*time.Second, "Time after which series of formats other than collectd expire without updates")
+	}
+
+	// Add Flags for graphite command
+	graphiteIPAddress := graphiteCommand.String("ip", "127.0.0.1", "Listening IP address")
+	graphitePort := graphiteCommand.Int("port", 2003, "Listening port, usually 2003 for plaintext and 2004 for pickle")
+	graphiteNetwork := graphiteCommand.String("network", "tcp", "Network: tcp or udp")
+	graphitePickle := graphiteCommand.Bool("pickle", false, "Receive the pickle protocol instead of plaintext, tcp only")
+	graphiteTemplates := []string{}
+	graphiteCommand.Func("template", "Template mapping paths to collectd fields: [filter] template [field=value,...], repeatable, first match wins (default "+graphite.DefaultTemplate+")", func(s string) error {
+		if _, err := graphite.ParseTemplate(s); err != nil {
+			return err
+		}
+		graphiteTemplates = append(graphiteTemplates, s)
+		return nil
+	})
+	graphiteMaxMessageSize := graphiteCommand.Int("maxmsgsize", streamserver.DefaultMaxMessageSize, "Max message size in bytes of tcp connections")
+	graphiteIdleTimeout := graphiteCommand.Duration("idletimeout", streamserver.DefaultIdleTimeout, "Close tcp connections without messages for this long, 0 disables")
+
+	// Add Flags for statsd command
+	statsdIPAddress := statsdCommand.String("ip", "127.0.0.1", "Listening IP address")
+	statsdPort := statsdCommand.Int("port", 8125, "Listening port")
+	statsdNetwork := statsdCommand.String("network", "udp", "Network: udp or tcp")
+	statsdFlushInterval := statsdCommand.Duration("flushinterval", statsd.DefaultFlushInterval, "Interval aggregated samples are exported at")
+	statsdTTL := statsdCommand.Duration("ttl", statsd.DefaultTTL, "Time after which series without samples expire")
+	statsdTimerType := statsdCommand.String("timertype", "histogram", "Type timers and histograms are exported as: histogram or summary")
+	statsdMaxMessageSize := statsdCommand.Int("maxmsgsize", streamserver.DefaultMaxMessageSize, "Max line size in bytes of tcp connections")
+	statsdIdleTimeout := statsdCommand.Duration("idletimeout", streamserver.DefaultIdleTimeout, "Close tcp connections without samples for this long, 0 disables")
+
+	// Add Flags for influx command
+	influxIPAddress := influxCommand.String("ip", "127.0.0.1", "Listening IP address")
+	influxPort := influxCommand.Int("port", 8086, "Listening port")
+	influxNetwork := influxCommand.String("network", "http", "Network: http or udp")
+	influxPrecision := influxCommand.String("precision", "ns", "Precision of udp timestamps: ns, u, ms, s, m or h")
+	influxHTTPConfig := httpFlags(influxCommand, influxserver.DefaultPath, "URL path of line protocol writes")
+
+	// Add Flags for otlp command
+	otlpIPAddress := otlpCommand.String("ip", "127.0.0.1", "Listening IP address")
+	otlpPort := otlpCommand.Int("port", 4318, "Listening port")
+	otlpResourceAttributes := otlpCommand.String("resourceattributes", strings.Join(otlp.DefaultResourceAttributes, ","), "Comma separated resource attributes exported as labels")
+	otlpHTTPConfig := httpFlags(otlpCommand, otlpserver.DefaultPath, "URL path of OTLP metric exports")
+
+	// Add Flags for transport command
+	transportName := transportCommand.String("name", "", "Name of a transport registered by a plugin")
+	transportAddress := transportCommand.String("address", "", "Address the transport listens on, its syntax is up to the transport")
+
+	// Add Flags for replay command
+	replayFile := replayCommand.String("file", "cd-capture.txt", "Capture file to replay")
+	replaySpeed := replayCommand.Float64("speed", 0, "Replay speed multiplier of the original timing, 0 replays as fast as possible")
+	replayHold := replayCommand.Bool("hold", false, "Keep serving metrics after the replay finished until interrupted")
+
+	// Add Flags for train-dictionary command
+	trainFile := trainCommand.String("file", "cd-capture.txt", "Capture file with sample messages")
+	trainOut := trainCommand.String("out", "dictionary", "Output dictionary file")
+	trainSize := trainCommand.Int("size", zstdutil.DefaultDictionarySize, "Max dictionary size in bytes")
+
 	flag.Parse()
 
 	commandArgs := flag.Args()
@@ -89,7 +288,7 @@ func main() {
 	// os.Arg[0] is the main command
 	// os.Arg[1] will be the subcommand
 	if len(commandArgs) < 1 {
-		fmt.Println("inet or unix subcommand is required!")
+		fmt.Println("inet, unix, tcp, unixstream, http, graphite, statsd, influx, otlp, transport, replay or train-dictionary subcommand is required!")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -109,46 +308,232 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	case "tcp":
+		err := tcpCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "unixstream":
+		err := unixStreamCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "http":
+		err := httpCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "graphite":
+		err := graphiteCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "statsd":
+		err := statsdCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "influx":
+		err := influxCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "otlp":
+		err := otlpCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "transport":
+		err := transportCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "replay":
+		err := replayCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
+	case "train-dictionary":
+		err := trainCommand.Parse(commandArgs[1:])
+		if err != nil {
+			panic(err)
+		}
 	default:
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	var w *bufio.Writer
-	var err error
+	level, err := logging.ParseLevel(*loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	format, err := logging.ParseFormat(*logformat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	namingScheme, err := cdmetrics.ParseNaming(*naming)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *emptyLabels != "base" && *emptyLabels != "omit" {
+		fmt.Fprintf(os.Stderr, "unknown empty labels mode %q, expected base or omit\n", *emptyLabels)
+		os.Exit(1)
+	}
+	logger := logging.NewLogger(level, format, os.Stdout, logging.RateLimit{Burst: *logratelimit, Interval: time.Second})
 
-	if *capture {
-		var fo *os.File
-		// open output file
-		fo, err = os.Create("cd-capture.txt")
-		if err != nil {
-			panic(err)
+	if trainCommand.Parsed() {
+		if err := trainDictionary(*trainFile, *trainOut, *trainSize, logger); err != nil {
+			logger.Error("dictionary training failed", "err", err)
+			os.Exit(1)
 		}
-		// close fo on exit and check for its returned error
-		defer func() {
-			if err := fo.Close(); err != nil {
-				panic(err)
-			}
-		}()
-		// make a write buffer
-		w = bufio.NewWriter(fo)
+		return
+	}
+
+	var dict []byte
+	if *dictionary != "" {
+		if dict, err = zstdutil.LoadDictionary(*dictionary); err != nil {
+			logger.Error("could not load dictionary", "err", err)
+			os.Exit(1)
+		}
+	}
+	codec, err := zstdutil.NewCodec(dict)
+	if err != nil {
+		logger.Error("could not create zstd codec", "err", err)
+		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	// deferred first to run last, after capture is flushed and the bus closed
+	var failed atomic.Bool
+	defer func() {
+		if failed.Load() {
+			os.Exit(1)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("signal received, shutting down", "signal", sig)
+		cancel()
+	}()
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("could not create CPU profile", "err", err)
+			os.Exit(1)
 		}
 		defer f.Close()
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal("could not start CPU profile: ", err)
+			logger.Error("could not start CPU profile", "err", err)
+			os.Exit(1)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
-	registry := startPromHTTP(*promhost, *promport)
+	// listeners return when the metrics server fails, so deferred cleanup
+	// runs before exiting
+	registry := startPromHTTP(*promhost, *promport, *loglevelWritable, logger, func() {
+		failed.Store(true)
+		cancel()
+	})
+
+	// metric store and self metrics are shared by all listeners
+	promIntf := cdmetrics.NewPromIntf()
+	registry.MustRegister(promIntf)
+
+	allMetrics := cdmetrics.NewCDMetrics(*hostgrace, logger)
+	allMetrics.UseTimestamp = *usetimestamp
+	allMetrics.Naming = namingScheme
+	allMetrics.OmitEmptyLabels = *emptyLabels == "omit"
+	registry.MustRegister(allMetrics)
+
+	cache := cacheutil.NewCacheServer(logger)
+	registry.MustRegister(cache)
+	go func() {
+		_ = cache.Run(ctx)
+	}()
+
+	pipeline := cdmetrics.NewPipeline(allMetrics, cache, codec, logger)
+	pipeline.BadPayloadSample = *badPayloadSample
+	if *typesDB != "" {
+		if pipeline.TypesDB, err = collectd.LoadTypesDB(strings.Split(*typesDB, ",")...); err != nil {
+			logger.Error("could not load types.db", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("types.db loaded", "types", pipeline.TypesDB.Len())
+	}
+
+	// raw messages received by listeners, consumed by capture
+	b := bus.New(logger)
+	defer b.Close()
+	registry.MustRegister(b)
+
+	if *captureEnabled {
+		compression, err := capture.ParseCompression(*captureCompression)
+		if err != nil {
+			logger.Error("invalid capture compression", "err", err)
+			os.Exit(1)
+		}
+		dropPolicy, err := bus.ParseDropPolicy(*captureDrop)
+		if err != nil {
+			logger.Error("invalid capture drop policy", "err", err)
+			os.Exit(1)
+		}
+		w, err := capture.NewWriter(capture.Config{
+			Path:        *capturePath,
+			MaxSize:     *captureMaxSize,
+			MaxAge:      *captureMaxAge,
+			MaxFiles:    *captureMaxFiles,
+			Compression: compression,
+			Dictionary:  dict,
+			QueueSize:   *captureQueue,
+			DropPolicy:  dropPolicy,
+		}, b, logger)
+		if err != nil {
+			logger.Error("could not open capture file", "err", err)
+			os.Exit(1)
+		}
+		// flush queued records on exit
+		defer w.Close()
+		registry.MustRegister(w)
+	}
+
+	if *plugins != "" {
+		cfgs, err := plugin.LoadConfig(*plugins)
+		if err != nil {
+			logger.Error("could not read plugins file", "err", err)
+			os.Exit(1)
+		}
+		if err := plugin.LoadAll(cfgs); err != nil {
+			logger.Error("could not load plugins", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("plugins loaded", "plugins", len(cfgs), "formats", strings.Join(handler.Formats(), ","), "transports", strings.Join(transport.Names(), ","))
+	}
+
+	// handler of the message format of generic listeners
+	var h handler.Handler
+	var pub *bus.Publisher
+	for fs, format := range formats {
+		if !fs.Parsed() {
+			continue
+		}
+		pub = b.Publisher(*format)
+		h, err = handler.New(*format, handler.Env{Context: ctx, Pipeline: pipeline, Cache: cache, Logger: logger, StaleTime: staleTimes[fs].Seconds()})
+		if err != nil {
+			logger.Error("could not create message handler", "err", err)
+			os.Exit(1)
+		}
+		registry.MustRegister(h.Collectors()...)
+	}
 
 	if inetCommand.Parsed() {
 		ip := net.ParseIP(*ipAddress)
@@ -157,20 +542,139 @@ func main() {
 			flag.Usage()
 			os.Exit(1)
 		}
-		err = inetserver.Listen(ctx, ip.String()+":"+strconv.Itoa(*port), w)
+		err = inetserver.Listen(ctx, ip.String()+":"+strconv.Itoa(*port), h.Handle, pub, promIntf, *stats, logger)
 		if err != nil {
-			fmt.Printf("Error occurred")
+			logger.Error("inet listener failed", "err", err)
 		}
 	} else if unixCommand.Parsed() {
-		err = unixserver.Listen(ctx, *socketPath, w, registry, *usetimestamp)
+		err = unixserver.Listen(ctx, *socketPath, h.Handle, pub, promIntf, *stats, logger)
 		if err != nil {
-			fmt.Printf("Error occurred")
+			logger.Error("unix listener failed", "err", err)
 		}
-	}
-
-	if *capture {
-		if err = w.Flush(); err != nil {
-			panic(err)
+	} else if tcpCommand.Parsed() || unixStreamCommand.Parsed() {
+		var cfg streamserver.Config
+		if tcpCommand.Parsed() {
+			cfg, err = tcpConfig()
+			cfg.Network = "tcp"
+			cfg.Address = net.JoinHostPort(*tcpIPAddress, strconv.Itoa(*tcpPort))
+		} else {
+			cfg, err = unixStreamConfig()
+			cfg.Network = "unix"
+			cfg.Address = *unixStreamPath
+		}
+		if err != nil {
+			logger.Error("invalid stream listener options", "err", err)
+			os.Exit(1)
+		}
+		err = streamserver.Listen(ctx, cfg, h.Handle, pub, promIntf, *stats, logger)
+		if err != nil {
+			logger.Error("stream listener failed", "err", err)
+		}
+	} else if httpCommand.Parsed() {
+		cfg, err := httpConfig()
+		if err != nil {
+			logger.Error("invalid http listener options", "err", err)
+			os.Exit(1)
+		}
+		cfg.Address = net.JoinHostPort(*httpIPAddress, strconv.Itoa(*httpPort))
+		err = httpserver.Listen(ctx, cfg, h.Handle, pub, promIntf, *stats, logger)
+		if err != nil {
+			logger.Error("http listener failed", "err", err)
+		}
+	} else if graphiteCommand.Parsed() {
+		mapper, err := graphite.NewMapper(graphiteTemplates, pipeline.TypesDB)
+		if err != nil {
+			logger.Error("invalid graphite templates", "err", err)
+			os.Exit(1)
+		}
+		err = graphiteserver.Listen(ctx, graphiteserver.Config{
+			Network:        *graphiteNetwork,
+			Address:        net.JoinHostPort(*graphiteIPAddress, strconv.Itoa(*graphitePort)),
+			Pickle:         *graphitePickle,
+			MaxMessageSize: *graphiteMaxMessageSize,
+			IdleTimeout:    *graphiteIdleTimeout,
+		}, mapper, b.Publisher("graphite"), promIntf, pipeline, *stats, logger)
+		if err != nil {
+			logger.Error("graphite listener failed", "err", err)
+		}
+	} else if statsdCommand.Parsed() {
+		timerType, err := statsd.ParseTimerType(*statsdTimerType)
+		if err != nil {
+			logger.Error("invalid statsd options", "err", err)
+			os.Exit(1)
+		}
+		exporter := statsd.NewExporter(cache, logger)
+		exporter.TTL = *statsdTTL
+		exporter.TimerType = timerType
+		registry.MustRegister(exporter)
+		go func() {
+			_ = exporter.Run(ctx, *statsdFlushInterval)
+		}()
+		err = statsdserver.Listen(ctx, statsdserver.Config{
+			Network:        *statsdNetwork,
+			Address:        net.JoinHostPort(*statsdIPAddress, strconv.Itoa(*statsdPort)),
+			MaxMessageSize: *statsdMaxMessageSize,
+			IdleTimeout:    *statsdIdleTimeout,
+		}, exporter, b.Publisher("statsd"), promIntf, *stats, logger)
+		if err != nil {
+			logger.Error("statsd listener failed", "err", err)
+		}
+	} else if influxCommand.Parsed() {
+		precision, err := influx.ParsePrecision(*influxPrecision)
+		if err != nil {
+			logger.Error("invalid influx options", "err", err)
+			os.Exit(1)
+		}
+		httpCfg, err := influxHTTPConfig()
+		if err != nil {
+			logger.Error("invalid influx options", "err", err)
+			os.Exit(1)
+		}
+		err = influxserver.Listen(ctx, influxserver.Config{
+			Network:   *influxNetwork,
+			HTTP:      httpCfg,
+			Address:   net.JoinHostPort(*influxIPAddress, strconv.Itoa(*influxPort)),
+			Precision: precision,
+			StaleTime: staleTimes[influxCommand].Seconds(),
+		}, b.Publisher("influx"), promIntf, pipeline, *stats, logger)
+		if err != nil {
+			logger.Error("influx listener failed", "err", err)
+		}
+	} else if otlpCommand.Parsed() {
+		cfg, err := otlpHTTPConfig()
+		if err != nil {
+			logger.Error("invalid otlp options", "err", err)
+			os.Exit(1)
+		}
+		cfg.Address = net.JoinHostPort(*otlpIPAddress, strconv.Itoa(*otlpPort))
+		var allowlist []string
+		for _, attribute := range strings.Split(*otlpResourceAttributes, ",") {
+			if attribute = strings.TrimSpace(attribute); attribute != "" {
+				allowlist = append(allowlist, attribute)
+			}
+		}
+		err = otlpserver.Listen(ctx, cfg, otlp.NewTranslator(allowlist), staleTimes[otlpCommand].Seconds(), b.Publisher("otlp"), promIntf, pipeline, *stats, logger)
+		if err != nil {
+			logger.Error("otlp listener failed", "err", err)
+		}
+	} else if transportCommand.Parsed() {
+		t, err := transport.New(*transportName, transport.Env{Address: *transportAddress, Logger: logger})
+		if err != nil {
+			logger.Error("could not create transport", "err", err)
+			os.Exit(1)
+		}
+		err = t.Listen(ctx, h.Handle, pub, promIntf, *stats)
+		if err != nil {
+			logger.Error("transport listener failed", "err", err)
+		}
+	} else if replayCommand.Parsed() {
+		err = replay.Listen(ctx, *replayFile, *replaySpeed, dict, promIntf,
+			handler.Env{Context: ctx, Pipeline: pipeline, Cache: cache, Logger: logger, StaleTime: staleTimes[replayCommand].Seconds()}, registry)
+		if err != nil {
+			logger.Error("replay failed", "err", err)
+		} else if *replayHold {
+			<-ctx.Done()
 		}
 	}
+
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/infrawatch/sg-core/pkg/capture"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
+)
+
+// trainDictionary builds zstd dictionary out of messages recorded in capture
+// file and reports how much it improves compression of those messages
+func trainDictionary(file string, out string, size int, logger logging.Logger) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := capture.NewReader(f, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	samples := [][]byte{}
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		samples = append(samples, rec.Msg)
+	}
+
+	dict, err := zstdutil.TrainDictionary(samples, size)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, dict, 0644); err != nil {
+		return err
+	}
+
+	plain, err := zstdutil.NewCodec(nil)
+	if err != nil {
+		return err
+	}
+	trained, err := zstdutil.NewCodec(dict)
+	if err != nil {
+		return err
+	}
+	var raw, withoutDict, withDict int
+	for _, s := range samples {
+		raw += len(s)
+		withoutDict += len(plain.Compress(nil, s))
+		withDict += len(trained.Compress(nil, s))
+	}
+	id, _ := zstdutil.DictionaryID(dict)
+	logger.Info("dictionary trained", "file", out, "id", id, "size", len(dict), "samples", len(samples),
+		"raw_bytes", raw, "zstd_bytes", withoutDict, "zstd_dict_bytes", withDict)
+	return nil
+}
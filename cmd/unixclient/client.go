@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
 )
 
 func usage() {
@@ -97,6 +98,8 @@ func main() {
 	metricPerMsg := flag.Int("mpm", 1, "Number of metrics per messsage")
 	msgCount := flag.Int("count", 1000000, "Number of metrics to send")
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	compress := flag.Bool("zstd", false, "zstd compress messages")
+	dictionary := flag.String("dictionary", "", "zstd dictionary used to compress messages")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -121,12 +124,28 @@ func main() {
 	}
 
 	addr := args[0]
+	var err error
 
 	metric := collectd.GenCPUMetric(10, "Goblin", *metricPerMsg)
+	if *compress || *dictionary != "" {
+		var dict []byte
+		if *dictionary != "" {
+			if dict, err = zstdutil.LoadDictionary(*dictionary); err != nil {
+				log.Fatal(err)
+			}
+		}
+		codec, err := zstdutil.NewCodec(dict)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compressed := codec.Compress(nil, metric)
+		fmt.Printf("Compressed message from %d to %d bytes\n", len(metric), len(compressed))
+		metric = compressed
+	}
 
 	ctx := context.Background()
 
-	err := sendMetrics(ctx, addr, *msgCount, *hostsNum, metric)
+	err = sendMetrics(ctx, addr, *msgCount, *hostsNum, metric)
 	if err != nil {
 		fmt.Printf("Error occurred: %s\n", err)
 	}
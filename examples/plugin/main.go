@@ -0,0 +1,137 @@
+// Example plugin registering a format of "<name> <value>" lines, each stored
+// as a gauge, and a transport reading the lines of a file as messages. Build
+// it against the sources and toolchain of the server with
+//
+//	go build -buildmode=plugin -o example.so ./examples/plugin
+//
+// and load it with a plugins file passed to -plugins:
+//
+//	{"plugins": [{"path": "example.so", "config": {"format": "lines", "prefix": "site_", "transport": "file"}}]}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/handler"
+	"github.com/infrawatch/sg-core/pkg/plugin"
+	"github.com/infrawatch/sg-core/pkg/transport"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reasonMalformedLines reason lines are rejected, registered by Init
+const reasonMalformedLines = "malformed_lines"
+
+// SGCoreAPIVersion plugin API version the plugin is built against
+var SGCoreAPIVersion = plugin.APIVersion
+
+// config block of the plugin
+type config struct {
+	// Format name the handler is registered as, "lines" when empty
+	Format string `json:"format"`
+	// Prefix of metric names
+	Prefix string `json:"prefix"`
+	// Transport name the file transport is registered as, "file" when empty
+	Transport string `json:"transport"`
+}
+
+// Init registers the lines format, the reason its lines are rejected for and
+// the file transport
+func Init(data []byte) error {
+	var cfg config
+	if len(data) > 0 {
+		if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	if cfg.Format == "" {
+		cfg.Format = "lines"
+	}
+	if cfg.Transport == "" {
+		cfg.Transport = "file"
+	}
+	cdmetrics.RegisterDecodeErrorReasons(reasonMalformedLines)
+	err := handler.Register(cfg.Format, func(env handler.Env) (handler.Handler, error) {
+		return handler.Func(func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+			series, err := decode(msg, cfg.Prefix)
+			return env.Pipeline.ProcessSeries(msg, series, env.StaleTime, err, lm)
+		}), nil
+	})
+	if err != nil {
+		return err
+	}
+	return transport.Register(cfg.Transport, func(env transport.Env) (transport.Transport, error) {
+		if env.Address == "" {
+			return nil, fmt.Errorf("path of the file is required")
+		}
+		return transport.Func(func(ctx context.Context, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool) error {
+			return readFile(ctx, env.Address, process, pub, promIntf.Listener(env.Address, "file"))
+		}), nil
+	})
+}
+
+// readFile passes each line of the file at path as a message to process and
+// waits for ctx to be cancelled
+func readFile(ctx context.Context, path string, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, lm *cdmetrics.ListenerMetrics) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pub != nil {
+			pub.Publish(path, scanner.Bytes())
+		}
+		// rejected lines are counted by the handler
+		_ = process(scanner.Bytes(), lm)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// decode returns a gauge series of each line of msg, invalid lines are
+// skipped and their errors returned joined
+func decode(msg []byte, prefix string) ([]cdmetrics.Series, error) {
+	now := time.Now()
+	var series []cdmetrics.Series
+	var errs []error
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			errs = append(errs, &collectd.ValidationError{Reason: reasonMalformedLines, Err: fmt.Errorf("expected name and value: %q", line)})
+			continue
+		}
+		value, err := strconv.ParseFloat(string(fields[1]), 64)
+		if err != nil {
+			errs = append(errs, &collectd.ValidationError{Reason: reasonMalformedLines, Err: fmt.Errorf("invalid value: %q", line)})
+			continue
+		}
+		series = append(series, cdmetrics.Series{
+			Name:      prefix + string(fields[0]),
+			Value:     value,
+			ValueType: prometheus.GaugeValue,
+			Time:      now,
+		})
+	}
+	return series, errors.Join(errs...)
+}
+
+// main is unused when built as a plugin
+func main() {}
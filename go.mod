@@ -1,9 +1,23 @@
 module github.com/infrawatch/sg-core
 
-go 1.14
+go 1.22
 
 require (
 	collectd.org v0.3.0
 	github.com/json-iterator/go v1.1.9
+	github.com/klauspost/compress v1.18.0
+	github.com/modern-go/reflect2 v1.0.1
 	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/client_model v0.2.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/prometheus/common v0.9.1 // indirect
+	github.com/prometheus/procfs v0.0.8 // indirect
+	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82 // indirect
 )
@@ -0,0 +1,257 @@
+// Package bus copies raw messages received by listeners to observers
+// without slowing down ingest. It is not the path metrics are stored
+// through: handlers are not subscribers, listeners call the handler of their
+// format directly, so metrics are never dropped by a full buffer and decode
+// errors reach the listener, e.g. as HTTP status. Capture is the only
+// subscriber of the server, others such as forwarding may subscribe the
+// same way.
+package bus
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultBufferSize messages buffered per subscriber before dropping
+const DefaultBufferSize = 4096
+
+// Message raw message received by a listener
+type Message struct {
+	// Time the message was received
+	Time time.Time
+	// Source address the message was received on
+	Source string
+	// Format name of the handler of the listener, e.g. collectd
+	Format string
+	// Data shared by all subscribers, read only
+	Data []byte
+}
+
+// DropPolicy decides which message is dropped when the buffer of a
+// subscriber is full. Publishing never blocks
+type DropPolicy int
+
+const (
+	// DropNewest drops the published message
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest buffered message to make room
+	DropOldest
+)
+
+// ParseDropPolicy returns drop policy of name, newest or oldest
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	switch name {
+	case "newest":
+		return DropNewest, nil
+	case "oldest":
+		return DropOldest, nil
+	}
+	return DropNewest, fmt.Errorf("unknown drop policy %q, expected newest or oldest", name)
+}
+
+// Subscription bounded buffer of messages of a subscriber
+type Subscription struct {
+	// C receives published messages, closed on Close or Bus.Close
+	C <-chan Message
+
+	bus    *Bus
+	name   string
+	ch     chan Message
+	policy DropPolicy
+	// guarded by bus.mu
+	closed bool
+
+	// accessed atomically
+	delivered uint64
+	dropped   uint64
+}
+
+// Name of the subscriber
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+// Dropped returns count of messages dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Lag returns count of messages buffered but not yet received
+func (s *Subscription) Lag() int {
+	return len(s.ch)
+}
+
+// Close unsubscribes, buffered messages can still be received from C
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+}
+
+// send buffers m according to the drop policy and reports whether a message
+// was dropped, the bus must be read locked
+func (s *Subscription) send(m Message) (dropped bool) {
+	select {
+	case s.ch <- m:
+		atomic.AddUint64(&s.delivered, 1)
+		return false
+	default:
+	}
+	if s.policy == DropOldest {
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+			dropped = true
+		default:
+		}
+		select {
+		case s.ch <- m:
+			atomic.AddUint64(&s.delivered, 1)
+			return dropped
+		default:
+			// refilled by a concurrent publisher
+		}
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return true
+}
+
+// Bus in-process publish subscribe bus. Each subscriber receives every
+// message published after it subscribed from its own bounded buffer, slow
+// subscribers lose messages instead of blocking publishers or other
+// subscribers. Concurrent
+type Bus struct {
+	logger logging.Logger
+	mu     sync.RWMutex
+	subs   []*Subscription
+	closed bool
+
+	// accessed atomically
+	published uint64
+
+	publishedDesc *prometheus.Desc
+	deliveredDesc *prometheus.Desc
+	droppedDesc   *prometheus.Desc
+	lagDesc       *prometheus.Desc
+	capacityDesc  *prometheus.Desc
+}
+
+// New creates bus
+func New(logger logging.Logger) *Bus {
+	return &Bus{
+		logger: logger,
+		publishedDesc: prometheus.NewDesc("sg_bus_published_total",
+			"Total count of msgs published to the bus.", nil, nil),
+		deliveredDesc: prometheus.NewDesc("sg_bus_delivered_total",
+			"Total count of msgs buffered for a subscriber.", []string{"subscriber"}, nil),
+		droppedDesc: prometheus.NewDesc("sg_bus_dropped_total",
+			"Total count of msgs a subscriber lost because its buffer was full.", []string{"subscriber"}, nil),
+		lagDesc: prometheus.NewDesc("sg_bus_lag",
+			"Msgs buffered for a subscriber but not yet received.", []string{"subscriber"}, nil),
+		capacityDesc: prometheus.NewDesc("sg_bus_capacity",
+			"Size of the buffer of a subscriber.", []string{"subscriber"}, nil),
+	}
+}
+
+// Subscribe returns subscription of subscriber name buffering up to size
+// messages, DefaultBufferSize when not positive. The subscription of a
+// closed bus is closed
+func (b *Bus) Subscribe(name string, size int, policy DropPolicy) *Subscription {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	ch := make(chan Message, size)
+	s := &Subscription{C: ch, bus: b, name: name, ch: ch, policy: policy}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		s.closed = true
+		close(ch)
+		return s
+	}
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// Publish passes m to all subscribers. m.Data is copied when there are
+// subscribers, callers may reuse it
+func (b *Bus) Publish(m Message) {
+	atomic.AddUint64(&b.published, 1)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	m.Data = append([]byte(nil), m.Data...)
+	for _, s := range b.subs {
+		if s.send(m) {
+			b.logger.Warn("subscriber buffer full, dropping message", "subscriber", s.name, "source", m.Source)
+		}
+	}
+}
+
+// Close closes all subscriptions, messages published afterwards are discarded
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, s := range b.subs {
+		s.closed = true
+		close(s.ch)
+	}
+	b.subs = nil
+}
+
+// Publisher returns publisher of messages of format
+func (b *Bus) Publisher(format string) *Publisher {
+	return &Publisher{bus: b, format: format}
+}
+
+// Publisher publishes messages of one format, listeners are passed one
+type Publisher struct {
+	bus    *Bus
+	format string
+}
+
+// Publish publishes msg received on source now
+func (p *Publisher) Publish(source string, msg []byte) {
+	p.bus.Publish(Message{Time: time.Now(), Source: source, Format: p.format, Data: msg})
+}
+
+// Describe implements prometheus.Collector
+func (b *Bus) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.publishedDesc
+	ch <- b.deliveredDesc
+	ch <- b.droppedDesc
+	ch <- b.lagDesc
+	ch <- b.capacityDesc
+}
+
+// Collect implements prometheus.Collector
+func (b *Bus) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(b.publishedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&b.published)))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		ch <- prometheus.MustNewConstMetric(b.deliveredDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&s.delivered)), s.name)
+		ch <- prometheus.MustNewConstMetric(b.droppedDesc, prometheus.CounterValue, float64(s.Dropped()), s.name)
+		ch <- prometheus.MustNewConstMetric(b.lagDesc, prometheus.GaugeValue, float64(s.Lag()), s.name)
+		ch <- prometheus.MustNewConstMetric(b.capacityDesc, prometheus.GaugeValue, float64(cap(s.ch)), s.name)
+	}
+}
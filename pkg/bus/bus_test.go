@@ -0,0 +1,145 @@
+package bus
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// drain returns data of the messages buffered in s
+func drain(s *Subscription) []string {
+	var data []string
+	for {
+		select {
+		case m, ok := <-s.C:
+			if !ok {
+				return data
+			}
+			data = append(data, string(m.Data))
+		default:
+			return data
+		}
+	}
+}
+
+func TestBus(t *testing.T) {
+	t.Run("subscribers receive copies", func(t *testing.T) {
+		b := New(logging.NewNopLogger())
+		// published before anyone subscribed
+		b.Publisher("collectd").Publish("udp", []byte("lost"))
+
+		capture := b.Subscribe("capture", 10, DropNewest)
+		forward := b.Subscribe("forward", 10, DropNewest)
+		msg := []byte("a")
+		b.Publisher("collectd").Publish("/tmp/smartgateway", msg)
+		msg[0] = 'b'
+
+		m := <-capture.C
+		assert.Equals(t, "a", string(m.Data))
+		assert.Equals(t, "/tmp/smartgateway", m.Source)
+		assert.Equals(t, "collectd", m.Format)
+		assert.Assert(t, !m.Time.IsZero(), "missing receive time")
+		assert.Equals(t, []string{"a"}, drain(forward))
+
+		forward.Close()
+		forward.Close()
+		b.Publisher("collectd").Publish("udp", []byte("c"))
+		assert.Equals(t, []string{"c"}, drain(capture))
+		_, ok := <-forward.C
+		assert.Assert(t, !ok, "expected closed subscription")
+
+		b.Close()
+		_, ok = <-capture.C
+		assert.Assert(t, !ok, "expected closed subscription")
+		b.Publisher("collectd").Publish("udp", []byte("discarded"))
+		_, ok = <-b.Subscribe("late", 1, DropNewest).C
+		assert.Assert(t, !ok, "expected closed subscription of closed bus")
+	})
+
+	t.Run("drop policies", func(t *testing.T) {
+		tests := []struct {
+			policy DropPolicy
+			kept   []string
+		}{
+			{DropNewest, []string{"1", "2"}},
+			{DropOldest, []string{"3", "4"}},
+		}
+		for _, test := range tests {
+			b := New(logging.NewNopLogger())
+			s := b.Subscribe("slow", 2, test.policy)
+			for _, data := range []string{"1", "2", "3", "4"} {
+				b.Publish(Message{Data: []byte(data)})
+			}
+			assert.Equals(t, 2, s.Lag())
+			assert.Equals(t, uint64(2), s.Dropped())
+			assert.Equals(t, test.kept, drain(s))
+			assert.Equals(t, 0, s.Lag())
+		}
+
+		policy, err := ParseDropPolicy("oldest")
+		assert.Ok(t, err)
+		assert.Equals(t, DropOldest, policy)
+		_, err = ParseDropPolicy("random")
+		assert.Assert(t, err != nil, "expected unknown policy")
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		b := New(logging.NewNopLogger())
+		s := b.Subscribe("capture", 1, DropNewest)
+		for i := 0; i < 3; i++ {
+			b.Publish(Message{Data: []byte("x")})
+		}
+		registry := prometheus.NewRegistry()
+		assert.Ok(t, registry.Register(b))
+		families, err := registry.Gather()
+		assert.Ok(t, err)
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				if len(m.GetLabel()) > 0 {
+					assert.Equals(t, "capture", m.GetLabel()[0].GetValue())
+				}
+				values[family.GetName()] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			}
+		}
+		assert.Equals(t, map[string]float64{
+			"sg_bus_published_total": 3,
+			"sg_bus_delivered_total": 1,
+			"sg_bus_dropped_total":   2,
+			"sg_bus_lag":             1,
+			"sg_bus_capacity":        1,
+		}, values)
+		s.Close()
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		b := New(logging.NewNopLogger())
+		s := b.Subscribe("capture", 100, DropOldest)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pub := b.Publisher("collectd")
+				for j := 0; j < 1000; j++ {
+					pub.Publish("udp", []byte("x"))
+				}
+			}()
+		}
+		received := 0
+		done := make(chan struct{})
+		go func() {
+			for range s.C {
+				received++
+			}
+			close(done)
+		}()
+		wg.Wait()
+		b.Close()
+		<-done
+		assert.Equals(t, uint64(4000), uint64(received)+s.Dropped())
+	})
+}
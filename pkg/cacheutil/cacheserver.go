@@ -3,7 +3,11 @@ package cacheutil
 import (
 	"container/list"
 	"context"
+	"sync"
 	"time"
+
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Expiry use to free memory after expire condition
@@ -12,54 +16,112 @@ type Expiry interface {
 	Delete()
 }
 
-// CacheServer for now used only to expire Expiry types
+// CacheServer for now used only to expire Expiry types. Register is safe to
+// call from any goroutine including from Expiry.Delete
 type CacheServer struct {
+	mu sync.Mutex
+	// registered since the last sweep, guarded by mu
+	pending []Expiry
+
 	entries  *list.List
 	Interval time.Duration
+	logger   logging.Logger
+
+	sweepDuration prometheus.Histogram
+	expiredTotal  prometheus.Counter
+	entriesCount  prometheus.Gauge
 }
 
 // NewCacheServer CacheServer factory that sets expiry interval in seconds
-func NewCacheServer() *CacheServer {
+func NewCacheServer(logger logging.Logger) *CacheServer {
 	return &CacheServer{
 		entries:  list.New(),
 		Interval: 5,
+		logger:   logger,
+		sweepDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sg_cache_sweep_duration_seconds",
+			Help:    "Time spent checking cache entries for expiry.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		expiredTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_cache_expired_total",
+			Help: "Total count of expired cache entries (label series, metrics and hosts).",
+		}),
+		entriesCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sg_cache_entries",
+			Help: "Count of cache entries after the last sweep.",
+		}),
 	}
 }
 
+// Describe implements prometheus.Collector
+func (cs *CacheServer) Describe(ch chan<- *prometheus.Desc) {
+	cs.sweepDuration.Describe(ch)
+	cs.expiredTotal.Describe(ch)
+	cs.entriesCount.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (cs *CacheServer) Collect(ch chan<- prometheus.Metric) {
+	cs.sweepDuration.Collect(ch)
+	cs.expiredTotal.Collect(ch)
+	cs.entriesCount.Collect(ch)
+}
+
 // Register new expiry object
 func (cs *CacheServer) Register(e Expiry) {
-	cs.entries.PushBack(e)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.pending = append(cs.pending, e)
+}
+
+func (cs *CacheServer) sweep() {
+	start := time.Now()
+
+	cs.mu.Lock()
+	for _, e := range cs.pending {
+		cs.entries.PushBack(e)
+	}
+	cs.pending = nil
+	cs.mu.Unlock()
+
+	expired := 0
+	e := cs.entries.Front()
+	for {
+		if e == nil {
+			break
+		}
+
+		if e.Value.(Expiry).Expired() {
+			e.Value.(Expiry).Delete()
+			n := e.Next()
+			cs.entries.Remove(e)
+			e = n
+			expired++
+			continue
+		}
+		e = e.Next()
+	}
+	cs.sweepDuration.Observe(time.Since(start).Seconds())
+	cs.expiredTotal.Add(float64(expired))
+	cs.entriesCount.Set(float64(cs.entries.Len()))
+	if expired > 0 {
+		cs.logger.Debug("cache sweep", "expired", expired, "entries", cs.entries.Len())
+	}
 }
 
 // Run run cache server
 func (cs *CacheServer) Run(ctx context.Context) error {
 	// expiry loop
+	ticker := time.NewTicker(time.Second * cs.Interval)
+	defer ticker.Stop()
 
-	var err error
 	for {
+		cs.sweep()
 		select {
 		case <-ctx.Done():
-			err = ctx.Err()
-			goto done
-		default:
-			e := cs.entries.Front()
-			for {
-				if e == nil {
-					break
-				}
-
-				if e.Value.(Expiry).Expired() {
-					e.Value.(Expiry).Delete()
-					n := e.Next()
-					cs.entries.Remove(e)
-					e = n
-					continue
-				}
-				e = e.Next()
-			}
-			time.Sleep(time.Second * cs.Interval)
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
-done:
-	return err
 }
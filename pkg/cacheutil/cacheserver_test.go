@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type deleteFn func()
@@ -66,7 +68,7 @@ func (ms *MetricStash) addMetric(metricName string, interval float64, numLabels
 func TestCacheExpiry(t *testing.T) {
 	ms := NewMetricStash()
 
-	cs := NewCacheServer()
+	cs := NewCacheServer(logging.NewNopLogger())
 	cs.Interval = 1
 	ctx := context.Background()
 
@@ -98,4 +100,9 @@ func TestCacheExpiry(t *testing.T) {
 		time.Sleep(time.Millisecond * 2000)
 		assert.Equals(t, 0, len(ms.metrics))
 	})
+
+	t.Run("self metrics", func(t *testing.T) {
+		assert.Equals(t, 13.0, testutil.ToFloat64(cs.expiredTotal))
+		assert.Equals(t, 0.0, testutil.ToFloat64(cs.entriesCount))
+	})
 }
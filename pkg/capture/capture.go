@@ -0,0 +1,67 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Compression of capture files
+type Compression int
+
+// available capture compressions
+const (
+	NONE Compression = iota
+	GZIP
+	ZSTD
+)
+
+// ParseCompression converts compression name to Compression
+func ParseCompression(name string) (Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return NONE, nil
+	case "gzip", "gz":
+		return GZIP, nil
+	case "zstd", "zst":
+		return ZSTD, nil
+	}
+	return NONE, fmt.Errorf("unknown capture compression: %s", name)
+}
+
+// ext file name extension appended for compression
+func (c Compression) ext() string {
+	switch c {
+	case GZIP:
+		return ".gz"
+	case ZSTD:
+		return ".zst"
+	}
+	return ""
+}
+
+// header first line of a framed capture file, headerV1 of files written
+// before records carried their format
+const (
+	header   = "#sg-capture 2\n"
+	headerV1 = "#sg-capture 1\n"
+)
+
+// noFormat recorded for messages without format
+const noFormat = "-"
+
+// Record single captured message
+//
+// Framed capture files start with the header line followed by records
+//
+//	<receive time unix nanoseconds> <message length> <format> <source>\n<message>\n
+//
+// Records of version 1 files lack the format. Legacy capture files hold one
+// message per line with no receive time, format or source
+type Record struct {
+	Time   time.Time
+	Source string
+	// Format of the listener the message was received by, empty when unknown
+	Format string
+	Msg    []byte
+}
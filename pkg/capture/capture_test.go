@@ -0,0 +1,158 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func readAll(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	r, err := NewReader(f, nil)
+	assert.Ok(t, err)
+	defer r.Close()
+
+	records := []Record{}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		assert.Ok(t, err)
+		records = append(records, rec)
+	}
+}
+
+// failingWriter fails the first write
+type failingWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if !fw.failed {
+		fw.failed = true
+		return 0, errors.New("disk full")
+	}
+	return fw.w.Write(p)
+}
+
+func TestCapture(t *testing.T) {
+	msgs := []string{`[{"values":[1]}]`, "multi\nline", ""}
+
+	for _, compression := range []Compression{NONE, GZIP, ZSTD} {
+		t.Run("round trip"+compression.ext(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cd-capture.txt")
+			b := bus.New(logging.NewNopLogger())
+			w, err := NewWriter(Config{Path: path, Compression: compression}, b, logging.NewNopLogger())
+			assert.Ok(t, err)
+			pub := b.Publisher("collectd")
+			for _, msg := range msgs {
+				pub.Publish("/tmp/smartgateway", []byte(msg))
+			}
+			assert.Ok(t, w.Close())
+			pub.Publish("/tmp/smartgateway", []byte("after close"))
+
+			records := readAll(t, path+compression.ext())
+			assert.Equals(t, len(msgs), len(records))
+			for i, rec := range records {
+				assert.Equals(t, msgs[i], string(rec.Msg))
+				assert.Equals(t, "/tmp/smartgateway", rec.Source)
+				assert.Equals(t, "collectd", rec.Format)
+				assert.Assert(t, !rec.Time.IsZero(), "missing receive time")
+			}
+		})
+	}
+
+	t.Run("size rotation", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "cd-capture.txt")
+		b := bus.New(logging.NewNopLogger())
+		w, err := NewWriter(Config{Path: path, MaxSize: 100, MaxFiles: 2}, b, logging.NewNopLogger())
+		assert.Ok(t, err)
+		for i := 0; i < 10; i++ {
+			b.Publish(bus.Message{Time: time.Now(), Source: "udp", Data: []byte(strings.Repeat("x", 60))})
+		}
+		assert.Ok(t, w.Close())
+
+		rotated, err := filepath.Glob(path + ".*")
+		assert.Ok(t, err)
+		assert.Equals(t, 2, len(rotated))
+		for _, f := range rotated {
+			assert.Equals(t, 1, len(readAll(t, f)))
+		}
+	})
+
+	t.Run("age rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		b := bus.New(logging.NewNopLogger())
+		w, err := NewWriter(Config{Path: path, MaxAge: time.Nanosecond}, b, logging.NewNopLogger())
+		assert.Ok(t, err)
+		time.Sleep(10 * time.Millisecond)
+		assert.Ok(t, w.Close())
+		assert.Assert(t, testutil.ToFloat64(w.rotatedTotal) >= 1, "expected age rotation")
+	})
+
+	t.Run("version 1 capture", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		assert.Ok(t, os.WriteFile(path, []byte(headerV1+"1700000000000000000 3 /tmp/smart gateway\n[1]\n"), 0644))
+		records := readAll(t, path)
+		assert.Equals(t, 1, len(records))
+		assert.Equals(t, "/tmp/smart gateway", records[0].Source)
+		assert.Equals(t, "", records[0].Format)
+		assert.Equals(t, "[1]", string(records[0].Msg))
+	})
+
+	t.Run("corrupt record length", func(t *testing.T) {
+		for _, length := range []string{"9223372036854775807", "67108865", "-1", "x"} {
+			r, err := NewReader(strings.NewReader(header+"1700000000000000000 "+length+" collectd udp\n[1]\n"), nil)
+			assert.Ok(t, err)
+			_, err = r.Next()
+			assert.Assert(t, err != nil && err != io.EOF, "expected framing error for length %s, got %v", length, err)
+			r.Close()
+		}
+	})
+
+	t.Run("legacy capture", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		assert.Ok(t, os.WriteFile(path, []byte("[1]\n\n[2]\r\n[3]"), 0644))
+		records := readAll(t, path)
+		assert.Equals(t, 3, len(records))
+		assert.Equals(t, "[2]", string(records[1].Msg))
+		assert.Assert(t, records[0].Time.IsZero(), "legacy records carry no time")
+	})
+	t.Run("write error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		b := bus.New(logging.NewNopLogger())
+		w, err := NewWriter(Config{Path: path}, b, logging.NewNopLogger())
+		assert.Ok(t, err)
+		// the writer goroutine touches the file only after the first publish
+		w.counter.w = &failingWriter{w: w.counter.w}
+
+		// larger than the bufio buffer, so the write reaches the file
+		big := strings.Repeat("x", 8192)
+		b.Publish(bus.Message{Time: time.Now(), Source: "udp", Data: []byte(big)})
+		b.Publish(bus.Message{Time: time.Now(), Source: "udp", Data: []byte("next")})
+		assert.Ok(t, w.Close())
+
+		records := readAll(t, path)
+		assert.Equals(t, 1, len(records))
+		assert.Equals(t, "next", string(records[0].Msg))
+		assert.Assert(t, testutil.ToFloat64(w.errorsTotal) >= 1, "expected write error counted")
+		rotated, err := filepath.Glob(path + ".*")
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(rotated))
+	})
+}
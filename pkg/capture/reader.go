@@ -0,0 +1,158 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxLineSize longest legacy capture line accepted
+const maxLineSize = 1024 * 1024
+
+// MaxRecordSize bytes of the longest message captured, Writer skips larger
+// messages and Reader rejects records claiming more as corrupt
+const MaxRecordSize = 64 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Reader reads records of framed or legacy capture files, compressed or not
+type Reader struct {
+	r      *bufio.Reader
+	closer func()
+	framed bool
+	// fields of framed record headers, 3 without format
+	fields int
+}
+
+// NewReader detects compression and format of capture in r. dictionary is
+// needed for zstd captures written with one, it may be nil otherwise
+func NewReader(r io.Reader, dictionary []byte) (*Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	reader := &Reader{closer: func() {}}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		reader.r = bufio.NewReader(gr)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstdutil.DecoderOptions(dictionary)...)
+		if err != nil {
+			return nil, err
+		}
+		reader.r = bufio.NewReader(zr)
+		reader.closer = zr.Close
+	default:
+		reader.r = br
+	}
+
+	h, err := reader.r.Peek(len(header))
+	if err == nil && (string(h) == header || string(h) == headerV1) {
+		reader.framed = true
+		reader.fields = 4
+		if string(h) == headerV1 {
+			reader.fields = 3
+		}
+		if _, err := reader.r.Discard(len(header)); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Framed whether capture records carry receive time and source, and format
+// unless written by older versions
+func (r *Reader) Framed() bool {
+	return r.framed
+}
+
+// Close releases decompressor resources, it does not close the underlying reader
+func (r *Reader) Close() {
+	r.closer()
+}
+
+// Next returns next record or io.EOF at the end of capture
+func (r *Reader) Next() (Record, error) {
+	if r.framed {
+		return r.nextFramed()
+	}
+	return r.nextLine()
+}
+
+func (r *Reader) nextLine() (Record, error) {
+	for {
+		line, err := r.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// line longer than the reader buffer, collect it in pieces
+			full := append([]byte(nil), line...)
+			for err == bufio.ErrBufferFull && len(full) < maxLineSize {
+				line, err = r.r.ReadSlice('\n')
+				full = append(full, line...)
+			}
+			if err == bufio.ErrBufferFull {
+				return Record{}, fmt.Errorf("capture line longer than %d bytes", maxLineSize)
+			}
+			line = full
+		}
+		if err != nil && err != io.EOF {
+			return Record{}, err
+		}
+		msg := bytes.TrimRight(line, "\r\n")
+		if len(msg) > 0 {
+			return Record{Msg: append([]byte(nil), msg...)}, nil
+		}
+		if err == io.EOF {
+			return Record{}, io.EOF
+		}
+	}
+}
+
+func (r *Reader) nextFramed() (Record, error) {
+	head, err := r.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && head == "" {
+			return Record{}, io.EOF
+		}
+		return Record{}, fmt.Errorf("truncated capture record header: %w", err)
+	}
+	head = head[:len(head)-1]
+
+	var rec Record
+	var ts, length int64
+	fields := bytes.SplitN([]byte(head), []byte(" "), r.fields)
+	if len(fields) != r.fields {
+		return Record{}, fmt.Errorf("malformed capture record header: %q", head)
+	}
+	if ts, err = strconv.ParseInt(string(fields[0]), 10, 64); err != nil {
+		return Record{}, fmt.Errorf("malformed capture record time: %w", err)
+	}
+	if length, err = strconv.ParseInt(string(fields[1]), 10, 64); err != nil || length < 0 || length > MaxRecordSize {
+		return Record{}, fmt.Errorf("malformed capture record length: %q", fields[1])
+	}
+	rec.Time = time.Unix(0, ts)
+	if r.fields == 4 {
+		if rec.Format = string(fields[2]); rec.Format == noFormat {
+			rec.Format = ""
+		}
+	}
+	rec.Source = string(fields[r.fields-1])
+	rec.Msg = make([]byte, length+1)
+	if _, err := io.ReadFull(r.r, rec.Msg); err != nil {
+		return Record{}, fmt.Errorf("truncated capture record: %w", err)
+	}
+	rec.Msg = rec.Msg[:length]
+	return rec, nil
+}
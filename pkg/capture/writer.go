@@ -0,0 +1,352 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultQueueSize records buffered before capture starts dropping
+const DefaultQueueSize = bus.DefaultBufferSize
+
+// minAgeCheckInterval shortest interval the age of the active file is checked
+const minAgeCheckInterval = time.Millisecond
+
+// Config of capture Writer
+type Config struct {
+	// Path of the active capture file, compression extension is appended
+	Path string
+	// MaxSize bytes written to a file before it is rotated, 0 disables
+	MaxSize int64
+	// MaxAge of a file before it is rotated, 0 disables
+	MaxAge time.Duration
+	// MaxFiles rotated files kept, oldest are removed first, 0 keeps all
+	MaxFiles    int
+	Compression Compression
+	// Dictionary trained zstd dictionary used with ZSTD compression, optional
+	Dictionary []byte
+	// QueueSize records buffered between listeners and the disk, by the bus
+	// subscription of the writer
+	QueueSize int
+	// DropPolicy of the subscription when QueueSize records are buffered
+	DropPolicy bus.DropPolicy
+}
+
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total prometheus.Counter
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.total.Add(float64(n))
+	return n, err
+}
+
+// Writer writes messages published to a bus to rotated capture files from
+// its own goroutine. Listeners never block on capture, messages are dropped
+// when the subscription is full and disk errors are logged and counted
+// instead of stopping ingest
+type Writer struct {
+	cfg    Config
+	logger logging.Logger
+	sub    *bus.Subscription
+	done   chan struct{}
+
+	// owned by the writer goroutine
+	file    *os.File
+	counter *countingWriter
+	comp    io.WriteCloser
+	buf     *bufio.Writer
+	opened  time.Time
+
+	recordsTotal prometheus.Counter
+	droppedTotal prometheus.CounterFunc
+	errorsTotal  prometheus.Counter
+	bytesTotal   prometheus.Counter
+	rotatedTotal prometheus.Counter
+}
+
+// NewWriter opens capture file, subscribes to b as "capture" and starts the
+// writer goroutine. Close must be called to flush buffered records
+func NewWriter(cfg Config, b *bus.Bus, logger logging.Logger) (*Writer, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	w := &Writer{
+		cfg:    cfg,
+		logger: logger,
+		done:   make(chan struct{}),
+		recordsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_capture_records_total",
+			Help: "Total count of msgs written to capture.",
+		}),
+		errorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_capture_errors_total",
+			Help: "Total count of capture file errors.",
+		}),
+		bytesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_capture_bytes_total",
+			Help: "Total count of bytes written to capture files after compression.",
+		}),
+		rotatedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sg_capture_rotations_total",
+			Help: "Total count of capture file rotations.",
+		}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	w.sub = b.Subscribe("capture", cfg.QueueSize, cfg.DropPolicy)
+	w.droppedTotal = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "sg_capture_dropped_total",
+		Help: "Total count of msgs dropped because the capture queue was full.",
+	}, func() float64 {
+		return float64(w.sub.Dropped())
+	})
+	go w.run()
+	return w, nil
+}
+
+// Close unsubscribes, flushes queued records and closes the capture file
+func (w *Writer) Close() error {
+	w.sub.Close()
+	<-w.done
+	return nil
+}
+
+func (w *Writer) activePath() string {
+	return w.cfg.Path + w.cfg.Compression.ext()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.activePath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.counter = &countingWriter{w: f, total: w.bytesTotal}
+	switch w.cfg.Compression {
+	case GZIP:
+		w.comp = gzip.NewWriter(w.counter)
+	case ZSTD:
+		zw, err := zstd.NewWriter(w.counter, zstdutil.EncoderOptions(w.cfg.Dictionary)...)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.comp = zw
+	default:
+		w.comp = nopCloser{w.counter}
+	}
+	w.buf = bufio.NewWriter(w.comp)
+	w.opened = time.Now()
+	_, err = w.buf.WriteString(header)
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.buf.Flush()
+	if cerr := w.comp.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
+
+func (w *Writer) fail(msg string, err error) {
+	w.errorsTotal.Inc()
+	w.logger.Error(msg, "file", w.activePath(), "err", err)
+}
+
+// rotate moves the active file aside and opens a new one
+func (w *Writer) rotate() {
+	if err := w.close(); err != nil {
+		w.fail("failed to close capture file", err)
+	}
+	w.moveAside()
+	if err := w.open(); err != nil {
+		w.fail("failed to open capture file", err)
+	}
+}
+
+// reset drops the active file after a write error, bufio.Writer errors are
+// sticky. Records written so far are moved aside and the next record opens
+// a new file
+func (w *Writer) reset() {
+	if w.file == nil {
+		return
+	}
+	// the write error is already reported, closing fails the same way
+	_ = w.close()
+	w.moveAside()
+}
+
+// moveAside renames the closed active file to its rotated name
+func (w *Writer) moveAside() {
+	rotated := w.cfg.Path + "." + w.opened.UTC().Format("20060102T150405.000000000") + w.cfg.Compression.ext()
+	if err := os.Rename(w.activePath(), rotated); err != nil {
+		w.fail("failed to rotate capture file", err)
+	} else {
+		w.rotatedTotal.Inc()
+		w.logger.Info("capture file rotated", "file", rotated)
+	}
+	w.prune()
+}
+
+// prune removes oldest rotated files above MaxFiles
+func (w *Writer) prune() {
+	if w.cfg.MaxFiles <= 0 {
+		return
+	}
+	rotated, err := filepath.Glob(w.cfg.Path + ".*")
+	if err != nil {
+		return
+	}
+	active := w.activePath()
+	files := rotated[:0]
+	for _, f := range rotated {
+		if f != active {
+			files = append(files, f)
+		}
+	}
+	// timestamps in names sort chronologically
+	sort.Strings(files)
+	for len(files) > w.cfg.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			w.fail("failed to remove rotated capture file", err)
+		}
+		files = files[1:]
+	}
+}
+
+func (w *Writer) writeRecord(rec Record) error {
+	if w.file == nil {
+		// previous open failed, retry
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	format := rec.Format
+	if format == "" || strings.ContainsAny(format, " \n") {
+		format = noFormat
+	}
+	line := make([]byte, 0, 64+len(format)+len(rec.Source))
+	line = strconv.AppendInt(line, rec.Time.UnixNano(), 10)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(len(rec.Msg)), 10)
+	line = append(line, ' ')
+	line = append(line, format...)
+	line = append(line, ' ')
+	line = append(line, rec.Source...)
+	line = append(line, '\n')
+	if _, err := w.buf.Write(line); err != nil {
+		return err
+	}
+	if _, err := w.buf.Write(rec.Msg); err != nil {
+		return err
+	}
+	return w.buf.WriteByte('\n')
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	var ageC <-chan time.Time
+	if w.cfg.MaxAge > 0 {
+		// tickers panic on non-positive intervals
+		interval := w.cfg.MaxAge / 10
+		if interval < minAgeCheckInterval {
+			interval = minAgeCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ageC = ticker.C
+	}
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case m, ok := <-w.sub.C:
+			if !ok {
+				if err := w.close(); err != nil {
+					w.fail("failed to close capture file", err)
+				}
+				return
+			}
+			if len(m.Data) > MaxRecordSize {
+				w.fail("skipped capture record", fmt.Errorf("%d bytes from %s exceed %d", len(m.Data), m.Source, MaxRecordSize))
+				continue
+			}
+			rec := Record{Time: m.Time, Source: m.Source, Format: m.Format, Msg: m.Data}
+			if err := w.writeRecord(rec); err != nil {
+				w.fail("failed to write capture record", err)
+				w.reset()
+				continue
+			}
+			w.recordsTotal.Inc()
+			if w.cfg.MaxSize > 0 && w.counter.n+int64(w.buf.Buffered()) >= w.cfg.MaxSize {
+				w.rotate()
+			}
+		case <-ageC:
+			if time.Since(w.opened) >= w.cfg.MaxAge {
+				w.rotate()
+			}
+		case <-flush.C:
+			if w.file != nil {
+				if err := w.buf.Flush(); err != nil {
+					w.fail("failed to flush capture file", err)
+					w.reset()
+				}
+			}
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (w *Writer) Describe(ch chan<- *prometheus.Desc) {
+	w.recordsTotal.Describe(ch)
+	w.droppedTotal.Describe(ch)
+	w.errorsTotal.Describe(ch)
+	w.bytesTotal.Describe(ch)
+	w.rotatedTotal.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (w *Writer) Collect(ch chan<- prometheus.Metric) {
+	w.recordsTotal.Collect(ch)
+	w.droppedTotal.Collect(ch)
+	w.errorsTotal.Collect(ch)
+	w.bytesTotal.Collect(ch)
+	w.rotatedTotal.Collect(ch)
+}
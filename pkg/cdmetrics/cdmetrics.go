@@ -0,0 +1,418 @@
+package cdmetrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func genMetricName(cd *collectd.Collectd, index int) (name string) {
+
+	name = "collectd_" + cd.Plugin + "_" + cd.Type
+	if cd.Type == cd.Plugin {
+		name = "collectd_" + cd.Plugin
+	}
+
+	if dsname := cd.Dsnames[index]; dsname != "value" {
+		name += "_" + dsname
+	}
+
+	switch cd.Dstypes[index] {
+	case "counter", "derive", "absolute":
+		name += "_total"
+	}
+
+	return
+}
+
+// CDMetricDescription ...
+type CDMetricDescription struct {
+	metricName string
+	metricDesc *prometheus.Desc
+}
+
+// CDMetricDescriptions ...
+type CDMetricDescriptions struct {
+	// map[metricName+labelNames], a metric has a description per label set
+	descriptions map[string]*CDMetricDescription
+}
+
+// NewCDMetricDescriptions ...
+func NewCDMetricDescriptions() (metricDescriptions *CDMetricDescriptions) {
+	metricDescriptions = &CDMetricDescriptions{make(map[string]*CDMetricDescription)}
+
+	return
+}
+
+func (a *CDMetricDescriptions) getOrAddMetricDescription(metricName string, labelNames []string) (desc *prometheus.Desc) {
+	var found bool
+
+	var metricDescription *CDMetricDescription
+
+	// labels of the same metric differ with the instances present
+	key := metricName + "\xff" + strings.Join(labelNames, "\xff")
+	if metricDescription, found = a.descriptions[key]; !found {
+		metricDescription = &CDMetricDescription{metricName, prometheus.NewDesc(metricName,
+			"", labelNames, nil,
+		)}
+		a.descriptions[key] = metricDescription
+	}
+
+	desc = metricDescription.metricDesc
+
+	return
+}
+
+type deleteFn func()
+
+// CDLabelSeries represents collectd data_set_t which is a data series mapped to a label in a metric.
+// Values are guarded by the owning CDMetric, only lastArrival is safe to access concurrently
+type CDLabelSeries struct {
+	// unix nanoseconds, accessed atomically
+	lastArrival int64
+
+	host        string
+	labelValues []string
+	metric      float64
+	timeStamp   time.Time
+	valueType   prometheus.ValueType
+	metricDesc  *prometheus.Desc
+	interval    float64
+
+	deleteFn deleteFn
+}
+
+func (cdls *CDLabelSeries) keepAlive() {
+	atomic.StoreInt64(&cdls.lastArrival, time.Now().UnixNano())
+}
+
+func (cdls *CDLabelSeries) staleTime() float64 {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&cdls.lastArrival))).Seconds()
+}
+
+// Expired implements cacheutil.Expiry
+func (cdls *CDLabelSeries) Expired() bool {
+	return (cdls.staleTime() >= cdls.interval)
+}
+
+// Delete implements cacheutil.Expiry
+func (cdls *CDLabelSeries) Delete() {
+	cdls.deleteFn()
+}
+
+// CDMetric represents a collectd metric which can have several dataseries marked with labels. Concurrent
+type CDMetric struct {
+	// map[labelName]
+	labels   map[string]*CDLabelSeries
+	mu       sync.RWMutex
+	deleteFn deleteFn
+
+	// name before sanitization and type, further data sources sanitized to
+	// the same name or of another type collide with this metric
+	rawName   string
+	valueType prometheus.ValueType
+}
+
+// NewCDMetric ...
+func NewCDMetric() *CDMetric {
+	return &CDMetric{
+		labels: make(map[string]*CDLabelSeries),
+		mu:     sync.RWMutex{},
+	}
+}
+
+// Set ...
+func (cdm *CDMetric) Set(labelName string, cdlm *CDLabelSeries) {
+	cdm.mu.Lock()
+	defer cdm.mu.Unlock()
+
+	cdm.labels[labelName] = cdlm
+}
+
+// Get ...
+func (cdm *CDMetric) Get(labelName string) *CDLabelSeries {
+	cdm.mu.RLock()
+	defer cdm.mu.RUnlock()
+	return cdm.labels[labelName]
+}
+
+// Expired implements cacheutil.Expiry
+func (cdm *CDMetric) Expired() bool {
+	cdm.mu.RLock()
+	defer cdm.mu.RUnlock()
+
+	return len(cdm.labels) == 0
+}
+
+// Delete implements cacheutil.Expiry
+func (cdm *CDMetric) Delete() {
+	cdm.deleteFn()
+}
+
+// CDMetrics stash of CDMetric types. Concurrent
+type CDMetrics struct {
+	mu           sync.RWMutex
+	descriptions *CDMetricDescriptions
+	// map[metricName]
+	metrics map[string]*CDMetric
+	hosts   *CDHosts
+	logger  logging.Logger
+	// UseTimestamp propagates collectd timestamps to prometheus metrics
+	UseTimestamp bool
+	// Naming scheme of metric and label names of new series
+	Naming Naming
+	// OmitEmptyLabels leaves out labels of empty instances instead of
+	// exporting them as "base"
+	OmitEmptyLabels bool
+
+	seriesCountDesc *prometheus.Desc
+}
+
+// DefaultHostGracePeriod time a quiet host is kept reported as down
+const DefaultHostGracePeriod = 5 * time.Minute
+
+// NewCDMetrics  CDMetrics factory
+func NewCDMetrics(hostGracePeriod time.Duration, logger logging.Logger) (m *CDMetrics) {
+	m = &CDMetrics{
+		descriptions: NewCDMetricDescriptions(),
+		metrics:      make(map[string]*CDMetric),
+		hosts:        NewCDHosts(hostGracePeriod, logger),
+		logger:       logger,
+		seriesCountDesc: prometheus.NewDesc("sg_series_count",
+			"Count of label series currently stored.",
+			nil, nil,
+		),
+		mu: sync.RWMutex{},
+	}
+
+	return m
+}
+
+func (a *CDMetrics) updateOrAddMetric(cd *collectd.Collectd, index int, cs *cacheutil.CacheServer, staleTime float64) error {
+
+	if cd.Host == "" {
+		return fmt.Errorf("missing host: %v ", cd)
+	}
+
+	labelNames, labelValues := a.Naming.labels(cd, a.OmitEmptyLabels)
+	for i := range labelNames {
+		for j := i + 1; j < len(labelNames); j++ {
+			if labelNames[i] == labelNames[j] {
+				return &collectd.ValidationError{Reason: ReasonNameCollision,
+					Err: fmt.Errorf("plugin %q collides with label %s", cd.Plugin, labelNames[j])}
+			}
+		}
+	}
+	rawName := a.Naming.metricName(cd, index)
+
+	value := float64(cd.Values[index])
+
+	// Convert to getOrAddMetric!
+
+	var valueType prometheus.ValueType
+	switch cd.Dstypes[index] {
+	case "gauge":
+		valueType = prometheus.GaugeValue
+	case "counter", "derive", "absolute":
+		valueType = prometheus.CounterValue
+	default:
+		return fmt.Errorf("unknown name of value type: %s", cd.Dstypes[index])
+	}
+
+	return a.updateOrAddSeries(rawName, labelNames, labelValues, value, valueType, cd.Dstypes[index], cd.Time.Time(),
+		SanitizeLabelValue(cd.Host), cd.Interval, cs, staleTime)
+}
+
+// updateOrAddSeries stores value of series rawName with sanitized labels,
+// new series are registered to cs for expiry. host is accounted in host
+// metrics unless empty, typeName only names the type in errors
+func (a *CDMetrics) updateOrAddSeries(rawName string, labelNames []string, labelValues []string, value float64, valueType prometheus.ValueType,
+	typeName string, timeStamp time.Time, host string, interval float64, cs *cacheutil.CacheServer, staleTime float64) error {
+	metricName := SanitizeMetricName(rawName)
+	labelKey := strings.Join(labelNames, "\xff") + "\xfe" + strings.Join(labelValues, "\xff")
+
+	metric := a.metrics[metricName]
+	if metric != nil && metric.rawName != rawName {
+		return &collectd.ValidationError{Reason: ReasonNameCollision,
+			Err: fmt.Errorf("%s sanitized to %s of %s", rawName, metricName, metric.rawName)}
+	}
+	if metric != nil && metric.valueType != valueType {
+		return &collectd.ValidationError{Reason: ReasonNameCollision,
+			Err: fmt.Errorf("%s of type %s collides with a metric of another type", metricName, typeName)}
+	}
+
+	desc := a.descriptions.getOrAddMetricDescription(metricName, labelNames)
+
+	a.hosts.received(time.Now())
+	if host != "" {
+		a.hosts.seen(host, cs)
+	}
+
+	if metric == nil {
+		metric = NewCDMetric()
+		metric.rawName = rawName
+		metric.valueType = valueType
+		a.metrics[metricName] = metric
+
+		metric.deleteFn = func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.metrics[metricName] == metric {
+				delete(a.metrics, metricName)
+			}
+			a.logger.Debug("metric deleted", "metric", metricName)
+		}
+		cs.Register(metric)
+	}
+
+	if labelSeries := metric.Get(labelKey); labelSeries != nil {
+		metric.mu.Lock()
+		labelSeries.metric = value
+		labelSeries.timeStamp = timeStamp
+		metric.mu.Unlock()
+		labelSeries.keepAlive()
+	} else {
+		labelSeries := &CDLabelSeries{
+			host:        host,
+			labelValues: labelValues,
+			metric:      value,
+			timeStamp:   timeStamp,
+			metricDesc:  desc,
+			valueType:   valueType,
+			interval: func() float64 {
+				if interval != 0.0 && (interval*5) > staleTime {
+					staleTime = interval * 5
+				}
+				return staleTime
+			}(),
+		}
+		labelSeries.keepAlive()
+
+		metric.Set(labelKey, labelSeries)
+		if host != "" {
+			a.hosts.addSeries(host, cs)
+		}
+		a.logger.Debug("label series added", "metric", metricName, "labels", labelNames, "values", labelValues)
+
+		labelSeries.deleteFn = func() {
+			metric.mu.Lock()
+			defer metric.mu.Unlock()
+
+			a.logger.Debug("label series deleted", "metric", metricName, "label", labelKey, "inactive", labelSeries.staleTime())
+			delete(metric.labels, labelKey)
+			if labelSeries.host != "" {
+				a.hosts.deleteSeries(labelSeries.host)
+			}
+		}
+
+		cs.Register(labelSeries)
+	}
+
+	return nil
+}
+
+// UpdateOrAddMetrics stores all data sources of cdMetric, new series are
+// registered to cs for expiry. Data sources which can't be stored, e.g. because
+// their name collides with another metric, are skipped and their errors returned
+func (a *CDMetrics) UpdateOrAddMetrics(cdMetric *collectd.Collectd, cs *cacheutil.CacheServer, staleTime float64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var errs []error
+	for index := range cdMetric.Dsnames {
+		if err := a.updateOrAddMetric(cdMetric, index, cs, staleTime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Series sample of a series with arbitrary labels, for formats other than
+// collectd. Names and values are sanitized when stored
+type Series struct {
+	Name        string
+	LabelNames  []string
+	LabelValues []string
+	Value       float64
+	ValueType   prometheus.ValueType
+	Time        time.Time
+	// Host accounted in the host metrics, optional
+	Host string
+}
+
+// UpdateOrAddSeries stores s like UpdateOrAddMetrics stores collectd data
+// sources, new series are registered to cs for expiry after staleTime seconds
+// without updates. Labels are sorted by name, label names colliding after
+// sanitization are rejected
+func (a *CDMetrics) UpdateOrAddSeries(s *Series, cs *cacheutil.CacheServer, staleTime float64) error {
+	if len(s.LabelNames) != len(s.LabelValues) {
+		return fmt.Errorf("%s: %d label names, but %d values", s.Name, len(s.LabelNames), len(s.LabelValues))
+	}
+	labels := make([][2]string, len(s.LabelNames))
+	for i, name := range s.LabelNames {
+		labels[i] = [2]string{SanitizeLabelName(name), SanitizeLabelValue(s.LabelValues[i])}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	labelNames := make([]string, len(labels))
+	labelValues := make([]string, len(labels))
+	for i, label := range labels {
+		if i > 0 && labels[i-1][0] == label[0] {
+			return &collectd.ValidationError{Reason: ReasonNameCollision,
+				Err: fmt.Errorf("%s: duplicate label %s", s.Name, label[0])}
+		}
+		labelNames[i], labelValues[i] = label[0], label[1]
+	}
+	typeName := "gauge"
+	if s.ValueType == prometheus.CounterValue {
+		typeName = "counter"
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.updateOrAddSeries(s.Name, labelNames, labelValues, s.Value, s.ValueType, typeName, s.Time,
+		SanitizeLabelValue(s.Host), 0, cs, staleTime)
+}
+
+// Describe ...
+// Descriptors of collectd metrics are created as data arrives and the same
+// metric may carry different label names, so only static descriptors are described
+func (a *CDMetrics) Describe(ch chan<- *prometheus.Desc) {
+	a.hosts.Describe(ch)
+	ch <- a.seriesCountDesc
+}
+
+// Collect implements prometheus.Collector
+func (a *CDMetrics) Collect(ch chan<- prometheus.Metric) {
+	a.hosts.Collect(ch)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	seriesCount := 0
+	for _, metric := range a.metrics {
+		metric.mu.RLock()
+		defer metric.mu.RUnlock()
+		seriesCount += len(metric.labels)
+		for _, labeledMetric := range metric.labels {
+			m, err := prometheus.NewConstMetric(labeledMetric.metricDesc, labeledMetric.valueType, labeledMetric.metric,
+				labeledMetric.labelValues...)
+			if err != nil {
+				// invalid names must not fail the whole scrape
+				a.logger.Debug("skipping invalid metric", "err", err)
+				continue
+			}
+			if a.UseTimestamp {
+				m = prometheus.NewMetricWithTimestamp(labeledMetric.timeStamp, m)
+			}
+			ch <- m
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(a.seriesCountDesc, prometheus.GaugeValue, float64(seriesCount))
+}
@@ -0,0 +1,457 @@
+package cdmetrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func (a *CDMetrics) metricsLen() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.metrics)
+}
+
+func TestCDMetrics(t *testing.T) {
+	t.Run("CDMetrics expiration", func(t *testing.T) {
+		cd := &collectd.Collectd{
+			Values:   []float64{1.59},
+			Host:     "localhost",
+			Dstypes:  []string{"gauge"},
+			Dsnames:  []string{"dsname0"},
+			Plugin:   "interface",
+			Type:     "ingress",
+			Interval: 0.2, //expire happens at 5x this interval
+		}
+
+		cdmetrics := NewCDMetrics(DefaultHostGracePeriod, logging.NewNopLogger())
+		// ch := make(chan prometheus.Metric)
+
+		cs := cacheutil.NewCacheServer(logging.NewNopLogger())
+		cs.Interval = 1
+		ctx := context.Background()
+
+		go func() {
+			err := cs.Run(ctx)
+			assert.Ok(t, err)
+		}()
+
+		assert.Ok(t, cdmetrics.UpdateOrAddMetrics(cd, cs, 1.0))
+		assert.Equals(t, 1, cdmetrics.metricsLen())
+		for i := 0; i < 3; i++ {
+			// go cdmetrics.Collect(ch)
+			time.Sleep(time.Second * 1)
+		}
+
+		assert.Equals(t, 0, cdmetrics.metricsLen())
+	})
+
+	t.Run("CDMetrics host tracking", func(t *testing.T) {
+		cd := &collectd.Collectd{
+			Values:   []float64{1.59, 2.0},
+			Host:     "localhost",
+			Dstypes:  []string{"gauge", "derive"},
+			Dsnames:  []string{"rx", "tx"},
+			Plugin:   "interface",
+			Type:     "if_octets",
+			Interval: 0.2,
+		}
+
+		cdmetrics := NewCDMetrics(0, logging.NewNopLogger())
+
+		cs := cacheutil.NewCacheServer(logging.NewNopLogger())
+		cs.Interval = 1
+		ctx := context.Background()
+
+		go func() {
+			err := cs.Run(ctx)
+			assert.Ok(t, err)
+		}()
+
+		before := time.Now()
+		assert.Equals(t, int64(0), cdmetrics.hosts.lastSample)
+		assert.Ok(t, cdmetrics.UpdateOrAddMetrics(cd, cs, 1.0))
+		lastSample := time.Unix(0, cdmetrics.hosts.lastSample)
+		assert.Assert(t, !lastSample.Before(before) && !lastSample.After(time.Now()), "unexpected last sample time %v", lastSample)
+		cdmetrics.hosts.mu.RLock()
+		assert.Equals(t, 1, len(cdmetrics.hosts.hosts))
+		assert.Equals(t, 2, cdmetrics.hosts.hosts["localhost"].seriesCount)
+		cdmetrics.hosts.mu.RUnlock()
+
+		time.Sleep(time.Second * 3)
+
+		cdmetrics.hosts.mu.RLock()
+		assert.Equals(t, 0, len(cdmetrics.hosts.hosts))
+		cdmetrics.hosts.mu.RUnlock()
+	})
+
+	t.Run("CDMetrics host grace period", func(t *testing.T) {
+		cd := &collectd.Collectd{
+			Values:   []float64{1.59},
+			Host:     "localhost",
+			Dstypes:  []string{"gauge"},
+			Dsnames:  []string{"value"},
+			Plugin:   "load",
+			Type:     "load",
+			Interval: 0.2,
+		}
+
+		cdmetrics := NewCDMetrics(time.Second*3, logging.NewNopLogger())
+
+		cs := cacheutil.NewCacheServer(logging.NewNopLogger())
+		cs.Interval = 1
+		ctx := context.Background()
+
+		go func() {
+			err := cs.Run(ctx)
+			assert.Ok(t, err)
+		}()
+
+		assert.Ok(t, cdmetrics.UpdateOrAddMetrics(cd, cs, 1.0))
+		time.Sleep(time.Millisecond * 2500)
+
+		cdmetrics.hosts.mu.RLock()
+		assert.Equals(t, 1, len(cdmetrics.hosts.hosts))
+		assert.Assert(t, !cdmetrics.hosts.hosts["localhost"].up(), "host expected to be down")
+		cdmetrics.hosts.mu.RUnlock()
+
+		time.Sleep(time.Second * 3)
+
+		cdmetrics.hosts.mu.RLock()
+		assert.Equals(t, 0, len(cdmetrics.hosts.hosts))
+		cdmetrics.hosts.mu.RUnlock()
+	})
+}
+
+func TestPromIntf(t *testing.T) {
+	t.Run("rates", func(t *testing.T) {
+		promIntf := NewPromIntf()
+		lm := promIntf.Listener("/tmp/test", "unixgram")
+		lm.AddTotalReceived(20)
+		lm.IncTotalAmqpReceived()
+		lm.IncTotalAmqpReceived()
+
+		metricsDelta, msgsDelta := lm.UpdateRates(time.Second * 2)
+		assert.Equals(t, uint64(20), metricsDelta)
+		assert.Equals(t, uint64(2), msgsDelta)
+		assert.Equals(t, 10.0, testutil.ToFloat64(lm.metricsPerSecond))
+		assert.Equals(t, 1.0, testutil.ToFloat64(lm.msgsPerSecond))
+
+		lm.UpdateRates(time.Second)
+		assert.Equals(t, 0.0, testutil.ToFloat64(lm.metricsPerSecond))
+
+		lm.AddTotalReceived(5)
+		metricsDelta, _ = lm.UpdateRates(0)
+		assert.Equals(t, uint64(0), metricsDelta)
+		metricsDelta, _ = lm.UpdateRates(time.Millisecond * 500)
+		assert.Equals(t, uint64(5), metricsDelta)
+		assert.Equals(t, 10.0, testutil.ToFloat64(lm.metricsPerSecond))
+	})
+
+	t.Run("shared by concurrent listeners", func(t *testing.T) {
+		promIntf := NewPromIntf()
+		registry := prometheus.NewRegistry()
+		assert.Ok(t, registry.Register(promIntf))
+
+		wg := sync.WaitGroup{}
+		for _, listener := range []string{"a", "b"} {
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(listener string) {
+					defer wg.Done()
+					lm := promIntf.Listener(listener, "udp")
+					for j := 0; j < 1000; j++ {
+						lm.IncTotalAmqpReceived()
+						lm.AddTotalReceived(2)
+					}
+				}(listener)
+			}
+		}
+		wg.Wait()
+
+		assert.Equals(t, uint64(4000), promIntf.Listener("a", "udp").GetTotalAmqpReceived())
+		assert.Equals(t, uint64(8000), promIntf.Listener("b", "udp").GetTotalMetricsReceived())
+
+		families, err := registry.Gather()
+		assert.Ok(t, err)
+		for _, family := range families {
+			if family.GetName() == "sg_total_amqp_rcv_count" {
+				assert.Equals(t, 2, len(family.GetMetric()))
+			}
+		}
+	})
+}
+
+func TestPipeline(t *testing.T) {
+	t.Run("rejects invalid records", func(t *testing.T) {
+		logger := logging.NewNopLogger()
+		promIntf := NewPromIntf()
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		pipeline := NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+		lm := promIntf.Listener("test", "unixgram")
+
+		msg := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"},
+			{"values":[1,2],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"if","type":"if_octets"},
+			{"values":[1],"dstypes":["bogus"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"if","type":"if_octets"}]`
+		err := pipeline.Process([]byte(msg), lm)
+		assert.Assert(t, err != nil, "expected error for invalid records")
+		assert.Ok(t, pipeline.Process([]byte(`[{"values":[2],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`), lm))
+		assert.Assert(t, pipeline.Process([]byte(`[{"values":`), lm) != nil, "expected error for truncated msg")
+		assert.Assert(t, pipeline.Process([]byte{0x28, 0xb5, 0x2f, 0xfd, 0}, lm) != nil, "expected error for compressed msg")
+
+		assert.Equals(t, uint64(2), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(4), lm.GetTotalDecodeErrors())
+		assert.Equals(t, 1, allMetrics.metricsLen())
+		for reason, count := range map[string]float64{
+			collectd.ReasonLengthMismatch: 1,
+			collectd.ReasonUnknownDstype:  1,
+			collectd.ReasonMalformedJSON:  1,
+			ReasonCompressionDisabled:     1,
+			collectd.ReasonNonFinite:      0,
+		} {
+			assert.Equals(t, count, testutil.ToFloat64(promIntf.decodeErrors.WithLabelValues("test", "unixgram", reason)))
+		}
+
+		// reasons are exported per listener before they occur
+		promIntf.Listener("other", "udp")
+		assert.Equals(t, 2*len(DecodeErrorReasons()), len(gatherLabels(t, promIntf, "sg_decode_errors_total")))
+	})
+
+	t.Run("stores absolute values as counters", func(t *testing.T) {
+		logger := logging.NewNopLogger()
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		pipeline := NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+		lm := NewPromIntf().Listener("test", "unixgram")
+
+		msg := `[{"values":[42],"dstypes":["absolute"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"memcached","type":"total_bytes"}]`
+		assert.Ok(t, pipeline.Process([]byte(msg), lm))
+		assert.Equals(t, uint64(0), lm.GetTotalDecodeErrors())
+		assert.Equals(t, 1, len(gatherLabels(t, allMetrics, "collectd_memcached_total_bytes_total")))
+		assert.Equals(t, prometheus.CounterValue, allMetrics.metrics["collectd_memcached_total_bytes_total"].valueType)
+	})
+}
+
+func TestPipelineSeries(t *testing.T) {
+	logger := logging.NewNopLogger()
+	allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+	pipeline := NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+	lm := NewPromIntf().Listener("test", "udp")
+
+	assert.Ok(t, pipeline.ProcessSeries(nil, []Series{{Name: "short", Time: time.Now()}}, 60, nil, lm))
+	assert.Ok(t, pipeline.ProcessSeries(nil, []Series{{Name: "default", Time: time.Now()}}, 0, nil, lm))
+	assert.Equals(t, uint64(2), lm.GetTotalMetricsReceived())
+	for name, staleTime := range map[string]float64{"short": 60, "default": DefaultStaleTime} {
+		assert.Equals(t, 1, len(allMetrics.metrics[name].labels))
+		for _, series := range allMetrics.metrics[name].labels {
+			assert.Equals(t, staleTime, series.interval)
+		}
+	}
+}
+
+func TestRegisterDecodeErrorReasons(t *testing.T) {
+	n := len(DecodeErrorReasons())
+	RegisterDecodeErrorReasons("test_reason", ReasonDecompress, "test_reason")
+	reasons := DecodeErrorReasons()
+	assert.Equals(t, n+1, len(reasons))
+	assert.Equals(t, "test_reason", reasons[n])
+
+	promIntf := NewPromIntf()
+	promIntf.Listener("test", "udp")
+	found := false
+	for _, labels := range gatherLabels(t, promIntf, "sg_decode_errors_total") {
+		found = found || labels["reason"] == "test_reason"
+	}
+	assert.Assert(t, found, "registered reason not exported")
+}
+
+func TestPipelinePutval(t *testing.T) {
+	logger := logging.NewNopLogger()
+	promIntf := NewPromIntf()
+	allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+	pipeline := NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+	lm := promIntf.Listener("test", "unixgram")
+
+	msg := []byte("PUTVAL h/interface-eth0/if_octets interval=10 N:1:2\nPUTVAL h/cpu-0/cpu-user N:1\n")
+	assert.Assert(t, pipeline.Process(msg, lm) != nil, "expected error without types.db")
+	assert.Equals(t, 0, allMetrics.metricsLen())
+	assert.Equals(t, 2.0, testutil.ToFloat64(promIntf.decodeErrors.WithLabelValues("test", "unixgram", collectd.ReasonUnknownType)))
+
+	pipeline.TypesDB, _ = collectd.LoadTypesDB("../collectd/testdata/types.db")
+	assert.Ok(t, pipeline.Process(msg, lm))
+	assert.Equals(t, 3, allMetrics.metricsLen())
+	assert.Equals(t, uint64(2), lm.GetTotalMetricsReceived())
+
+	// JSON records without data sources are resolved in types.db as well
+	assert.Ok(t, pipeline.Process([]byte(`[{"values":[1,2],"time":1580682811.0,"interval":5,"host":"h","plugin":"disk","plugin_instance":"sda","type":"disk_octets"}]`), lm))
+	assert.Equals(t, 5, allMetrics.metricsLen())
+	err := pipeline.Process([]byte(`[{"values":[120],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`), lm)
+	assert.Assert(t, err != nil, "expected out of range error")
+	assert.Equals(t, 1.0, testutil.ToFloat64(promIntf.decodeErrors.WithLabelValues("test", "unixgram", collectd.ReasonOutOfRange)))
+}
+
+// gatherLabels returns labels of all series of metric family name collected from c
+func gatherLabels(t *testing.T, c prometheus.Collector, name string) []map[string]string {
+	registry := prometheus.NewRegistry()
+	assert.Ok(t, registry.Register(c))
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+
+	series := []map[string]string{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range m.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			series = append(series, labels)
+		}
+	}
+	return series
+}
+
+func TestNaming(t *testing.T) {
+	records := []collectd.Collectd{
+		{Values: []float64{1}, Dstypes: []string{"derive"}, Dsnames: []string{"value"}, Host: "h", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "user"},
+		{Values: []float64{1}, Dstypes: []string{"derive"}, Dsnames: []string{"value"}, Host: "h", Plugin: "cpu", Type: "cpu", TypeInstance: "idle"},
+		{Values: []float64{1}, Dstypes: []string{"derive"}, Dsnames: []string{"value"}, Host: "h", Plugin: "cpu", Type: "cpu"},
+	}
+	store := func(naming Naming, omitEmpty bool) *CDMetrics {
+		logger := logging.NewNopLogger()
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		allMetrics.Naming = naming
+		allMetrics.OmitEmptyLabels = omitEmpty
+		cs := cacheutil.NewCacheServer(logger)
+		for i := range records {
+			assert.Ok(t, allMetrics.UpdateOrAddMetrics(&records[i], cs, DefaultStaleTime))
+		}
+		return allMetrics
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		for _, naming := range []Naming{NamingLegacy, NamingCollectdExporter} {
+			parsed, err := ParseNaming(naming.String())
+			assert.Ok(t, err)
+			assert.Equals(t, naming, parsed)
+		}
+		_, err := ParseNaming("bogus")
+		assert.Assert(t, err != nil, "expected error for unknown naming scheme")
+	})
+
+	t.Run("sg-legacy", func(t *testing.T) {
+		series := gatherLabels(t, store(NamingLegacy, false), "collectd_cpu_total")
+		assert.Equals(t, 3, len(series))
+		assert.Equals(t, []map[string]string{
+			{"host": "h", "plugin_instance": "0", "type_instance": "user"},
+			{"host": "h", "plugin_instance": "base", "type_instance": "base"},
+			{"host": "h", "plugin_instance": "base", "type_instance": "idle"},
+		}, sortedSeries(series))
+	})
+
+	t.Run("sg-legacy omitting empty labels", func(t *testing.T) {
+		series := gatherLabels(t, store(NamingLegacy, true), "collectd_cpu_total")
+		assert.Equals(t, []map[string]string{
+			{"host": "h", "plugin_instance": "0", "type_instance": "user"},
+			{"host": "h", "type_instance": "idle"},
+			{"host": "h"},
+		}, sortedSeries(series))
+	})
+
+	t.Run("collectd_exporter", func(t *testing.T) {
+		for _, omitEmpty := range []bool{false, true} {
+			series := gatherLabels(t, store(NamingCollectdExporter, omitEmpty), "collectd_cpu_total")
+			assert.Equals(t, []map[string]string{
+				{"cpu": "0", "type": "user", "instance": "h"},
+				{"cpu": "idle", "instance": "h"},
+				{"instance": "h"},
+			}, sortedSeries(series))
+		}
+	})
+}
+
+// sortedSeries sorts series by their printed labels
+func sortedSeries(series []map[string]string) []map[string]string {
+	sort.Slice(series, func(i, j int) bool {
+		return fmt.Sprint(series[i]) < fmt.Sprint(series[j])
+	})
+	return series
+}
+
+func TestCollisions(t *testing.T) {
+	logger := logging.NewNopLogger()
+	cs := cacheutil.NewCacheServer(logger)
+	record := func(host string, plugin string, dstype string) *collectd.Collectd {
+		return &collectd.Collectd{Values: []float64{1}, Dstypes: []string{dstype}, Dsnames: []string{"value"},
+			Host: host, Plugin: plugin, PluginInstance: "0", Type: "load", TypeInstance: "x"}
+	}
+
+	t.Run("sanitized names", func(t *testing.T) {
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		assert.Ok(t, allMetrics.UpdateOrAddMetrics(record("h", "foo-bar", "gauge"), cs, DefaultStaleTime))
+		assert.Ok(t, allMetrics.UpdateOrAddMetrics(record("h2", "foo-bar", "gauge"), cs, DefaultStaleTime))
+		err := allMetrics.UpdateOrAddMetrics(record("h", "foo.bar", "gauge"), cs, DefaultStaleTime)
+		assert.Assert(t, err != nil, "expected collision of foo.bar with foo-bar")
+		err = allMetrics.UpdateOrAddMetrics(record("h", "foo_bar", "gauge"), cs, DefaultStaleTime)
+		assert.Assert(t, err != nil, "expected collision of foo_bar with foo-bar")
+		assert.Ok(t, allMetrics.UpdateOrAddMetrics(record("h", "foo-bar", "derive"), cs, DefaultStaleTime))
+		gaugeTotal := record("h", "foo-bar", "gauge")
+		gaugeTotal.Dsnames = []string{"total"}
+		err = allMetrics.UpdateOrAddMetrics(gaugeTotal, cs, DefaultStaleTime)
+		assert.Assert(t, err != nil, "expected collision of gauge with derive collectd_foo_bar_load_total")
+
+		assert.Equals(t, 2, len(gatherLabels(t, allMetrics, "collectd_foo_bar_load")))
+	})
+
+	t.Run("exporter labels", func(t *testing.T) {
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		allMetrics.Naming = NamingCollectdExporter
+		err := allMetrics.UpdateOrAddMetrics(record("h", "type", "gauge"), cs, DefaultStaleTime)
+		assert.Assert(t, err != nil, "expected collision of plugin type with label type")
+		assert.Ok(t, allMetrics.UpdateOrAddMetrics(record("h", "python.mod", "gauge"), cs, DefaultStaleTime))
+		assert.Equals(t, []map[string]string{{"python_mod": "0", "type": "x", "instance": "h"}},
+			gatherLabels(t, allMetrics, "collectd_python_mod_load"))
+	})
+
+	t.Run("invalid utf-8 does not break scrape", func(t *testing.T) {
+		allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+		assert.Ok(t, allMetrics.UpdateOrAddMetrics(record("bad\xffhost", "cpu", "gauge"), cs, DefaultStaleTime))
+		assert.Equals(t, []map[string]string{{"host": "bad�host", "plugin_instance": "0", "type_instance": "x"}},
+			gatherLabels(t, allMetrics, "collectd_cpu_load"))
+	})
+}
+
+func TestSeries(t *testing.T) {
+	logger := logging.NewNopLogger()
+	cs := cacheutil.NewCacheServer(logger)
+	allMetrics := NewCDMetrics(DefaultHostGracePeriod, logger)
+
+	series := &Series{Name: "cpu.usage", LabelNames: []string{"host", "cpu"}, LabelValues: []string{"h", "0"},
+		Value: 1, ValueType: prometheus.GaugeValue, Host: "h"}
+	assert.Ok(t, allMetrics.UpdateOrAddSeries(series, cs, DefaultStaleTime))
+	// label order does not matter
+	series = &Series{Name: "cpu.usage", LabelNames: []string{"cpu", "host"}, LabelValues: []string{"0", "h"},
+		Value: 2, ValueType: prometheus.GaugeValue, Host: "h"}
+	assert.Ok(t, allMetrics.UpdateOrAddSeries(series, cs, DefaultStaleTime))
+	assert.Equals(t, []map[string]string{{"cpu": "0", "host": "h"}}, gatherLabels(t, allMetrics, "cpu_usage"))
+	assert.Equals(t, 1, allMetrics.hosts.hosts["h"].seriesCount)
+
+	series = &Series{Name: "cpu.usage", ValueType: prometheus.CounterValue}
+	err := allMetrics.UpdateOrAddSeries(series, cs, DefaultStaleTime)
+	assert.Assert(t, err != nil, "expected collision of counter with gauge cpu_usage")
+
+	series = &Series{Name: "mem", LabelNames: []string{"a.b", "a-b"}, LabelValues: []string{"1", "2"}}
+	err = allMetrics.UpdateOrAddSeries(series, cs, DefaultStaleTime)
+	assert.Assert(t, err != nil, "expected collision of labels a.b and a-b")
+}
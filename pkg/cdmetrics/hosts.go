@@ -0,0 +1,194 @@
+package cdmetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CDHostStatus tracks arrival times and the number of live label series of a collectd host
+type CDHostStatus struct {
+	host        string
+	firstSeen   time.Time
+	lastSeen    time.Time
+	downSince   time.Time
+	seriesCount int
+
+	hosts *CDHosts
+	cs    *cacheutil.CacheServer
+}
+
+func (hs *CDHostStatus) up() bool {
+	return hs.seriesCount > 0
+}
+
+// Expired implements cacheutil.Expiry. Host expires once it has been down for the grace period
+func (hs *CDHostStatus) Expired() bool {
+	hs.hosts.mu.RLock()
+	defer hs.hosts.mu.RUnlock()
+
+	return !hs.up() && time.Since(hs.downSince) >= hs.hosts.gracePeriod
+}
+
+// Delete implements cacheutil.Expiry
+func (hs *CDHostStatus) Delete() {
+	hs.hosts.mu.Lock()
+	defer hs.hosts.mu.Unlock()
+
+	if hs.up() {
+		// host came back between Expired and Delete, keep watching it
+		hs.cs.Register(hs)
+		return
+	}
+	delete(hs.hosts.hosts, hs.host)
+	hs.hosts.logger.Info("host deleted", "host", hs.host, "inactive", time.Since(hs.lastSeen).Seconds())
+}
+
+// CDHosts registry of collectd hosts. Hosts stay in the registry marked
+// as down for gracePeriod after their last label series expired. Concurrent
+type CDHosts struct {
+	mu sync.RWMutex
+	// map[host]
+	hosts       map[string]*CDHostStatus
+	gracePeriod time.Duration
+	logger      logging.Logger
+	// unix nanoseconds of the last stored sample of any host, accessed atomically
+	lastSample int64
+
+	lastPullDesc      *prometheus.Desc
+	hostStatusDesc    *prometheus.Desc
+	hostLastSeenDesc  *prometheus.Desc
+	metricPerHostDesc *prometheus.Desc
+	hostUpDesc        *prometheus.Desc
+	firstSeenDesc     *prometheus.Desc
+	lastSeenDesc      *prometheus.Desc
+}
+
+// NewCDHosts CDHosts factory
+func NewCDHosts(gracePeriod time.Duration, logger logging.Logger) *CDHosts {
+	return &CDHosts{
+		hosts:       make(map[string]*CDHostStatus),
+		gracePeriod: gracePeriod,
+		logger:      logger,
+		mu:          sync.RWMutex{},
+		lastPullDesc: prometheus.NewDesc("collectd_last_pull_timestamp_seconds",
+			"Unix timestamp of the last sample received in seconds.",
+			nil, nil,
+		),
+		hostStatusDesc: prometheus.NewDesc("collectd_last_metric_for_host_status",
+			"Status of metrics for host currently active.",
+			[]string{"host"}, nil,
+		),
+		hostLastSeenDesc: prometheus.NewDesc("collectd_last_metric_for_host_timestamp_seconds",
+			"Unix timestamp of the last metric received from host in seconds.",
+			[]string{"host"}, nil,
+		),
+		metricPerHostDesc: prometheus.NewDesc("collectd_metric_per_host",
+			"Count of live metric series per host.",
+			[]string{"host"}, nil,
+		),
+		hostUpDesc: prometheus.NewDesc("sg_host_up",
+			"Whether host is reporting metrics (1) or went quiet within the grace period (0).",
+			[]string{"host"}, nil,
+		),
+		firstSeenDesc: prometheus.NewDesc("sg_host_first_seen_timestamp_seconds",
+			"Unix timestamp of the first metric received from host in seconds.",
+			[]string{"host"}, nil,
+		),
+		lastSeenDesc: prometheus.NewDesc("sg_host_last_seen_timestamp_seconds",
+			"Unix timestamp of the last metric received from host in seconds.",
+			[]string{"host"}, nil,
+		),
+	}
+}
+
+func (h *CDHosts) getOrAddHost(host string, cs *cacheutil.CacheServer) *CDHostStatus {
+	status := h.hosts[host]
+	if status == nil {
+		now := time.Now()
+		status = &CDHostStatus{
+			host:      host,
+			firstSeen: now,
+			lastSeen:  now,
+			hosts:     h,
+			cs:        cs,
+		}
+		h.hosts[host] = status
+		cs.Register(status)
+	}
+	return status
+}
+
+// received marks arrival of a sample, of a host or not
+func (h *CDHosts) received(t time.Time) {
+	atomic.StoreInt64(&h.lastSample, t.UnixNano())
+}
+
+// seen marks arrival of a metric from host
+func (h *CDHosts) seen(host string, cs *cacheutil.CacheServer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.getOrAddHost(host, cs).lastSeen = time.Now()
+}
+
+// addSeries accounts a new label series for host
+func (h *CDHosts) addSeries(host string, cs *cacheutil.CacheServer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.getOrAddHost(host, cs).seriesCount++
+}
+
+// deleteSeries removes a label series from host, host goes down along with its last series
+func (h *CDHosts) deleteSeries(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := h.hosts[host]
+	if status == nil || !status.up() {
+		return
+	}
+	status.seriesCount--
+	if !status.up() {
+		status.downSince = time.Now()
+		h.logger.Warn("host down", "host", host, "inactive", time.Since(status.lastSeen).Seconds())
+	}
+}
+
+// Describe ...
+func (h *CDHosts) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.lastPullDesc
+	ch <- h.hostStatusDesc
+	ch <- h.hostLastSeenDesc
+	ch <- h.metricPerHostDesc
+	ch <- h.hostUpDesc
+	ch <- h.firstSeenDesc
+	ch <- h.lastSeenDesc
+}
+
+// Collect implements prometheus.Collector
+func (h *CDHosts) Collect(ch chan<- prometheus.Metric) {
+	if lastSample := atomic.LoadInt64(&h.lastSample); lastSample != 0 {
+		ch <- prometheus.MustNewConstMetric(h.lastPullDesc, prometheus.GaugeValue, float64(lastSample)/1e9)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for host, status := range h.hosts {
+		up := 0.0
+		if status.up() {
+			up = 1.0
+			ch <- prometheus.MustNewConstMetric(h.hostStatusDesc, prometheus.GaugeValue, 1, host)
+			ch <- prometheus.MustNewConstMetric(h.hostLastSeenDesc, prometheus.GaugeValue, float64(status.lastSeen.UnixNano())/1e9, host)
+			ch <- prometheus.MustNewConstMetric(h.metricPerHostDesc, prometheus.GaugeValue, float64(status.seriesCount), host)
+		}
+		ch <- prometheus.MustNewConstMetric(h.hostUpDesc, prometheus.GaugeValue, up, host)
+		ch <- prometheus.MustNewConstMetric(h.firstSeenDesc, prometheus.GaugeValue, float64(status.firstSeen.UnixNano())/1e9, host)
+		ch <- prometheus.MustNewConstMetric(h.lastSeenDesc, prometheus.GaugeValue, float64(status.lastSeen.UnixNano())/1e9, host)
+	}
+}
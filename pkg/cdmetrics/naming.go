@@ -0,0 +1,93 @@
+package cdmetrics
+
+import (
+	"fmt"
+
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+// Naming scheme of exported metric and label names
+type Naming int
+
+const (
+	// NamingLegacy names of the smart gateway, labels host, plugin_instance
+	// and type_instance with "base" for empty instances, unless they are omitted
+	NamingLegacy Naming = iota
+	// NamingCollectdExporter names of prometheus/collectd_exporter, labels
+	// instance, <plugin> for the plugin or type instance and type for the
+	// type instance when both instances are set
+	NamingCollectdExporter
+)
+
+var namingNames = map[Naming]string{
+	NamingLegacy:           "sg-legacy",
+	NamingCollectdExporter: "collectd_exporter",
+}
+
+func (n Naming) String() string {
+	return namingNames[n]
+}
+
+// ParseNaming returns naming scheme of name
+func ParseNaming(name string) (Naming, error) {
+	for naming, s := range namingNames {
+		if s == name {
+			return naming, nil
+		}
+	}
+	return NamingLegacy, fmt.Errorf("unknown naming scheme %q, expected sg-legacy or collectd_exporter", name)
+}
+
+var (
+	legacyLabelNames       = []string{"host", "plugin_instance", "type_instance"}
+	legacyPluginLabelNames = []string{"host", "plugin_instance"}
+	legacyTypeLabelNames   = []string{"host", "type_instance"}
+	legacyHostLabelNames   = []string{"host"}
+)
+
+// metricName unsanitized name of data source index of cd, both schemes name metrics alike
+func (n Naming) metricName(cd *collectd.Collectd, index int) string {
+	return genMetricName(cd, index)
+}
+
+// labels returns sanitized label names and values of cd. Empty instances are
+// omitted when omitEmpty is set, otherwise the legacy scheme exports them as
+// "base". Names must not be modified
+func (n Naming) labels(cd *collectd.Collectd, omitEmpty bool) (names []string, values []string) {
+	host := SanitizeLabelValue(cd.Host)
+	pluginInstance := SanitizeLabelValue(cd.PluginInstance)
+	typeInstance := SanitizeLabelValue(cd.TypeInstance)
+
+	switch n {
+	case NamingCollectdExporter:
+		plugin := SanitizeLabelName(cd.Plugin)
+		switch {
+		case pluginInstance != "" && typeInstance != "":
+			return []string{plugin, "type", "instance"}, []string{pluginInstance, typeInstance, host}
+		case pluginInstance != "":
+			return []string{plugin, "instance"}, []string{pluginInstance, host}
+		case typeInstance != "":
+			return []string{plugin, "instance"}, []string{typeInstance, host}
+		}
+		return []string{"instance"}, []string{host}
+	default:
+		if omitEmpty {
+			switch {
+			case pluginInstance != "" && typeInstance != "":
+				return legacyLabelNames, []string{host, pluginInstance, typeInstance}
+			case pluginInstance != "":
+				return legacyPluginLabelNames, []string{host, pluginInstance}
+			case typeInstance != "":
+				return legacyTypeLabelNames, []string{host, typeInstance}
+			}
+			return legacyHostLabelNames, []string{host}
+		}
+		if pluginInstance == "" {
+			pluginInstance = "base"
+		}
+		if typeInstance == "" {
+			typeInstance = "base"
+		}
+		return legacyLabelNames, []string{host, pluginInstance, typeInstance}
+	}
+}
@@ -0,0 +1,239 @@
+package cdmetrics
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
+)
+
+// ErrEndOfStream returned by Pipeline.Process for messages carrying the negative interval end marker
+var ErrEndOfStream = errors.New("end of stream marker received")
+
+// DefaultStaleTime seconds after which a series without updates expires,
+// unless the collectd interval of the series is longer
+const DefaultStaleTime = 300.0
+
+// Reasons compressed messages or records are rejected besides collectd.Reasons
+const (
+	ReasonCompressionDisabled = "compression_disabled"
+	ReasonDecompress          = "decompress"
+	ReasonNameCollision       = "name_collision"
+)
+
+// decodeErrorReasons registered reasons counted in sg_decode_errors_total
+var decodeErrorReasons = struct {
+	sync.Mutex
+	reasons []string
+}{reasons: append([]string{ReasonCompressionDisabled, ReasonDecompress, ReasonNameCollision}, collectd.Reasons...)}
+
+// RegisterDecodeErrorReasons registers reasons msgs or records of a format
+// are rejected for, format packages call it from init. Registered reasons
+// are exported by listeners created afterwards before they occur
+func RegisterDecodeErrorReasons(reasons ...string) {
+	decodeErrorReasons.Lock()
+	defer decodeErrorReasons.Unlock()
+	for _, reason := range reasons {
+		if !contains(decodeErrorReasons.reasons, reason) {
+			decodeErrorReasons.reasons = append(decodeErrorReasons.reasons, reason)
+		}
+	}
+}
+
+// DecodeErrorReasons returns all registered reasons counted in sg_decode_errors_total
+func DecodeErrorReasons() []string {
+	decodeErrorReasons.Lock()
+	defer decodeErrorReasons.Unlock()
+	return append([]string(nil), decodeErrorReasons.reasons...)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// maxLoggedPayload bytes of a rejected payload included in the log
+const maxLoggedPayload = 512
+
+// Pipeline decodes collectd JSON or PUTVAL messages with pooled decoders and
+// stores them in a metric store.
+// zstd compressed messages are decompressed with codec first. Concurrent
+type Pipeline struct {
+	// 64-bit atomics first for alignment on 32-bit platforms
+	rejected uint64
+
+	// BadPayloadSample logs every n-th rejected payload, 0 disables logging payloads
+	BadPayloadSample uint64
+	// TypesDB resolves data sources of PUTVAL messages, which are rejected when
+	// nil, fills in missing data sources of JSON records and checks records
+	// against their type
+	TypesDB *collectd.TypesDB
+
+	allMetrics *CDMetrics
+	cache      *cacheutil.CacheServer
+	codec      *zstdutil.Codec
+	logger     logging.Logger
+}
+
+// NewPipeline Pipeline factory. Compressed messages are rejected when codec is nil
+func NewPipeline(allMetrics *CDMetrics, cache *cacheutil.CacheServer, codec *zstdutil.Codec, logger logging.Logger) *Pipeline {
+	return &Pipeline{
+		allMetrics: allMetrics,
+		cache:      cache,
+		codec:      codec,
+		logger:     logger,
+	}
+}
+
+// reject counts err as decode error and logs a sample of rejected payloads.
+// Each of joined errors is counted
+func (p *Pipeline) reject(err error, msg []byte, lm *ListenerMetrics) error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			p.reject(e, msg, lm)
+		}
+		return err
+	}
+	reason := collectd.ReasonMalformedJSON
+	var verr *collectd.ValidationError
+	if errors.As(err, &verr) {
+		reason = verr.Reason
+	}
+	lm.IncDecodeError(reason)
+
+	n := atomic.AddUint64(&p.rejected, 1)
+	if p.BadPayloadSample > 0 && (n-1)%p.BadPayloadSample == 0 {
+		if len(msg) > maxLoggedPayload {
+			msg = msg[:maxLoggedPayload]
+		}
+		p.logger.Warn("rejected payload", "reason", reason, "err", err, "payload", string(msg))
+	} else {
+		p.logger.Debug("rejected payload", "reason", reason, "err", err)
+	}
+	return err
+}
+
+// Process decodes msg and stores its metrics, accounting to listener metrics lm.
+// The format, JSON or PUTVAL, is detected per message.
+// Invalid records are skipped and counted, valid records of the same message
+// are still stored. Decode errors are returned, the caller is free to carry on
+// with the next message
+func (p *Pipeline) Process(msg []byte, lm *ListenerMetrics) error {
+	lm.IncTotalAmqpReceived()
+	lm.AddBytesReceived(len(msg))
+
+	start := time.Now()
+	if zstdutil.IsCompressed(msg) {
+		if p.codec == nil {
+			return p.reject(&collectd.ValidationError{
+				Reason: ReasonCompressionDisabled,
+				Err:    errors.New("compressed message received, but compression is not enabled"),
+			}, msg, lm)
+		}
+		decompressed, err := p.codec.Decompress(nil, msg)
+		if err != nil {
+			return p.reject(&collectd.ValidationError{Reason: ReasonDecompress, Err: err}, msg, lm)
+		}
+		msg = decompressed
+	}
+	decoder := collectd.AcquireDecoder()
+	defer collectd.ReleaseDecoder(decoder)
+	var metrics []collectd.Collectd
+	var err error
+	if collectd.IsPutval(msg) {
+		metrics, err = decoder.DecodePutval(msg, p.TypesDB)
+	} else {
+		metrics, err = decoder.Decode(msg)
+	}
+	lm.ObserveParseDuration(time.Since(start))
+	return p.store(msg, metrics, err, true, lm)
+}
+
+// ProcessRecords stores records decoded by the caller from msg, like Process
+// does with collectd messages. Records are validated, but not resolved in
+// TypesDB, the caller fills in their data sources. decodeErr holds errors of
+// records the caller could not decode, they are counted as rejected
+func (p *Pipeline) ProcessRecords(msg []byte, records []collectd.Collectd, decodeErr error, lm *ListenerMetrics) error {
+	lm.IncTotalAmqpReceived()
+	lm.AddBytesReceived(len(msg))
+	return p.store(msg, records, decodeErr, false, lm)
+}
+
+// ProcessSeries stores series decoded by the caller from msg, accounting to
+// listener metrics lm. New series expire after staleTime seconds without
+// updates, DefaultStaleTime when not positive. decodeErr holds errors of
+// samples the caller could not decode, they are counted as rejected along
+// with series which can't be stored. All errors are returned joined
+func (p *Pipeline) ProcessSeries(msg []byte, series []Series, staleTime float64, decodeErr error, lm *ListenerMetrics) error {
+	if staleTime <= 0 {
+		staleTime = DefaultStaleTime
+	}
+	lm.IncTotalAmqpReceived()
+	lm.AddBytesReceived(len(msg))
+
+	errs := []error{}
+	if decodeErr != nil {
+		errs = append(errs, p.reject(decodeErr, msg, lm))
+	}
+
+	start := time.Now()
+	stored := 0
+	for i := range series {
+		if err := p.allMetrics.UpdateOrAddSeries(&series[i], p.cache, staleTime); err != nil {
+			errs = append(errs, p.reject(err, msg, lm))
+			continue
+		}
+		stored++
+	}
+	lm.AddTotalReceived(stored)
+	lm.ObserveProcessDuration(time.Since(start))
+	return errors.Join(errs...)
+}
+
+// store validates and stores decoded metrics of msg, resolving them in TypesDB first if resolve is set
+func (p *Pipeline) store(msg []byte, metrics []collectd.Collectd, decodeErr error, resolve bool, lm *ListenerMetrics) error {
+	var rejected error
+	if decodeErr != nil {
+		rejected = p.reject(decodeErr, msg, lm)
+		if len(metrics) == 0 {
+			return rejected
+		}
+	}
+
+	start := time.Now()
+	stored := 0
+	for i := range metrics {
+		m := &metrics[i]
+		if resolve {
+			if err := p.TypesDB.Resolve(m); err != nil {
+				rejected = p.reject(err, msg, lm)
+				continue
+			}
+		}
+		if err := m.Validate(); err != nil {
+			rejected = p.reject(err, msg, lm)
+			continue
+		}
+		if err := p.allMetrics.UpdateOrAddMetrics(m, p.cache, DefaultStaleTime); err != nil {
+			rejected = p.reject(err, msg, lm)
+			continue
+		}
+		stored++
+	}
+	lm.AddTotalReceived(stored)
+	lm.ObserveProcessDuration(time.Since(start))
+
+	if len(metrics) > 0 && metrics[0].Interval < 0.0 {
+		return ErrEndOfStream
+	}
+	return rejected
+}
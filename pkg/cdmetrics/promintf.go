@@ -0,0 +1,313 @@
+package cdmetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ListenerMetrics counters of a single listener. Counters are atomic, so
+// one listener may be fed from several goroutines. Concurrent
+type ListenerMetrics struct {
+	// 64-bit atomics first for alignment on 32-bit platforms
+	totalMetricsReceived uint64
+	totalAmqpReceived    uint64
+	totalDecodeErrors    uint64
+	totalBytesReceived   uint64
+	totalConnections     uint64
+	openConnections      int64
+
+	// only touched by the goroutine calling UpdateRates
+	lastMetricCount uint64
+	lastAmqpCount   uint64
+
+	listener         string
+	transport        string
+	metricsPerSecond prometheus.Gauge
+	msgsPerSecond    prometheus.Gauge
+	parseDuration    prometheus.Observer
+	processDuration  prometheus.Observer
+	decodeErrors     *prometheus.CounterVec
+	connDuration     prometheus.Observer
+	connsClosed      *prometheus.CounterVec
+}
+
+// Reasons stream connections are closed
+const (
+	ConnReasonEOF             = "eof"
+	ConnReasonIdleTimeout     = "idle_timeout"
+	ConnReasonMessageTooLarge = "message_too_large"
+	ConnReasonLimit           = "limit"
+	ConnReasonShutdown        = "shutdown"
+	ConnReasonError           = "error"
+)
+
+// ConnReasons all reasons counted in sg_connections_closed_total
+var ConnReasons = []string{ConnReasonEOF, ConnReasonIdleTimeout, ConnReasonMessageTooLarge, ConnReasonLimit, ConnReasonShutdown, ConnReasonError}
+
+// IncTotalMetricsReceived ...
+func (a *ListenerMetrics) IncTotalMetricsReceived() {
+	atomic.AddUint64(&a.totalMetricsReceived, 1)
+}
+
+// IncTotalAmqpReceived ...
+func (a *ListenerMetrics) IncTotalAmqpReceived() {
+	atomic.AddUint64(&a.totalAmqpReceived, 1)
+}
+
+// AddTotalReceived ...
+func (a *ListenerMetrics) AddTotalReceived(num int) {
+	atomic.AddUint64(&a.totalMetricsReceived, uint64(num))
+}
+
+// GetTotalMetricsReceived ...
+func (a *ListenerMetrics) GetTotalMetricsReceived() uint64 {
+	return atomic.LoadUint64(&a.totalMetricsReceived)
+}
+
+// GetTotalAmqpReceived ...
+func (a *ListenerMetrics) GetTotalAmqpReceived() uint64 {
+	return atomic.LoadUint64(&a.totalAmqpReceived)
+}
+
+// IncTotalDecodeErrors ...
+func (a *ListenerMetrics) IncTotalDecodeErrors() {
+	atomic.AddUint64(&a.totalDecodeErrors, 1)
+}
+
+// IncDecodeError counts a decode error for reason
+func (a *ListenerMetrics) IncDecodeError(reason string) {
+	atomic.AddUint64(&a.totalDecodeErrors, 1)
+	a.decodeErrors.WithLabelValues(a.listener, a.transport, reason).Inc()
+}
+
+// GetTotalDecodeErrors ...
+func (a *ListenerMetrics) GetTotalDecodeErrors() uint64 {
+	return atomic.LoadUint64(&a.totalDecodeErrors)
+}
+
+// AddBytesReceived ...
+func (a *ListenerMetrics) AddBytesReceived(num int) {
+	atomic.AddUint64(&a.totalBytesReceived, uint64(num))
+}
+
+// GetTotalBytesReceived ...
+func (a *ListenerMetrics) GetTotalBytesReceived() uint64 {
+	return atomic.LoadUint64(&a.totalBytesReceived)
+}
+
+// ConnectionOpened counts a new stream connection
+func (a *ListenerMetrics) ConnectionOpened() {
+	atomic.AddUint64(&a.totalConnections, 1)
+	atomic.AddInt64(&a.openConnections, 1)
+}
+
+// ConnectionClosed counts a stream connection closed for reason after being open for d
+func (a *ListenerMetrics) ConnectionClosed(reason string, d time.Duration) {
+	atomic.AddInt64(&a.openConnections, -1)
+	a.connsClosed.WithLabelValues(a.listener, a.transport, reason).Inc()
+	a.connDuration.Observe(d.Seconds())
+}
+
+// GetTotalConnections ...
+func (a *ListenerMetrics) GetTotalConnections() uint64 {
+	return atomic.LoadUint64(&a.totalConnections)
+}
+
+// GetOpenConnections ...
+func (a *ListenerMetrics) GetOpenConnections() int64 {
+	return atomic.LoadInt64(&a.openConnections)
+}
+
+// ObserveParseDuration ...
+func (a *ListenerMetrics) ObserveParseDuration(d time.Duration) {
+	a.parseDuration.Observe(d.Seconds())
+}
+
+// ObserveProcessDuration ...
+func (a *ListenerMetrics) ObserveProcessDuration(d time.Duration) {
+	a.processDuration.Observe(d.Seconds())
+}
+
+// UpdateRates sets per second gauges from counts received since the last
+// call and returns the counts received in between. elapsed is the measured
+// time since the last call, tickers slip under load. Not to be called
+// concurrently
+func (a *ListenerMetrics) UpdateRates(elapsed time.Duration) (metricsDelta uint64, msgsDelta uint64) {
+	metrics, msgs := a.GetTotalMetricsReceived(), a.GetTotalAmqpReceived()
+	metricsDelta, msgsDelta = metrics-a.lastMetricCount, msgs-a.lastAmqpCount
+	if elapsed <= 0 {
+		// keep the counts for the next call
+		return 0, 0
+	}
+	a.metricsPerSecond.Set(float64(metricsDelta) / elapsed.Seconds())
+	a.msgsPerSecond.Set(float64(msgsDelta) / elapsed.Seconds())
+	a.lastMetricCount, a.lastAmqpCount = metrics, msgs
+	return
+}
+
+// PromIntf gateway self metrics labeled per listener and transport. A single
+// PromIntf is registered once and shared by all listeners. Concurrent
+type PromIntf struct {
+	mu sync.RWMutex
+	// map[listener+transport]
+	listeners map[string]*ListenerMetrics
+
+	totalMetricsReceivedDesc *prometheus.Desc
+	totalAmqpReceivedDesc    *prometheus.Desc
+	totalDecodeErrorsDesc    *prometheus.Desc
+	totalBytesReceivedDesc   *prometheus.Desc
+	totalConnectionsDesc     *prometheus.Desc
+	openConnectionsDesc      *prometheus.Desc
+
+	metricsPerSecond *prometheus.GaugeVec
+	msgsPerSecond    *prometheus.GaugeVec
+	parseDuration    *prometheus.HistogramVec
+	processDuration  *prometheus.HistogramVec
+	decodeErrors     *prometheus.CounterVec
+	connDuration     *prometheus.HistogramVec
+	connsClosed      *prometheus.CounterVec
+}
+
+var listenerLabels = []string{"listener", "transport"}
+
+// NewPromIntf  ...
+func NewPromIntf() *PromIntf {
+	a := &PromIntf{
+		listeners: make(map[string]*ListenerMetrics),
+		//***** There are metrics missing here:
+		// collectd_qpid_router_status (Used in perftest dashboard, but not that useful in practice, also hard to propagate via the bridge)
+		// collectd_total_amqp_reconnect_count (Unused, same as above though)
+		// collectd_elasticsearch_status (Unused, events specific so not for this codebase yet)
+		// collectd_last_metric_for_host_status and collectd_metric_per_host are exported by CDMetrics
+		totalMetricsReceivedDesc: prometheus.NewDesc("sg_total_metric_rcv_count",
+			"Total count of collectd metrics rcv'd.",
+			listenerLabels, nil,
+		),
+		totalAmqpReceivedDesc: prometheus.NewDesc("sg_total_amqp_rcv_count",
+			"Total count of amqp msq rcv'd.",
+			listenerLabels, nil,
+		),
+		totalDecodeErrorsDesc: prometheus.NewDesc("sg_total_metric_decode_error_count",
+			"Total count of amqp message processed.",
+			listenerLabels, nil,
+		),
+		totalBytesReceivedDesc: prometheus.NewDesc("sg_rcv_bytes_total",
+			"Total count of bytes rcv'd.",
+			listenerLabels, nil,
+		),
+		totalConnectionsDesc: prometheus.NewDesc("sg_connections_total",
+			"Total count of stream connections accepted.",
+			listenerLabels, nil,
+		),
+		openConnectionsDesc: prometheus.NewDesc("sg_open_connections",
+			"Number of currently open stream connections.",
+			listenerLabels, nil,
+		),
+		metricsPerSecond: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sg_metrics_per_second",
+			Help: "Rate of collectd metrics rcv'd over the last rate interval.",
+		}, listenerLabels),
+		msgsPerSecond: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sg_msgs_per_second",
+			Help: "Rate of msgs rcv'd over the last rate interval.",
+		}, listenerLabels),
+		parseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sg_msg_parse_duration_seconds",
+			Help:    "Time spent decoding a msg.",
+			Buckets: prometheus.ExponentialBuckets(0.000005, 4, 8),
+		}, listenerLabels),
+		processDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sg_msg_process_duration_seconds",
+			Help:    "Time spent storing the metrics of a decoded msg.",
+			Buckets: prometheus.ExponentialBuckets(0.000005, 4, 8),
+		}, listenerLabels),
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sg_decode_errors_total",
+			Help: "Total count of rejected msgs and records by reason.",
+		}, []string{"listener", "transport", "reason"}),
+		connDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sg_connection_duration_seconds",
+			Help:    "Time stream connections were open.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, listenerLabels),
+		connsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sg_connections_closed_total",
+			Help: "Total count of closed stream connections by reason.",
+		}, []string{"listener", "transport", "reason"}),
+	}
+	return a
+}
+
+// Listener returns metrics of listener using transport, creating them on first use
+func (a *PromIntf) Listener(listener string, transport string) *ListenerMetrics {
+	key := listener + "\x00" + transport
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if lm, found := a.listeners[key]; found {
+		return lm
+	}
+	lm := &ListenerMetrics{
+		listener:         listener,
+		transport:        transport,
+		metricsPerSecond: a.metricsPerSecond.WithLabelValues(listener, transport),
+		msgsPerSecond:    a.msgsPerSecond.WithLabelValues(listener, transport),
+		parseDuration:    a.parseDuration.WithLabelValues(listener, transport),
+		processDuration:  a.processDuration.WithLabelValues(listener, transport),
+		decodeErrors:     a.decodeErrors,
+		connDuration:     a.connDuration.WithLabelValues(listener, transport),
+		connsClosed:      a.connsClosed,
+	}
+	// export known reasons even before they occur
+	for _, reason := range DecodeErrorReasons() {
+		a.decodeErrors.WithLabelValues(listener, transport, reason)
+	}
+	a.listeners[key] = lm
+	return lm
+}
+
+// Describe ...
+func (a *PromIntf) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.totalMetricsReceivedDesc
+	ch <- a.totalAmqpReceivedDesc
+	ch <- a.totalDecodeErrorsDesc
+	ch <- a.totalBytesReceivedDesc
+	a.metricsPerSecond.Describe(ch)
+	a.msgsPerSecond.Describe(ch)
+	a.parseDuration.Describe(ch)
+	a.processDuration.Describe(ch)
+	a.decodeErrors.Describe(ch)
+	ch <- a.totalConnectionsDesc
+	ch <- a.openConnectionsDesc
+	a.connDuration.Describe(ch)
+	a.connsClosed.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *PromIntf) Collect(ch chan<- prometheus.Metric) {
+	a.mu.RLock()
+	for _, lm := range a.listeners {
+		ch <- prometheus.MustNewConstMetric(a.totalMetricsReceivedDesc, prometheus.CounterValue, float64(lm.GetTotalMetricsReceived()), lm.listener, lm.transport)
+		ch <- prometheus.MustNewConstMetric(a.totalAmqpReceivedDesc, prometheus.CounterValue, float64(lm.GetTotalAmqpReceived()), lm.listener, lm.transport)
+		ch <- prometheus.MustNewConstMetric(a.totalDecodeErrorsDesc, prometheus.CounterValue, float64(lm.GetTotalDecodeErrors()), lm.listener, lm.transport)
+		ch <- prometheus.MustNewConstMetric(a.totalBytesReceivedDesc, prometheus.CounterValue, float64(lm.GetTotalBytesReceived()), lm.listener, lm.transport)
+		// connection metrics only apply to stream listeners
+		if total := lm.GetTotalConnections(); total > 0 {
+			ch <- prometheus.MustNewConstMetric(a.totalConnectionsDesc, prometheus.CounterValue, float64(total), lm.listener, lm.transport)
+			ch <- prometheus.MustNewConstMetric(a.openConnectionsDesc, prometheus.GaugeValue, float64(lm.GetOpenConnections()), lm.listener, lm.transport)
+		}
+	}
+	a.mu.RUnlock()
+
+	a.metricsPerSecond.Collect(ch)
+	a.msgsPerSecond.Collect(ch)
+	a.parseDuration.Collect(ch)
+	a.processDuration.Collect(ch)
+	a.decodeErrors.Collect(ch)
+	a.connDuration.Collect(ch)
+	a.connsClosed.Collect(ch)
+}
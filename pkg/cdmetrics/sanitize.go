@@ -0,0 +1,48 @@
+package cdmetrics
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// SanitizeMetricName replaces each character invalid in Prometheus metric
+// names with '_' and prefixes names starting with a digit. Valid names are
+// returned as they are
+func SanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// SanitizeLabelName like SanitizeMetricName, but without colons and with the
+// "__" prefix reserved for internal labels reduced to "_"
+func SanitizeLabelName(name string) string {
+	name = sanitizeName(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = "_" + strings.TrimLeft(name, "_")
+	}
+	return name
+}
+
+// SanitizeLabelValue replaces invalid UTF-8 in label value
+func SanitizeLabelValue(value string) string {
+	if utf8.ValidString(value) {
+		return value
+	}
+	return strings.ToValidUTF8(value, "�")
+}
+
+func sanitizeName(name string, colons bool) string {
+	if name == "" {
+		return "_"
+	}
+	// strings.Map returns name itself when nothing is replaced
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || (colons && r == ':') {
+			return r
+		}
+		return '_'
+	}, name)
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,39 @@
+package cdmetrics
+
+import (
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, test := range []struct {
+		fn       func(string) string
+		in       string
+		expected string
+	}{
+		{SanitizeMetricName, "collectd_cpu_total", "collectd_cpu_total"},
+		{SanitizeMetricName, "collectd_foo-bar.baz qux", "collectd_foo_bar_baz_qux"},
+		{SanitizeMetricName, "ns:metric", "ns:metric"},
+		{SanitizeMetricName, "9lives", "_9lives"},
+		{SanitizeMetricName, "héllo", "h_llo"},
+		{SanitizeMetricName, "", "_"},
+		{SanitizeLabelName, "ns:label", "ns_label"},
+		{SanitizeLabelName, "__name__", "_name__"},
+		{SanitizeLabelName, "python.plugin", "python_plugin"},
+		{SanitizeLabelValue, "any value-é", "any value-é"},
+		{SanitizeLabelValue, "bad\xffutf8", "bad�utf8"},
+	} {
+		assert.Equals(t, test.expected, test.fn(test.in))
+	}
+
+	t.Run("valid names are not copied", func(t *testing.T) {
+		name := "collectd_cpu_total"
+		allocs := testing.AllocsPerRun(10, func() {
+			_ = SanitizeMetricName(name)
+			_ = SanitizeLabelName(name)
+			_ = SanitizeLabelValue(name)
+		})
+		assert.Equals(t, 0.0, allocs)
+	})
+}
@@ -0,0 +1,177 @@
+package ceilometer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReasonMalformedCeilometer reason ceilometer messages or samples are rejected
+const ReasonMalformedCeilometer = "malformed_ceilometer"
+
+func init() {
+	cdmetrics.RegisterDecodeErrorReasons(ReasonMalformedCeilometer)
+}
+
+// MetricPrefix prefix of the names of ceilometer metrics
+const MetricPrefix = "ceilometer_"
+
+func invalid(format string, args ...interface{}) *collectd.ValidationError {
+	return &collectd.ValidationError{Reason: ReasonMalformedCeilometer, Err: fmt.Errorf(format, args...)}
+}
+
+// counter types of samples
+const (
+	TypeGauge      = "gauge"
+	TypeDelta      = "delta"
+	TypeCumulative = "cumulative"
+)
+
+// Sample ceilometer metering sample
+type Sample struct {
+	CounterName   string   `json:"counter_name"`
+	CounterType   string   `json:"counter_type"`
+	CounterUnit   string   `json:"counter_unit"`
+	CounterVolume *float64 `json:"counter_volume"`
+	ResourceID    string   `json:"resource_id"`
+	ProjectID     string   `json:"project_id"`
+	UserID        string   `json:"user_id"`
+	Timestamp     string   `json:"timestamp"`
+	// ResourceMetadata only host is used
+	ResourceMetadata struct {
+		Host string `json:"host"`
+	} `json:"resource_metadata"`
+}
+
+// message oslo notification carrying samples
+type message struct {
+	PublisherID string   `json:"publisher_id"`
+	EventType   string   `json:"event_type"`
+	Payload     []Sample `json:"payload"`
+}
+
+// envelope oslo messaging envelope, the message is JSON encoded in a string
+type envelope struct {
+	Request struct {
+		OsloMessage string `json:"oslo.message"`
+	} `json:"request"`
+}
+
+// Decode decodes the samples of ceilometer message msg, an oslo messaging
+// envelope as received from the bus or the notification it carries
+func Decode(msg []byte) ([]Sample, error) {
+	var env envelope
+	if err := jsoniter.ConfigFastest.Unmarshal(msg, &env); err != nil {
+		return nil, invalid("%v", err)
+	}
+	if env.Request.OsloMessage != "" {
+		msg = []byte(env.Request.OsloMessage)
+	}
+	var m message
+	if err := jsoniter.ConfigFastest.Unmarshal(msg, &m); err != nil {
+		return nil, invalid("oslo.message: %v", err)
+	}
+	if m.Payload == nil {
+		return nil, invalid("message of publisher %q without samples", m.PublisherID)
+	}
+	return m.Payload, nil
+}
+
+// timestamp layouts of samples, UTC unless the zone is given
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func parseTimestamp(ts string) (time.Time, error) {
+	var err error
+	for _, layout := range timestampLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, ts); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Series appends a series of each sample to series, named
+// ceilometer_<counter_name> with labels project and resource, and host if
+// the resource metadata names it. Cumulative samples are exported as
+// counters named ceilometer_<counter_name>_total, gauge and delta samples as
+// gauges. Samples without timestamp are
+// stamped with now. Invalid samples are skipped and their errors returned
+// joined
+func Series(samples []Sample, series []cdmetrics.Series, now time.Time) ([]cdmetrics.Series, error) {
+	var errs []error
+	for i := range samples {
+		s := &samples[i]
+		if s.CounterName == "" {
+			errs = append(errs, invalid("sample of resource %q without counter_name", s.ResourceID))
+			continue
+		}
+		if s.CounterVolume == nil || math.IsNaN(*s.CounterVolume) || math.IsInf(*s.CounterVolume, 0) {
+			errs = append(errs, invalid("%s: invalid counter_volume", s.CounterName))
+			continue
+		}
+		name := MetricPrefix + s.CounterName
+		valueType := prometheus.GaugeValue
+		switch s.CounterType {
+		case TypeCumulative:
+			name += "_total"
+			valueType = prometheus.CounterValue
+		case TypeGauge, TypeDelta:
+		default:
+			errs = append(errs, invalid("%s: unknown counter_type %q", s.CounterName, s.CounterType))
+			continue
+		}
+		ts := now
+		if s.Timestamp != "" {
+			var err error
+			if ts, err = parseTimestamp(s.Timestamp); err != nil {
+				errs = append(errs, invalid("%s: invalid timestamp %q", s.CounterName, s.Timestamp))
+				continue
+			}
+		}
+
+		labelNames := []string{"project", "resource"}
+		labelValues := []string{s.ProjectID, s.ResourceID}
+		host := s.ResourceMetadata.Host
+		if host != "" {
+			labelNames = append(labelNames, "host")
+			labelValues = append(labelValues, host)
+		}
+		series = append(series, cdmetrics.Series{
+			Name:        name,
+			LabelNames:  labelNames,
+			LabelValues: labelValues,
+			Value:       *s.CounterVolume,
+			ValueType:   valueType,
+			Time:        ts,
+			Host:        host,
+		})
+	}
+	return series, errors.Join(errs...)
+}
+
+// ProcessFunc returns a function decoding ceilometer messages and storing
+// their samples in pipeline, accounting to listener metrics lm. Series
+// expire after staleTime seconds without samples, see Pipeline.ProcessSeries
+func ProcessFunc(pipeline *cdmetrics.Pipeline, staleTime float64) func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+	return func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+		start := time.Now()
+		samples, err := Decode(msg)
+		var series []cdmetrics.Series
+		if err == nil {
+			series, err = Series(samples, nil, start)
+		}
+		lm.ObserveParseDuration(time.Since(start))
+		return pipeline.ProcessSeries(msg, series, staleTime, err, lm)
+	}
+}
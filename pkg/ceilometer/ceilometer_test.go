@@ -0,0 +1,100 @@
+package ceilometer
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDecode(t *testing.T) {
+	t.Run("envelope", func(t *testing.T) {
+		msg, err := os.ReadFile("testdata/sample.json")
+		assert.Ok(t, err)
+		samples, err := Decode(msg)
+		assert.Ok(t, err)
+		assert.Equals(t, 4, len(samples))
+		assert.Equals(t, "cpu", samples[0].CounterName)
+		assert.Equals(t, 123450000000.0, *samples[0].CounterVolume)
+		assert.Equals(t, "compute-0", samples[0].ResourceMetadata.Host)
+		assert.Assert(t, samples[3].CounterVolume == nil, "null counter_volume decoded")
+	})
+
+	t.Run("notification", func(t *testing.T) {
+		samples, err := Decode([]byte(`{"publisher_id":"p","payload":[{"counter_name":"cpu","counter_volume":1}]}`))
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(samples))
+	})
+
+	t.Run("rejects malformed messages", func(t *testing.T) {
+		for _, msg := range []string{`not json`, `{"request":{"oslo.message":"{"}}`, `{"publisher_id":"p"}`, `[{"values":[1]}]`} {
+			_, err := Decode([]byte(msg))
+			var verr *collectd.ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error for %s, got %v", msg, err)
+			assert.Equals(t, ReasonMalformedCeilometer, verr.Reason)
+		}
+	})
+}
+
+func TestSeries(t *testing.T) {
+	msg, err := os.ReadFile("testdata/sample.json")
+	assert.Ok(t, err)
+	samples, err := Decode(msg)
+	assert.Ok(t, err)
+	now := time.Unix(1700000000, 0)
+	series, err := Series(samples, nil, now)
+	var verr *collectd.ValidationError
+	assert.Assert(t, errors.As(err, &verr), "expected rejected null counter_volume, got %v", err)
+
+	assert.Equals(t, 3, len(series))
+	assert.Equals(t, cdmetrics.Series{
+		Name:        "ceilometer_cpu_total",
+		LabelNames:  []string{"project", "resource", "host"},
+		LabelValues: []string{"p1", "vm-1", "compute-0"},
+		Value:       123450000000,
+		ValueType:   prometheus.CounterValue,
+		Time:        time.Date(2023, 11, 14, 22, 13, 20, 123456000, time.UTC),
+		Host:        "compute-0",
+	}, series[0])
+	assert.Equals(t, "ceilometer_disk.device.read.bytes_total", series[1].Name)
+	assert.Equals(t, time.Unix(1700000000, 0), series[1].Time)
+	assert.Equals(t, "ceilometer_memory.usage", series[2].Name)
+	assert.Equals(t, []string{"project", "resource"}, series[2].LabelNames)
+	assert.Equals(t, prometheus.GaugeValue, series[2].ValueType)
+
+	_, err = Series([]Sample{{CounterName: "x", CounterType: "rate", CounterVolume: new(float64)}, {CounterType: TypeGauge}}, nil, now)
+	assert.Equals(t, 2, len(err.(interface{ Unwrap() []error }).Unwrap()))
+}
+
+func TestProcessFunc(t *testing.T) {
+	logger := logging.NewNopLogger()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+	lm := cdmetrics.NewPromIntf().Listener("test", "unixgram")
+
+	msg, err := os.ReadFile("testdata/sample.json")
+	assert.Ok(t, err)
+	err = ProcessFunc(pipeline, cdmetrics.DefaultStaleTime)(msg, lm)
+	assert.Assert(t, err != nil, "expected rejected sample")
+	assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+	assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+
+	registry := prometheus.NewRegistry()
+	assert.Ok(t, registry.Register(allMetrics))
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{"ceilometer_cpu_total", "ceilometer_disk_device_read_bytes_total", "ceilometer_memory_usage"} {
+		assert.Assert(t, names[name], "%s not exported", name)
+	}
+}
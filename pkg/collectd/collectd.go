@@ -1,7 +1,8 @@
 package collectd
 
 import (
-	"log"
+	"errors"
+	"io"
 
 	"collectd.org/cdtime"
 	jsoniter "github.com/json-iterator/go"
@@ -36,15 +37,14 @@ func (c *Collectd) ParseInputString(jsonString string) (*[]Collectd, error) {
 //ParseInputByte   ...
 func (c *Collectd) ParseInputByte(jsonBlob []byte) (*[]Collectd, error) {
 	collect := []Collectd{}
-	//var json = jsoniter.ConfigCompatibleWithStandardLibrary.BorrowIterator(jsonBlob)
-	var json = jsoniter.ConfigFastest.BorrowIterator(jsonBlob)
-	//defer jsoniter.ConfigCompatibleWithStandardLibrary.ReturnIterator(json)
-	defer jsoniter.ConfigFastest.ReturnIterator(json)
+	var json = strictConfig.BorrowIterator(jsonBlob)
+	defer strictConfig.ReturnIterator(json)
 	json.ReadVal(&collect)
-	//	err := json.Unmarshal(jsonBlob, &collect)
 	if json.Error != nil {
-		log.Println("Error parsing json:", json.Error)
-		return nil, json.Error
+		return nil, &ValidationError{Reason: ReasonMalformedJSON, Err: json.Error}
+	}
+	if json.WhatIsNext() != jsoniter.InvalidValue || json.Error != io.EOF {
+		return nil, &ValidationError{Reason: ReasonMalformedJSON, Err: errors.New("trailing data after collectd message")}
 	}
 
 	return &collect, nil
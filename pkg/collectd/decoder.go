@@ -0,0 +1,420 @@
+package collectd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"collectd.org/cdtime"
+)
+
+// maxInterned strings kept by a Decoder before its table is reset, bounds
+// memory when labels are unbounded
+const maxInterned = 16384
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		return NewDecoder()
+	},
+}
+
+// AcquireDecoder returns a Decoder from the pool
+func AcquireDecoder() *Decoder {
+	return decoderPool.Get().(*Decoder)
+}
+
+// ReleaseDecoder returns d to the pool. Records decoded by d must not be used afterwards
+func ReleaseDecoder(d *Decoder) {
+	decoderPool.Put(d)
+}
+
+// TimeFromSeconds converts seconds since the epoch, as sent by collectd and
+// graphite, to cdtime.Time truncating the fraction to nanoseconds like
+// cdtime.Time JSON decoding. cdtime.Time is unsigned, negative and NaN
+// seconds return the epoch
+func TimeFromSeconds(seconds float64) cdtime.Time {
+	if !(seconds > 0) {
+		return 0
+	}
+	if seconds >= math.MaxInt64/1e9 {
+		return cdtime.NewDuration(math.MaxInt64)
+	}
+	s, frac := math.Modf(seconds)
+	return cdtime.NewDuration(time.Duration(s)*time.Second + time.Duration(frac*1e9))
+}
+
+// Decoder streaming collectd JSON decoder. Records, their slices and the
+// decoder buffers are reused across messages and host, plugin, type and
+// data source strings are interned, so steady state decoding does not
+// allocate. Equivalent to ParseInputByte. Not concurrent
+type Decoder struct {
+	buf     []byte
+	pos     int
+	records []Collectd
+	strings map[string]string
+	scratch []byte
+}
+
+// NewDecoder Decoder factory
+func NewDecoder() *Decoder {
+	return &Decoder{strings: make(map[string]string)}
+}
+
+// Decode decodes collectd JSON msg. The returned records are owned by d and
+// only valid until the next call to Decode
+func (d *Decoder) Decode(msg []byte) ([]Collectd, error) {
+	d.buf, d.pos = msg, 0
+	d.records = d.records[:0]
+	err := d.decode()
+	d.buf = nil
+	if err != nil {
+		return nil, &ValidationError{Reason: ReasonMalformedJSON, Err: err}
+	}
+	return d.records, nil
+}
+
+func (d *Decoder) decode() error {
+	if err := d.expect('['); err != nil {
+		return err
+	}
+	if d.peek() == ']' {
+		d.pos++
+	} else {
+		for {
+			if err := d.readRecord(d.nextRecord()); err != nil {
+				return err
+			}
+			if more, err := d.more(']'); err != nil {
+				return err
+			} else if !more {
+				break
+			}
+		}
+	}
+	if d.peek() != 0 {
+		return d.errorf("trailing data after collectd message")
+	}
+	return nil
+}
+
+// nextRecord grows records by one, reusing a previous record and its slices
+func (d *Decoder) nextRecord() *Collectd {
+	n := len(d.records)
+	if n < cap(d.records) {
+		d.records = d.records[:n+1]
+	} else {
+		d.records = append(d.records, Collectd{})
+	}
+	c := &d.records[n]
+	*c = Collectd{
+		Values:  c.Values[:0],
+		Dstypes: c.Dstypes[:0],
+		Dsnames: c.Dsnames[:0],
+	}
+	return c
+}
+
+func (d *Decoder) readRecord(c *Collectd) error {
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+	if d.peek() == '}' {
+		d.pos++
+		return nil
+	}
+	for {
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if err := d.expect(':'); err != nil {
+			return err
+		}
+		switch string(key) {
+		case "values":
+			err = d.readArray(func() error {
+				v, err := d.readNumber()
+				c.Values = append(c.Values, v)
+				return err
+			})
+		case "dstypes":
+			err = d.readArray(func() error {
+				s, err := d.readInterned()
+				c.Dstypes = append(c.Dstypes, s)
+				return err
+			})
+		case "dsnames":
+			err = d.readArray(func() error {
+				s, err := d.readInterned()
+				c.Dsnames = append(c.Dsnames, s)
+				return err
+			})
+		case "time":
+			var f float64
+			if f, err = d.readNumber(); err == nil {
+				c.Time = TimeFromSeconds(f)
+			}
+		case "interval":
+			c.Interval, err = d.readNumber()
+		case "host":
+			c.Host, err = d.readInterned()
+		case "plugin":
+			c.Plugin, err = d.readInterned()
+		case "plugin_instance":
+			c.PluginInstance, err = d.readInterned()
+		case "type":
+			c.Type, err = d.readInterned()
+		case "type_instance":
+			c.TypeInstance, err = d.readInterned()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+		if more, err := d.more('}'); err != nil {
+			return err
+		} else if !more {
+			return nil
+		}
+	}
+}
+
+// readArray calls readElem for each element of a JSON array
+func (d *Decoder) readArray(readElem func() error) error {
+	if d.readNull() {
+		return nil
+	}
+	if err := d.expect('['); err != nil {
+		return err
+	}
+	if d.peek() == ']' {
+		d.pos++
+		return nil
+	}
+	for {
+		if err := readElem(); err != nil {
+			return err
+		}
+		if more, err := d.more(']'); err != nil {
+			return err
+		} else if !more {
+			return nil
+		}
+	}
+}
+
+// more consumes the separator after an element, reports false when closing was consumed
+func (d *Decoder) more(closing byte) (bool, error) {
+	switch d.peek() {
+	case ',':
+		d.pos++
+		return true, nil
+	case closing:
+		d.pos++
+		return false, nil
+	}
+	return false, d.errorf("expected ',' or '%c'", closing)
+}
+
+// peek skips whitespace and returns the next byte, 0 at the end of input
+func (d *Decoder) peek() byte {
+	for ; d.pos < len(d.buf); d.pos++ {
+		switch c := d.buf[d.pos]; c {
+		case ' ', '\t', '\n', '\r':
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+func (d *Decoder) expect(c byte) error {
+	if d.peek() != c {
+		return d.errorf("expected '%c'", c)
+	}
+	d.pos++
+	return nil
+}
+
+func (d *Decoder) readNull() bool {
+	if d.peek() == 'n' && len(d.buf)-d.pos >= 4 && string(d.buf[d.pos:d.pos+4]) == "null" {
+		d.pos += 4
+		return true
+	}
+	return false
+}
+
+// readNumber reads a JSON number, null is read as NaN
+func (d *Decoder) readNumber() (float64, error) {
+	if d.readNull() {
+		return math.NaN(), nil
+	}
+	start := d.pos
+	for ; d.pos < len(d.buf); d.pos++ {
+		c := d.buf[d.pos]
+		if (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' && c != 'e' && c != 'E' {
+			break
+		}
+	}
+	if start == d.pos {
+		return 0, d.errorf("expected number")
+	}
+	f, err := parseFloat(d.buf[start:d.pos])
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q at offset %d", d.buf[start:d.pos], start)
+	}
+	return f, nil
+}
+
+// readInterned reads a JSON string, null is read as empty string
+func (d *Decoder) readInterned() (string, error) {
+	if d.readNull() {
+		return "", nil
+	}
+	b, err := d.readString()
+	if err != nil {
+		return "", err
+	}
+	return d.intern(b), nil
+}
+
+// intern returns b as string, shared with previous occurrences of the same value
+func (d *Decoder) intern(b []byte) string {
+	if s, found := d.strings[string(b)]; found {
+		return s
+	}
+	if len(d.strings) >= maxInterned {
+		d.strings = make(map[string]string)
+	}
+	s := string(b)
+	d.strings[s] = s
+	return s
+}
+
+// readString reads a JSON string. The result is only valid until the next read
+func (d *Decoder) readString() ([]byte, error) {
+	if err := d.expect('"'); err != nil {
+		return nil, err
+	}
+	start := d.pos
+	for ; d.pos < len(d.buf); d.pos++ {
+		switch d.buf[d.pos] {
+		case '"':
+			d.pos++
+			return d.buf[start : d.pos-1], nil
+		case '\\':
+			return d.readEscapedString(start)
+		}
+	}
+	return nil, d.errorf("unterminated string")
+}
+
+// readEscapedString slow path of readString, unescapes into scratch
+func (d *Decoder) readEscapedString(start int) ([]byte, error) {
+	d.scratch = append(d.scratch[:0], d.buf[start:d.pos]...)
+	for d.pos < len(d.buf) {
+		c := d.buf[d.pos]
+		d.pos++
+		switch c {
+		case '"':
+			return d.scratch, nil
+		case '\\':
+			if d.pos >= len(d.buf) {
+				return nil, d.errorf("unterminated string")
+			}
+			c = d.buf[d.pos]
+			d.pos++
+			switch c {
+			case '"', '\\', '/':
+				d.scratch = append(d.scratch, c)
+			case 'b':
+				d.scratch = append(d.scratch, '\b')
+			case 'f':
+				d.scratch = append(d.scratch, '\f')
+			case 'n':
+				d.scratch = append(d.scratch, '\n')
+			case 'r':
+				d.scratch = append(d.scratch, '\r')
+			case 't':
+				d.scratch = append(d.scratch, '\t')
+			case 'u':
+				if len(d.buf)-d.pos < 4 {
+					return nil, d.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(string(d.buf[d.pos:d.pos+4]), 16, 32)
+				if err != nil {
+					return nil, d.errorf("invalid unicode escape")
+				}
+				d.pos += 4
+				d.scratch = utf8.AppendRune(d.scratch, rune(r))
+			default:
+				return nil, d.errorf("invalid escape '\\%c'", c)
+			}
+		default:
+			d.scratch = append(d.scratch, c)
+		}
+	}
+	return nil, d.errorf("unterminated string")
+}
+
+// skip skips a JSON value of any type
+func (d *Decoder) skip() error {
+	switch c := d.peek(); c {
+	case '"':
+		_, err := d.readString()
+		return err
+	case '{', '[':
+		closing := byte('}')
+		if c == '[' {
+			closing = ']'
+		}
+		d.pos++
+		if d.peek() == closing {
+			d.pos++
+			return nil
+		}
+		for {
+			if c == '{' {
+				if _, err := d.readString(); err != nil {
+					return err
+				}
+				if err := d.expect(':'); err != nil {
+					return err
+				}
+			}
+			if err := d.skip(); err != nil {
+				return err
+			}
+			if more, err := d.more(closing); err != nil {
+				return err
+			} else if !more {
+				return nil
+			}
+		}
+	case 't', 'f', 'n':
+		for _, literal := range []string{"true", "false", "null"} {
+			if len(d.buf)-d.pos >= len(literal) && string(d.buf[d.pos:d.pos+len(literal)]) == literal {
+				d.pos += len(literal)
+				return nil
+			}
+		}
+		return d.errorf("invalid literal")
+	case 0:
+		return d.errorf("unexpected end of input")
+	default:
+		_, err := d.readNumber()
+		return err
+	}
+}
+
+func (d *Decoder) errorf(format string, args ...interface{}) error {
+	if d.pos >= len(d.buf) {
+		return errors.New(fmt.Sprintf(format, args...) + " at end of input")
+	}
+	return fmt.Errorf(format+" at offset %d", append(args, d.pos)...)
+}
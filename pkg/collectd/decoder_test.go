@@ -0,0 +1,173 @@
+package collectd
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/cdtime"
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+// loadCapture returns non-empty messages of cd-capture.txt
+func loadCapture(tb testing.TB) [][]byte {
+	f, err := os.Open("../../cd-capture.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	msgs := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			msgs = append(msgs, append([]byte{}, scanner.Bytes()...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return msgs
+}
+
+// equalRecords compares records treating NaN values as equal and nil slices as empty
+func equalRecords(exp []Collectd, act []Collectd) bool {
+	if len(exp) != len(act) {
+		return false
+	}
+	for i := range exp {
+		e, a := exp[i], act[i]
+		if len(e.Values) != len(a.Values) {
+			return false
+		}
+		for j := range e.Values {
+			if e.Values[j] != a.Values[j] && !(math.IsNaN(e.Values[j]) && math.IsNaN(a.Values[j])) {
+				return false
+			}
+		}
+		e.Values, a.Values = nil, nil
+		if len(e.Dstypes) == 0 && len(a.Dstypes) == 0 {
+			e.Dstypes, a.Dstypes = nil, nil
+		}
+		if len(e.Dsnames) == 0 && len(a.Dsnames) == 0 {
+			e.Dsnames, a.Dsnames = nil, nil
+		}
+		if !reflect.DeepEqual(e, a) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTimeFromSeconds(t *testing.T) {
+	for seconds, expected := range map[float64]time.Duration{
+		1580682811:     1580682811 * time.Second,
+		1580682811.25:  1580682811*time.Second + 250*time.Millisecond,
+		0.000001:       time.Microsecond,
+		0:              0,
+		-1.5:           0,
+		-1580682811.25: 0,
+	} {
+		assert.Equals(t, cdtime.NewDuration(expected), TimeFromSeconds(seconds))
+	}
+	assert.Equals(t, cdtime.Time(0), TimeFromSeconds(math.NaN()))
+	assert.Equals(t, cdtime.NewDuration(math.MaxInt64), TimeFromSeconds(math.Inf(1)))
+}
+
+func TestDecoder(t *testing.T) {
+	t.Run("validation", func(t *testing.T) {
+		d := NewDecoder()
+		checkValidation(t, d.Decode)
+	})
+
+	t.Run("matches ParseInputByte on capture", func(t *testing.T) {
+		d := NewDecoder()
+		for _, msg := range loadCapture(t) {
+			exp, expErr := new(Collectd).ParseInputByte(msg)
+			act, actErr := d.Decode(msg)
+			if expErr != nil {
+				assert.Assert(t, actErr != nil, "expected error decoding %s", msg)
+				continue
+			}
+			assert.Ok(t, actErr)
+			assert.Assert(t, equalRecords(*exp, act), "decoded\n%+v\nexpected\n%+v", act, *exp)
+		}
+	})
+
+	t.Run("escapes, nulls and unknown fields", func(t *testing.T) {
+		d := NewDecoder()
+		records, err := d.Decode([]byte(`[{"values":[1e3, -2.5, null],"dstypes":["gauge","gauge","gauge"],"dsnames":["a","b","c"],
+			"meta":{"nested":[1,{"x":"y"}],"flag":true,"none":null},"host":"h\"q\u00e9","plugin":"p","plugin_instance":null,"type":"t","type_instance":"a\/b"}]`))
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(records))
+		assert.Equals(t, []float64{1000, -2.5}, records[0].Values[:2])
+		assert.Assert(t, math.IsNaN(records[0].Values[2]), "expected NaN")
+		assert.Equals(t, "h\"qé", records[0].Host)
+		assert.Equals(t, "", records[0].PluginInstance)
+		assert.Equals(t, "a/b", records[0].TypeInstance)
+
+		records, err = d.Decode([]byte(` [ ] `))
+		assert.Ok(t, err)
+		assert.Equals(t, 0, len(records))
+	})
+
+	t.Run("reuses records", func(t *testing.T) {
+		d := NewDecoder()
+		records, err := d.Decode([]byte(`[{"values":[1,2],"dstypes":["gauge","gauge"],"dsnames":["rx","tx"],"host":"a","plugin":"p","type":"t","type_instance":"x"}]`))
+		assert.Ok(t, err)
+		assert.Equals(t, 2, len(records[0].Values))
+		records, err = d.Decode([]byte(`[{"values":[3],"dstypes":["derive"],"dsnames":["value"],"host":"b","plugin":"p","type":"t"}]`))
+		assert.Ok(t, err)
+		assert.Equals(t, []float64{3}, records[0].Values)
+		assert.Equals(t, []string{"value"}, records[0].Dsnames)
+		assert.Equals(t, "", records[0].TypeInstance)
+	})
+
+	t.Run("does not allocate", func(t *testing.T) {
+		d := NewDecoder()
+		msgs := loadCapture(t)[:100]
+		for _, msg := range msgs {
+			_, _ = d.Decode(msg)
+		}
+		allocs := testing.AllocsPerRun(10, func() {
+			for _, msg := range msgs {
+				_, _ = d.Decode(msg)
+			}
+		})
+		assert.Equals(t, 0.0, allocs)
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	msgs := loadCapture(b)
+	size := 0
+	for _, msg := range msgs {
+		size += len(msg)
+	}
+
+	b.Run("jsoniter", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(size))
+		for i := 0; i < b.N; i++ {
+			for _, msg := range msgs {
+				_, _ = new(Collectd).ParseInputByte(msg)
+			}
+		}
+	})
+
+	b.Run("decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(size))
+		for i := 0; i < b.N; i++ {
+			for _, msg := range msgs {
+				d := AcquireDecoder()
+				_, _ = d.Decode(msg)
+				ReleaseDecoder(d)
+			}
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package collectd
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"collectd.org/cdtime"
+)
+
+var putvalCommand = []byte("PUTVAL")
+
+// IsPutval whether msg is in collectd plain text protocol rather than JSON
+func IsPutval(msg []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(msg, " \t\r\n"), putvalCommand)
+}
+
+// DecodePutval decodes collectd plain text protocol msg, one PUTVAL command
+// per line, as emitted by write_http with Format "Command" and the exec plugin:
+//
+//	PUTVAL host/plugin-instance/type-instance interval=10 N:1.23
+//
+// Data source names and types are resolved in db. Invalid lines, including
+// types missing in db, are skipped and their errors returned joined, along
+// with the records of the valid lines. The returned records are owned by d and
+// only valid until the next call to Decode or DecodePutval
+func (d *Decoder) DecodePutval(msg []byte, db *TypesDB) ([]Collectd, error) {
+	d.records = d.records[:0]
+	var errs []error
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		n := len(d.records)
+		if err := d.decodePutvalLine(line, db); err != nil {
+			d.records = d.records[:n]
+			errs = append(errs, err)
+		}
+	}
+	return d.records, errors.Join(errs...)
+}
+
+func (d *Decoder) decodePutvalLine(line []byte, db *TypesDB) error {
+	command, line := nextPutvalField(line)
+	if !bytes.Equal(command, putvalCommand) {
+		return invalid(ReasonMalformedPutval, "unknown command %q", command)
+	}
+	identifier, line := nextPutvalField(line)
+	host, plugin, pluginInstance, typ, typeInstance, ok := splitIdentifier(identifier)
+	if !ok {
+		return invalid(ReasonMalformedPutval, "invalid identifier %q", identifier)
+	}
+
+	interval := 0.0
+	for {
+		option, rest := nextPutvalField(line)
+		eq := bytes.IndexByte(option, '=')
+		if eq < 0 {
+			break
+		}
+		line = rest
+		if string(option[:eq]) == "interval" {
+			var err error
+			if interval, err = parseFloat(option[eq+1:]); err != nil {
+				return invalid(ReasonMalformedPutval, "invalid interval %q", option[eq+1:])
+			}
+		}
+	}
+
+	sources, found := db.Get(string(typ))
+	if !found {
+		return invalid(ReasonUnknownType, "%s: type %q not in types.db", identifier, typ)
+	}
+
+	values, line := nextPutvalField(line)
+	if len(values) == 0 {
+		return invalid(ReasonNoValues, "%s: no values", identifier)
+	}
+	for ; len(values) > 0; values, line = nextPutvalField(line) {
+		c := d.nextRecord()
+		c.Host = d.intern(host)
+		c.Plugin = d.intern(plugin)
+		c.PluginInstance = d.intern(pluginInstance)
+		c.Type = d.intern(typ)
+		c.TypeInstance = d.intern(typeInstance)
+		c.Interval = interval
+
+		colon := bytes.IndexByte(values, ':')
+		if colon < 0 {
+			return invalid(ReasonMalformedPutval, "%s: missing time in %q", identifier, values)
+		}
+		if ts := values[:colon]; string(ts) == "N" {
+			c.Time = cdtime.New(time.Now())
+		} else if f, err := parseFloat(ts); err == nil {
+			c.Time = TimeFromSeconds(f)
+		} else {
+			return invalid(ReasonMalformedPutval, "%s: invalid time %q", identifier, ts)
+		}
+
+		for rest := values[colon+1:]; ; {
+			value := rest
+			if i := bytes.IndexByte(rest, ':'); i >= 0 {
+				value, rest = rest[:i], rest[i+1:]
+			} else {
+				rest = nil
+			}
+			f := math.NaN()
+			if string(value) != "U" {
+				var err error
+				if f, err = parseFloat(value); err != nil {
+					return invalid(ReasonMalformedPutval, "%s: invalid value %q", identifier, value)
+				}
+			}
+			c.Values = append(c.Values, f)
+			if rest == nil {
+				break
+			}
+		}
+		if len(c.Values) != len(sources) {
+			return invalid(ReasonLengthMismatch, "%s: %d values, type %s has %d data sources",
+				identifier, len(c.Values), typ, len(sources))
+		}
+		for _, ds := range sources {
+			c.Dsnames = append(c.Dsnames, ds.Name)
+			c.Dstypes = append(c.Dstypes, ds.Type)
+		}
+	}
+	return nil
+}
+
+// nextPutvalField splits off the next space separated, optionally quoted field of line
+func nextPutvalField(line []byte) (field []byte, rest []byte) {
+	line = bytes.TrimLeft(line, " \t")
+	if len(line) > 0 && line[0] == '"' {
+		if end := bytes.IndexByte(line[1:], '"'); end >= 0 {
+			return line[1 : end+1], line[end+2:]
+		}
+	}
+	if i := bytes.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], line[i:]
+	}
+	return line, nil
+}
+
+// splitIdentifier splits host/plugin[-instance]/type[-instance]
+func splitIdentifier(identifier []byte) (host, plugin, pluginInstance, typ, typeInstance []byte, ok bool) {
+	parts := bytes.SplitN(identifier, []byte{'/'}, 3)
+	if len(parts) != 3 || len(parts[0]) == 0 {
+		return
+	}
+	host, plugin, typ = parts[0], parts[1], parts[2]
+	if i := bytes.IndexByte(plugin, '-'); i >= 0 {
+		plugin, pluginInstance = plugin[:i], plugin[i+1:]
+	}
+	if i := bytes.IndexByte(typ, '-'); i >= 0 {
+		typ, typeInstance = typ[:i], typ[i+1:]
+	}
+	ok = len(plugin) > 0 && len(typ) > 0
+	return
+}
+
+// parseFloat parses b without converting it to a string
+func parseFloat(b []byte) (float64, error) {
+	if len(b) == 0 {
+		return 0, strconv.ErrSyntax
+	}
+	f, err := strconv.ParseFloat(unsafe.String(&b[0], len(b)), 64)
+	if err != nil {
+		// the error must not keep a reference to b
+		return 0, strconv.ErrSyntax
+	}
+	return f, nil
+}
@@ -0,0 +1,85 @@
+package collectd
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+func TestDecodePutval(t *testing.T) {
+	db, err := LoadTypesDB("testdata/types.db")
+	assert.Ok(t, err)
+
+	t.Run("detect", func(t *testing.T) {
+		assert.Assert(t, IsPutval([]byte("\nPUTVAL h/cpu-0/cpu-user N:1")), "PUTVAL not detected")
+		assert.Assert(t, !IsPutval([]byte(`[{"values":[1]}]`)), "JSON detected as PUTVAL")
+	})
+
+	t.Run("single value", func(t *testing.T) {
+		records, err := NewDecoder().DecodePutval([]byte("PUTVAL host0/cpu-0/cpu-user interval=10 1580682811.5:1270783\n"), db)
+		assert.Ok(t, err)
+		assert.Equals(t, 1, len(records))
+		r := records[0]
+		assert.Ok(t, r.Validate())
+		assert.Equals(t, "host0", r.Host)
+		assert.Equals(t, "cpu", r.Plugin)
+		assert.Equals(t, "0", r.PluginInstance)
+		assert.Equals(t, "cpu", r.Type)
+		assert.Equals(t, "user", r.TypeInstance)
+		assert.Equals(t, 10.0, r.Interval)
+		assert.Equals(t, []float64{1270783}, r.Values)
+		assert.Equals(t, []string{"value"}, r.Dsnames)
+		assert.Equals(t, []string{"derive"}, r.Dstypes)
+		assert.Equals(t, 1580682811.5, r.Time.Float())
+	})
+
+	t.Run("multiple lines and value lists", func(t *testing.T) {
+		msg := `PUTVAL "host 1/interface-eth0/if_octets" interval=5.000 1580682811:10:U 1580682816:20:30
+PUTVAL host1/load/load N:0.5:0.4:0.3
+`
+		records, err := NewDecoder().DecodePutval([]byte(msg), db)
+		assert.Ok(t, err)
+		assert.Equals(t, 3, len(records))
+		assert.Equals(t, "host 1", records[0].Host)
+		assert.Equals(t, "", records[0].TypeInstance)
+		assert.Equals(t, []string{"rx", "tx"}, records[0].Dsnames)
+		assert.Equals(t, 10.0, records[0].Values[0])
+		assert.Assert(t, math.IsNaN(records[0].Values[1]), "expected U as NaN")
+		assert.Equals(t, []float64{20, 30}, records[1].Values)
+		assert.Equals(t, []float64{0.5, 0.4, 0.3}, records[2].Values)
+		assert.Equals(t, "", records[2].PluginInstance)
+		assert.Assert(t, time.Since(records[2].Time.Time()) < time.Minute, "N not resolved to now")
+	})
+
+	t.Run("invalid lines are skipped", func(t *testing.T) {
+		msg := `PUTVAL host1/load/load N:0.5:0.4
+PUTVAL host1/foo/bogus N:1
+GETVAL host1/load/load
+PUTVAL host1 N:1
+PUTVAL host1/cpu/cpu N:x
+PUTVAL host1/memory/memory-used N:42
+`
+		records, err := NewDecoder().DecodePutval([]byte(msg), db)
+		assert.Equals(t, 1, len(records))
+		assert.Equals(t, []float64{42}, records[0].Values)
+
+		reasons := []string{}
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var verr *ValidationError
+			assert.Assert(t, errors.As(e, &verr), "expected validation error, got %v", e)
+			reasons = append(reasons, verr.Reason)
+		}
+		assert.Equals(t, []string{ReasonLengthMismatch, ReasonUnknownType, ReasonMalformedPutval, ReasonMalformedPutval, ReasonMalformedPutval}, reasons)
+	})
+
+	t.Run("without types.db", func(t *testing.T) {
+		records, err := NewDecoder().DecodePutval([]byte("PUTVAL h/cpu-0/cpu-user N:1"), nil)
+		assert.Equals(t, 0, len(records))
+		var verr *ValidationError
+		assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+		assert.Equals(t, ReasonUnknownType, verr.Reason)
+	})
+}
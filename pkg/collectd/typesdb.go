@@ -0,0 +1,168 @@
+package collectd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DataSource data source of a collectd type as defined in types.db
+type DataSource struct {
+	Name string
+	// lower case dstype, as used in collectd JSON
+	Type string
+	// NaN when unbounded
+	Min float64
+	Max float64
+}
+
+// TypesDB collectd types.db, data sources by type name
+type TypesDB struct {
+	types map[string][]DataSource
+}
+
+// NewTypesDB returns empty TypesDB
+func NewTypesDB() *TypesDB {
+	return &TypesDB{types: make(map[string][]DataSource)}
+}
+
+// LoadTypesDB reads types.db files from paths, later files override types of earlier ones
+func LoadTypesDB(paths ...string) (*TypesDB, error) {
+	db := NewTypesDB()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// Parse reads types.db lines from r into db
+//
+//	if_octets  rx:DERIVE:0:U, tx:DERIVE:0:U
+func (db *TypesDB) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: missing data sources of type %s", lineNo, fields[0])
+		}
+		sources := []DataSource{}
+		for _, spec := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			ds, err := parseDataSource(spec)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			sources = append(sources, ds)
+		}
+		db.types[fields[0]] = sources
+	}
+	return scanner.Err()
+}
+
+func parseDataSource(spec string) (DataSource, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 4 {
+		return DataSource{}, fmt.Errorf("invalid data source %q", spec)
+	}
+	ds := DataSource{Name: parts[0], Type: strings.ToLower(parts[1])}
+	switch ds.Type {
+	case "gauge", "counter", "derive", "absolute":
+	default:
+		return DataSource{}, fmt.Errorf("invalid data source type %q", parts[1])
+	}
+	var err error
+	if ds.Min, err = parseBound(parts[2]); err != nil {
+		return DataSource{}, err
+	}
+	if ds.Max, err = parseBound(parts[3]); err != nil {
+		return DataSource{}, err
+	}
+	return ds, nil
+}
+
+func parseBound(s string) (float64, error) {
+	if s == "U" {
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid data source bound %q", s)
+	}
+	return f, nil
+}
+
+// Get returns data sources of collectd type typ
+func (db *TypesDB) Get(typ string) ([]DataSource, bool) {
+	if db == nil {
+		return nil, false
+	}
+	sources, found := db.types[typ]
+	return sources, found
+}
+
+// Len number of types in db
+func (db *TypesDB) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.types)
+}
+
+// Resolve fills missing dsnames and dstypes of c from its type in db and
+// checks c against the type: number of values, data source names and types
+// must match and gauges must be within min and max of the data source. Min and
+// max of counters apply to their rate and are not enforced. Records of types
+// missing in db are left to Validate
+func (db *TypesDB) Resolve(c *Collectd) error {
+	sources, found := db.Get(c.Type)
+	if !found {
+		return nil
+	}
+	if len(c.Values) != len(sources) {
+		return invalid(ReasonTypeMismatch, "%s/%s: %d values, type has %d data sources",
+			c.Plugin, c.Type, len(c.Values), len(sources))
+	}
+	if len(c.Dsnames) == 0 {
+		for _, ds := range sources {
+			c.Dsnames = append(c.Dsnames, ds.Name)
+		}
+	}
+	if len(c.Dstypes) == 0 {
+		for _, ds := range sources {
+			c.Dstypes = append(c.Dstypes, ds.Type)
+		}
+	}
+	if len(c.Dsnames) != len(sources) || len(c.Dstypes) != len(sources) {
+		return invalid(ReasonTypeMismatch, "%s/%s: %d dsnames, %d dstypes, type has %d data sources",
+			c.Plugin, c.Type, len(c.Dsnames), len(c.Dstypes), len(sources))
+	}
+	for i, ds := range sources {
+		if c.Dsnames[i] != ds.Name || c.Dstypes[i] != ds.Type {
+			return invalid(ReasonTypeMismatch, "%s/%s: data source %s:%s, type declares %s:%s",
+				c.Plugin, c.Type, c.Dsnames[i], c.Dstypes[i], ds.Name, ds.Type)
+		}
+		if ds.Type != "gauge" {
+			continue
+		}
+		if v := c.Values[i]; v < ds.Min || v > ds.Max {
+			return invalid(ReasonOutOfRange, "%s/%s: %s %v out of range [%v, %v]",
+				c.Plugin, c.Type, ds.Name, v, ds.Min, ds.Max)
+		}
+	}
+	return nil
+}
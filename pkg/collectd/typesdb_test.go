@@ -0,0 +1,84 @@
+package collectd
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+func TestTypesDB(t *testing.T) {
+	t.Run("load", func(t *testing.T) {
+		db, err := LoadTypesDB("testdata/types.db")
+		assert.Ok(t, err)
+		assert.Equals(t, 8, db.Len())
+
+		sources, found := db.Get("load")
+		assert.Assert(t, found, "load not found")
+		assert.Equals(t, 3, len(sources))
+		assert.Equals(t, DataSource{Name: "midterm", Type: "gauge", Min: 0, Max: 5000}, sources[1])
+
+		sources, _ = db.Get("if_octets")
+		assert.Equals(t, "derive", sources[0].Type)
+		assert.Assert(t, math.IsNaN(sources[0].Max), "expected unbounded max")
+
+		_, found = db.Get("bogus")
+		assert.Assert(t, !found, "unexpected type found")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, line := range []string{"load", "load shortterm:GAUGE:0", "load shortterm:HISTOGRAM:0:U", "load shortterm:GAUGE:x:U"} {
+			err := NewTypesDB().Parse(strings.NewReader(line))
+			assert.Assert(t, err != nil, "expected error parsing %q", line)
+		}
+	})
+}
+
+func TestResolve(t *testing.T) {
+	db, err := LoadTypesDB("testdata/types.db")
+	assert.Ok(t, err)
+
+	tests := []struct {
+		name   string
+		record Collectd
+		reason string
+	}{
+		{"missing dsnames and dstypes", Collectd{Values: []float64{1, 2}, Plugin: "interface", Type: "if_octets"}, ""},
+		{"matching", Collectd{Values: []float64{1, 2}, Dsnames: []string{"rx", "tx"}, Dstypes: []string{"derive", "derive"}, Plugin: "interface", Type: "if_octets"}, ""},
+		{"unknown type", Collectd{Values: []float64{1}, Dsnames: []string{"x"}, Dstypes: []string{"gauge"}, Plugin: "p", Type: "custom"}, ""},
+		{"value count", Collectd{Values: []float64{1}, Plugin: "interface", Type: "if_octets"}, ReasonTypeMismatch},
+		{"dsname", Collectd{Values: []float64{1, 2}, Dsnames: []string{"in", "out"}, Plugin: "interface", Type: "if_octets"}, ReasonTypeMismatch},
+		{"dstype", Collectd{Values: []float64{1, 2}, Dstypes: []string{"gauge", "gauge"}, Plugin: "interface", Type: "if_octets"}, ReasonTypeMismatch},
+		{"above max", Collectd{Values: []float64{101}, Plugin: "cpu", Type: "percent"}, ReasonOutOfRange},
+		{"below min", Collectd{Values: []float64{-1}, Plugin: "cpu", Type: "percent"}, ReasonOutOfRange},
+		{"NaN gauge", Collectd{Values: []float64{math.NaN()}, Plugin: "cpu", Type: "percent"}, ""},
+		{"counter bounds not enforced", Collectd{Values: []float64{-1}, Plugin: "cpu", Type: "cpu"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := db.Resolve(&test.record)
+			if test.reason == "" {
+				assert.Ok(t, err)
+				return
+			}
+			var verr *ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+			assert.Equals(t, test.reason, verr.Reason)
+		})
+	}
+
+	t.Run("fills data sources", func(t *testing.T) {
+		c := Collectd{Values: []float64{1, 2}, Host: "h", Plugin: "interface", Type: "if_octets"}
+		assert.Ok(t, db.Resolve(&c))
+		assert.Equals(t, []string{"rx", "tx"}, c.Dsnames)
+		assert.Equals(t, []string{"derive", "derive"}, c.Dstypes)
+		assert.Ok(t, c.Validate())
+	})
+
+	t.Run("nil types.db", func(t *testing.T) {
+		var db *TypesDB
+		assert.Ok(t, db.Resolve(&Collectd{Values: []float64{1}, Type: "percent"}))
+	})
+}
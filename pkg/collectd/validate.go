@@ -0,0 +1,135 @@
+package collectd
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/modern-go/reflect2"
+)
+
+// Reasons a collectd message or record is rejected
+const (
+	ReasonMalformedJSON   = "malformed_json"
+	ReasonLengthMismatch  = "length_mismatch"
+	ReasonNoValues        = "no_values"
+	ReasonUnknownDstype   = "unknown_dstype"
+	ReasonMissingHost     = "missing_host"
+	ReasonMissingPlugin   = "missing_plugin"
+	ReasonMissingType     = "missing_type"
+	ReasonNonFinite       = "non_finite"
+	ReasonMalformedPutval = "malformed_putval"
+	ReasonUnknownType     = "unknown_type"
+	ReasonTypeMismatch    = "type_mismatch"
+	ReasonOutOfRange      = "out_of_range"
+)
+
+// Reasons all reasons reported by decoders and Validate
+var Reasons = []string{
+	ReasonMalformedJSON,
+	ReasonLengthMismatch,
+	ReasonNoValues,
+	ReasonUnknownDstype,
+	ReasonMissingHost,
+	ReasonMissingPlugin,
+	ReasonMissingType,
+	ReasonNonFinite,
+	ReasonMalformedPutval,
+	ReasonUnknownType,
+	ReasonTypeMismatch,
+	ReasonOutOfRange,
+}
+
+// ValidationError malformed collectd message or record
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func invalid(reason string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// Validate checks the record is consistent enough to be stored: values,
+// dstypes and dsnames of the same length, known dstypes, non-empty host,
+// plugin and type and finite numbers. NaN is accepted for gauges, collectd
+// uses it for unknown values and writes it as null
+func (c *Collectd) Validate() error {
+	if len(c.Values) == 0 {
+		return invalid(ReasonNoValues, "%s/%s: no values", c.Plugin, c.Type)
+	}
+	if len(c.Dstypes) != len(c.Values) || len(c.Dsnames) != len(c.Values) {
+		return invalid(ReasonLengthMismatch, "%s/%s: %d values, %d dstypes, %d dsnames",
+			c.Plugin, c.Type, len(c.Values), len(c.Dstypes), len(c.Dsnames))
+	}
+	if c.Host == "" {
+		return invalid(ReasonMissingHost, "%s/%s: empty host", c.Plugin, c.Type)
+	}
+	if c.Plugin == "" {
+		return invalid(ReasonMissingPlugin, "empty plugin")
+	}
+	if c.Type == "" {
+		return invalid(ReasonMissingType, "%s: empty type", c.Plugin)
+	}
+	if math.IsNaN(c.Interval) || math.IsInf(c.Interval, 0) {
+		return invalid(ReasonNonFinite, "%s/%s: interval %v", c.Plugin, c.Type, c.Interval)
+	}
+	for i, dstype := range c.Dstypes {
+		switch dstype {
+		case "gauge":
+			if math.IsInf(c.Values[i], 0) {
+				return invalid(ReasonNonFinite, "%s/%s: %s %v", c.Plugin, c.Type, c.Dsnames[i], c.Values[i])
+			}
+		case "counter", "derive", "absolute":
+			if math.IsNaN(c.Values[i]) || math.IsInf(c.Values[i], 0) {
+				return invalid(ReasonNonFinite, "%s/%s: %s %v", c.Plugin, c.Type, c.Dsnames[i], c.Values[i])
+			}
+		default:
+			return invalid(ReasonUnknownDstype, "%s/%s: %q", c.Plugin, c.Type, dstype)
+		}
+	}
+	return nil
+}
+
+// strictConfig matches jsoniter.ConfigFastest, except null numbers decode
+// to NaN instead of silently becoming zero
+var strictConfig = func() jsoniter.API {
+	api := jsoniter.Config{
+		EscapeHTML:                    false,
+		MarshalFloatWith6Digits:       true,
+		ObjectFieldMustBeSimpleString: true,
+	}.Froze()
+	api.RegisterExtension(&nullAsNaNExtension{})
+	return api
+}()
+
+type nullAsNaNExtension struct {
+	jsoniter.DummyExtension
+}
+
+func (e *nullAsNaNExtension) CreateDecoder(typ reflect2.Type) jsoniter.ValDecoder {
+	if typ.Kind() == reflect.Float64 {
+		return nullAsNaNDecoder{}
+	}
+	return nil
+}
+
+type nullAsNaNDecoder struct{}
+
+func (nullAsNaNDecoder) Decode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
+	if iter.ReadNil() {
+		*(*float64)(ptr) = math.NaN()
+		return
+	}
+	*(*float64)(ptr) = iter.ReadFloat64()
+}
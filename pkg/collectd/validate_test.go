@@ -0,0 +1,69 @@
+package collectd
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+var validationTests = []struct {
+	name   string
+	msg    string
+	reason string
+}{
+	{"valid", `[{"values":[1,2],"dstypes":["derive","gauge"],"dsnames":["rx","tx"],"time":1580682811.0,"interval":5,"host":"h","plugin":"if","type":"if_octets"}]`, ""},
+	{"null gauge", `[{"values":[null],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`, ""},
+	{"null derive", `[{"values":[null],"dstypes":["derive"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"cpu"}]`, ReasonNonFinite},
+	{"length mismatch", `[{"values":[1,2],"dstypes":["gauge"],"dsnames":["rx","tx"],"time":1580682811.0,"interval":5,"host":"h","plugin":"if","type":"if_octets"}]`, ReasonLengthMismatch},
+	{"missing dsnames", `[{"values":[1],"dstypes":["gauge"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`, ReasonLengthMismatch},
+	{"no values", `[{"values":[],"dstypes":[],"dsnames":[],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`, ReasonNoValues},
+	{"unknown dstype", `[{"values":[1],"dstypes":["histogram"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu","type":"percent"}]`, ReasonUnknownDstype},
+	{"missing host", `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"plugin":"cpu","type":"percent"}]`, ReasonMissingHost},
+	{"missing plugin", `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","type":"percent"}]`, ReasonMissingPlugin},
+	{"missing type", `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5,"host":"h","plugin":"cpu"}]`, ReasonMissingType},
+	{"null interval", `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":null,"host":"h","plugin":"cpu","type":"percent"}]`, ReasonNonFinite},
+	{"truncated", `[{"values":[1],"dstypes":["gauge"],`, ReasonMalformedJSON},
+	{"trailing data", `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"host":"h","plugin":"cpu","type":"percent"}] []`, ReasonMalformedJSON},
+	{"not json", `not json`, ReasonMalformedJSON},
+}
+
+func checkValidation(t *testing.T, parse func([]byte) ([]Collectd, error)) {
+	for _, test := range validationTests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics, err := parse([]byte(test.msg))
+			if err == nil {
+				for _, m := range metrics {
+					if err = m.Validate(); err != nil {
+						break
+					}
+				}
+			}
+			if test.reason == "" {
+				assert.Ok(t, err)
+				return
+			}
+			var verr *ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+			assert.Equals(t, test.reason, verr.Reason)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	checkValidation(t, func(msg []byte) ([]Collectd, error) {
+		metrics, err := new(Collectd).ParseInputByte(msg)
+		if err != nil {
+			return nil, err
+		}
+		return *metrics, nil
+	})
+
+	t.Run("null decodes to NaN", func(t *testing.T) {
+		metrics, err := new(Collectd).ParseInputString(`[{"values":[null,1],"dstypes":["gauge","gauge"],"dsnames":["a","b"],"host":"h","plugin":"p","type":"t"}]`)
+		assert.Ok(t, err)
+		assert.Assert(t, math.IsNaN((*metrics)[0].Values[0]), "expected NaN, got %v", (*metrics)[0].Values[0])
+		assert.Equals(t, 1.0, (*metrics)[0].Values[1])
+	})
+}
@@ -0,0 +1,124 @@
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+// Reasons graphite messages or data points are rejected
+const (
+	ReasonMalformedGraphite = "malformed_graphite"
+	ReasonMalformedPickle   = "malformed_pickle"
+)
+
+// Reasons all reasons reported by graphite decoders
+var Reasons = []string{ReasonMalformedGraphite, ReasonMalformedPickle}
+
+func init() {
+	cdmetrics.RegisterDecodeErrorReasons(Reasons...)
+}
+
+func invalid(reason string, format string, args ...interface{}) *collectd.ValidationError {
+	return &collectd.ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// DecodePlaintext decodes graphite plaintext protocol msg, one data point per line:
+//
+//	path value timestamp
+//
+// Invalid lines are skipped and their errors returned joined, along with the
+// records of the valid lines
+func (m *Mapper) DecodePlaintext(msg []byte) ([]collectd.Collectd, error) {
+	var records []collectd.Collectd
+	var errs []error
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			errs = append(errs, invalid(ReasonMalformedGraphite, "expected path value timestamp, got %q", line))
+			continue
+		}
+		value, err := strconv.ParseFloat(string(fields[1]), 64)
+		if err != nil {
+			errs = append(errs, invalid(ReasonMalformedGraphite, "%s: invalid value %q", fields[0], fields[1]))
+			continue
+		}
+		timestamp, err := strconv.ParseFloat(string(fields[2]), 64)
+		if err != nil {
+			errs = append(errs, invalid(ReasonMalformedGraphite, "%s: invalid timestamp %q", fields[0], fields[2]))
+			continue
+		}
+		records = append(records, m.Map(string(fields[0]), value, timestamp))
+	}
+	return records, errors.Join(errs...)
+}
+
+// DecodePickle decodes the payload of a graphite pickle protocol message, a
+// pickled list of (path, (timestamp, value)) tuples without the length prefix.
+// Invalid data points are skipped and their errors returned joined, along
+// with the records of the valid ones
+func (m *Mapper) DecodePickle(msg []byte) ([]collectd.Collectd, error) {
+	obj, err := unpickle(msg)
+	if err != nil {
+		return nil, invalid(ReasonMalformedPickle, "%v", err)
+	}
+	list, ok := obj.(*pickleList)
+	if !ok {
+		return nil, invalid(ReasonMalformedPickle, "expected list of data points, got %T", obj)
+	}
+	var records []collectd.Collectd
+	var errs []error
+	for _, item := range list.items {
+		point, ok := item.([]interface{})
+		if !ok || len(point) != 2 {
+			errs = append(errs, invalid(ReasonMalformedPickle, "expected (path, (timestamp, value)), got %v", item))
+			continue
+		}
+		metricPath, ok := point[0].(string)
+		if !ok {
+			errs = append(errs, invalid(ReasonMalformedPickle, "expected path, got %v", point[0]))
+			continue
+		}
+		pair, ok := point[1].([]interface{})
+		if !ok || len(pair) != 2 {
+			errs = append(errs, invalid(ReasonMalformedPickle, "%s: expected (timestamp, value), got %v", metricPath, point[1]))
+			continue
+		}
+		timestamp, tsOk := pickleNumber(pair[0])
+		value, valueOk := pickleNumber(pair[1])
+		if !tsOk || !valueOk {
+			errs = append(errs, invalid(ReasonMalformedPickle, "%s: expected numeric timestamp and value, got %v", metricPath, pair))
+			continue
+		}
+		records = append(records, m.Map(metricPath, value, timestamp))
+	}
+	return records, errors.Join(errs...)
+}
+
+// pickleNumber converts numbers and numeric strings, carbon accepts both
+func pickleNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	case nil:
+		return math.NaN(), true
+	}
+	return 0, false
+}
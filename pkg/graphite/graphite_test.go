@@ -0,0 +1,156 @@
+package graphite
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+type identifier struct {
+	host, plugin, pluginInstance, typ, typeInstance, dsname, dstype string
+}
+
+func identify(c collectd.Collectd) identifier {
+	return identifier{c.Host, c.Plugin, c.PluginInstance, c.Type, c.TypeInstance, c.Dsnames[0], c.Dstypes[0]}
+}
+
+func TestMapper(t *testing.T) {
+	db, err := collectd.LoadTypesDB("../collectd/testdata/types.db")
+	assert.Ok(t, err)
+
+	tests := []struct {
+		name      string
+		templates []string
+		path      string
+		exp       identifier
+	}{
+		{
+			name: "write_graphite default",
+			path: "host1.cpu-0.cpu-user",
+			exp:  identifier{"host1", "cpu", "0", "cpu", "user", "value", "derive"},
+		},
+		{
+			name: "data source of multi value type",
+			path: "host1.load.load.midterm",
+			exp:  identifier{"host1", "load", "", "load", "", "midterm", "gauge"},
+		},
+		{
+			name: "unknown type defaults to gauge",
+			path: "host1.app.requests-get",
+			exp:  identifier{"host1", "app", "", "requests", "get", "value", "gauge"},
+		},
+		{
+			name:      "filter, skipped nodes, greedy and static fields",
+			templates: []string{"servers.*.app.* .host..plugin.type_instance* type=requests,dstype=derive"},
+			path:      "servers.web1.app.http.get.index",
+			exp:       identifier{"web1", "http", "", "requests", "get.index", "value", "derive"},
+		},
+		{
+			name:      "unmatched filter falls back to default",
+			templates: []string{"servers.* .host.plugin.type"},
+			path:      "host1.memory.memory-used",
+			exp:       identifier{"host1", "memory", "", "memory", "used", "value", "gauge"},
+		},
+		{
+			name:      "nodes of the same field are joined",
+			templates: []string{"host.host.plugin.type"},
+			path:      "web1.example.nginx.connections",
+			exp:       identifier{"web1.example", "nginx", "", "connections", "", "value", "gauge"},
+		},
+		{
+			name:      "first matching template wins",
+			templates: []string{"a.* .plugin.type", "a.b.* ..plugin.type"},
+			path:      "a.b.c",
+			exp:       identifier{"", "b", "", "c", "", "value", "gauge"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMapper(test.templates, db)
+			assert.Ok(t, err)
+			c := m.Map(test.path, 1, 1700000000)
+			assert.Equals(t, test.exp, identify(c))
+			assert.Equals(t, []float64{1}, c.Values)
+			assert.Equals(t, int64(1700000000), c.Time.Time().Unix())
+		})
+	}
+
+	t.Run("invalid templates", func(t *testing.T) {
+		for _, s := range []string{
+			"host.unknown",
+			"a b c d",
+			"[ host",
+			"host dstype=histogram",
+			"host foo=bar",
+			"host plugin-instance=a",
+		} {
+			_, err := ParseTemplate(s)
+			assert.Assert(t, err != nil, "expected error for template %q", s)
+		}
+	})
+}
+
+func TestDecodePlaintext(t *testing.T) {
+	m, err := NewMapper(nil, nil)
+	assert.Ok(t, err)
+
+	records, err := m.DecodePlaintext([]byte("host1.cpu-0.cpu-user 42.5 1700000000\n\nhost1.cpu-1.cpu-user nan -1\r\nbroken\nhost1.cpu-2.cpu-user x 1700000000\n"))
+	assert.Equals(t, 2, len(records))
+	assert.Equals(t, identifier{"host1", "cpu", "0", "cpu", "user", "value", "gauge"}, identify(records[0]))
+	assert.Equals(t, 42.5, records[0].Values[0])
+	assert.Assert(t, records[1].Time.Time().Unix() > 1700000000, "expected current time for timestamp -1")
+
+	var verr *collectd.ValidationError
+	assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+	assert.Equals(t, ReasonMalformedGraphite, verr.Reason)
+	assert.Equals(t, 2, len(err.(interface{ Unwrap() []error }).Unwrap()))
+}
+
+func TestDecodePickle(t *testing.T) {
+	m, err := NewMapper(nil, nil)
+	assert.Ok(t, err)
+
+	// pickle.dumps of the same data points with protocols 0, 1, 2 and 4
+	pickles := map[string]string{
+		"protocol 0": "(lp0\x0a(Vhost1.cpu-0.cpu-user\x0ap1\x0a(I1700000000\x0aF42.5\x0atp2\x0atp3\x0aa(Vhost1.load.load.shortterm\x0ap4\x0a(F1700000000.5\x0aI1\x0atp5\x0atp6\x0aa(Vhost1.memory.memory-used\x0ap7\x0a(I1700000000\x0aL1099511627776L\x0atp8\x0atp9\x0aa.",
+		"protocol 1": "]q\x00((X\x14\x00\x00\x00host1.cpu-0.cpu-userq\x01(J\x00\xf1SeG@E@\x00\x00\x00\x00\x00tq\x02tq\x03(X\x19\x00\x00\x00host1.load.load.shorttermq\x04(GA\xd9T\xfc@ \x00\x00K\x01tq\x05tq\x06(X\x18\x00\x00\x00host1.memory.memory-usedq\x07(J\x00\xf1SeL1099511627776L\x0atq\x08tq\x09e.",
+		"protocol 2": "\x80\x02]q\x00(X\x14\x00\x00\x00host1.cpu-0.cpu-userq\x01J\x00\xf1SeG@E@\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x19\x00\x00\x00host1.load.load.shorttermq\x04GA\xd9T\xfc@ \x00\x00K\x01\x86q\x05\x86q\x06X\x18\x00\x00\x00host1.memory.memory-usedq\x07J\x00\xf1Se\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x08\x86q\x09e.",
+		"protocol 4": "\x80\x04\x95\x85\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x14host1.cpu-0.cpu-user\x94J\x00\xf1SeG@E@\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x19host1.load.load.shortterm\x94GA\xd9T\xfc@ \x00\x00K\x01\x86\x94\x86\x94\x8c\x18host1.memory.memory-used\x94J\x00\xf1Se\x8a\x06\x00\x00\x00\x00\x00\x01\x86\x94\x86\x94e.",
+	}
+	for name, p := range pickles {
+		t.Run(name, func(t *testing.T) {
+			records, err := m.DecodePickle([]byte(p))
+			assert.Ok(t, err)
+			assert.Equals(t, 3, len(records))
+			assert.Equals(t, identifier{"host1", "cpu", "0", "cpu", "user", "value", "gauge"}, identify(records[0]))
+			assert.Equals(t, 42.5, records[0].Values[0])
+			assert.Equals(t, int64(1700000000), records[0].Time.Time().Unix())
+			assert.Equals(t, identifier{"host1", "load", "", "load", "", "shortterm", "gauge"}, identify(records[1]))
+			assert.Equals(t, 1.0, records[1].Values[0])
+			assert.Equals(t, 1099511627776.0, records[2].Values[0])
+		})
+	}
+
+	t.Run("rejects malformed pickles", func(t *testing.T) {
+		for _, p := range []string{
+			"",
+			"]",
+			"cos\nsystem\n(S'true'\ntR.",
+			"\x80\x02K\x01.",
+			"\x80\x02](K\x01e.",
+		} {
+			_, err := m.DecodePickle([]byte(p))
+			var verr *collectd.ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error for %q, got %v", p, err)
+			assert.Equals(t, ReasonMalformedPickle, verr.Reason)
+		}
+	})
+
+	t.Run("decodes negative longs", func(t *testing.T) {
+		assert.Equals(t, -1.0, decodeLong([]byte{0xff}))
+		assert.Equals(t, -256.0, decodeLong([]byte{0x00, 0xff}))
+		assert.Equals(t, 255.0, decodeLong([]byte{0xff, 0x00}))
+	})
+}
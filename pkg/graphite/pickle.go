@@ -0,0 +1,418 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// pickle opcodes of protocols 0 to 4 needed for lists of tuples of strings
+// and numbers. Opcodes building arbitrary objects, like GLOBAL and REDUCE,
+// are rejected
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opFloat          = 'F'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opLong           = 'L'
+	opBinInt2        = 'M'
+	opNone           = 'N'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opAppend         = 'a'
+	opBinFloat       = 'G'
+	opAppends        = 'e'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opList           = 'l'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opEmptyList      = ']'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opLong4          = 0x8b
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+// pickleList mutable python list, shared through the memo
+type pickleList struct {
+	items []interface{}
+}
+
+// mark marks the start of list or tuple items on the stack
+type mark struct{}
+
+// unpickler decodes python pickles into string, float64, nil, bool,
+// *pickleList and []interface{} for tuples. Integers are converted to float64
+type unpickler struct {
+	buf   []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+func unpickle(b []byte) (interface{}, error) {
+	u := &unpickler{buf: b, memo: make(map[int]interface{})}
+	return u.load()
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opStop:
+			if len(u.stack) != 1 {
+				return nil, errors.New("stack not empty at STOP")
+			}
+			return u.stack[0], nil
+		case opProto:
+			if _, err = u.read(1); err != nil {
+				return nil, err
+			}
+		case opFrame:
+			if _, err = u.read(8); err != nil {
+				return nil, err
+			}
+		case opMark:
+			u.push(mark{})
+		case opPop:
+			_, err = u.pop()
+		case opPopMark:
+			_, err = u.popMark()
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(true)
+		case opNewFalse:
+			u.push(false)
+		case opInt:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				// protocol 0 booleans
+				switch string(line) {
+				case "00":
+					u.push(false)
+				case "01":
+					u.push(true)
+				default:
+					err = u.pushInt(string(line))
+				}
+			}
+		case opLong:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				err = u.pushInt(string(bytes.TrimSuffix(line, []byte("L"))))
+			}
+		case opBinInt:
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				u.push(float64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case opBinInt1:
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				u.push(float64(b[0]))
+			}
+		case opBinInt2:
+			var b []byte
+			if b, err = u.read(2); err == nil {
+				u.push(float64(binary.LittleEndian.Uint16(b)))
+			}
+		case opLong1, opLong4:
+			var n int
+			if n, err = u.readLength(op == opLong4); err == nil {
+				var b []byte
+				if b, err = u.read(n); err == nil {
+					u.push(decodeLong(b))
+				}
+			}
+		case opFloat:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				var f float64
+				if f, err = strconv.ParseFloat(string(line), 64); err == nil {
+					u.push(f)
+				}
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case opString:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				var s string
+				if s, err = strconv.Unquote(pythonQuoted(line)); err == nil {
+					u.push(s)
+				}
+			}
+		case opUnicode:
+			var line []byte
+			if line, err = u.readLine(); err == nil {
+				u.push(string(line))
+			}
+		case opShortBinString, opShortBinBytes, opShortBinUni:
+			err = u.pushString(1)
+		case opBinString, opBinBytes, opBinUnicode:
+			err = u.pushString(4)
+		case opBinUnicode8:
+			err = u.pushString(8)
+		case opEmptyList:
+			u.push(&pickleList{})
+		case opList:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{items: items})
+			}
+		case opAppend:
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTop(v)
+			}
+		case opAppends:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTop(items...)
+			}
+		case opEmptyTuple:
+			u.push([]interface{}{})
+		case opTuple:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(u.stack) < n {
+				return nil, errors.New("stack underflow")
+			}
+			items := append([]interface{}(nil), u.stack[len(u.stack)-n:]...)
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(items)
+		case opPut, opBinPut, opLongBinPut, opMemoize:
+			var idx int
+			if idx, err = u.readMemoIndex(op); err == nil {
+				if len(u.stack) == 0 {
+					return nil, errors.New("stack underflow")
+				}
+				u.memo[idx] = u.stack[len(u.stack)-1]
+			}
+		case opGet, opBinGet, opLongBinGet:
+			var idx int
+			if idx, err = u.readMemoIndex(op); err == nil {
+				v, found := u.memo[idx]
+				if !found {
+					return nil, fmt.Errorf("memo key %d not found", idx)
+				}
+				u.push(v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x at offset %d", op, u.pos-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark pops the items above the topmost mark and the mark
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(mark); ok {
+			items := append([]interface{}(nil), u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("mark not found")
+}
+
+func (u *unpickler) appendTop(items ...interface{}) error {
+	if len(u.stack) == 0 {
+		return errors.New("stack underflow")
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return fmt.Errorf("append to %T", u.stack[len(u.stack)-1])
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) pushInt(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	u.push(float64(n))
+	return nil
+}
+
+// pushString pushes a string prefixed by its little endian length of size bytes
+func (u *unpickler) pushString(size int) error {
+	b, err := u.read(size)
+	if err != nil {
+		return err
+	}
+	var n uint64
+	switch size {
+	case 1:
+		n = uint64(b[0])
+	case 4:
+		n = uint64(binary.LittleEndian.Uint32(b))
+	default:
+		n = binary.LittleEndian.Uint64(b)
+	}
+	if n > uint64(len(u.buf)-u.pos) {
+		return errors.New("string exceeds pickle")
+	}
+	if b, err = u.read(int(n)); err != nil {
+		return err
+	}
+	if !utf8.Valid(b) {
+		return errors.New("invalid UTF-8 in string")
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) readMemoIndex(op byte) (int, error) {
+	switch op {
+	case opMemoize:
+		return len(u.memo), nil
+	case opBinPut, opBinGet:
+		b, err := u.read(1)
+		if err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	case opLongBinPut, opLongBinGet:
+		b, err := u.read(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.LittleEndian.Uint32(b)), nil
+	}
+	line, err := u.readLine()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(line))
+}
+
+// readLength reads the 1 or 4 byte length of LONG1 and LONG4
+func (u *unpickler) readLength(long bool) (int, error) {
+	if !long {
+		b, err := u.read(1)
+		if err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	}
+	b, err := u.read(4)
+	if err != nil {
+		return 0, err
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(n) > uint64(len(u.buf)-u.pos) {
+		return 0, errors.New("long exceeds pickle")
+	}
+	return int(n), nil
+}
+
+func (u *unpickler) readByte() (byte, error) {
+	b, err := u.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n > len(u.buf)-u.pos {
+		return nil, errors.New("unexpected end of pickle")
+	}
+	b := u.buf[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() ([]byte, error) {
+	i := bytes.IndexByte(u.buf[u.pos:], '\n')
+	if i < 0 {
+		return nil, errors.New("unexpected end of pickle")
+	}
+	line := u.buf[u.pos : u.pos+i]
+	u.pos += i + 1
+	return line, nil
+}
+
+// decodeLong decodes little endian two's complement integer b
+func decodeLong(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	be := make([]byte, len(b))
+	for i, c := range b {
+		be[len(b)-1-i] = c
+	}
+	n := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f
+}
+
+// pythonQuoted converts python repr of a protocol 0 string to a Go quoted string
+func pythonQuoted(repr []byte) string {
+	if len(repr) >= 2 && repr[0] == '\'' && repr[len(repr)-1] == '\'' {
+		inner := bytes.ReplaceAll(repr[1:len(repr)-1], []byte(`\'`), []byte(`'`))
+		inner = bytes.ReplaceAll(inner, []byte(`"`), []byte(`\"`))
+		return `"` + string(inner) + `"`
+	}
+	return string(repr)
+}
@@ -0,0 +1,251 @@
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"collectd.org/cdtime"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+// DefaultTemplate layout of collectd write_graphite without prefix, used for
+// paths no configured template matches
+const DefaultTemplate = "host.plugin-instance.type-instance.dsname"
+
+// fields of a collectd identifier a path node maps to
+const (
+	fieldSkip = iota
+	fieldHost
+	fieldPlugin
+	fieldPluginInstance
+	fieldType
+	fieldTypeInstance
+	fieldDsname
+	// plugin[-plugin_instance] and type[-type_instance] in one node
+	fieldPluginCompound
+	fieldTypeCompound
+	numFields
+)
+
+var fieldNames = map[string]int{
+	"":                fieldSkip,
+	"host":            fieldHost,
+	"plugin":          fieldPlugin,
+	"plugin_instance": fieldPluginInstance,
+	"type":            fieldType,
+	"type_instance":   fieldTypeInstance,
+	"dsname":          fieldDsname,
+	"plugin-instance": fieldPluginCompound,
+	"type-instance":   fieldTypeCompound,
+}
+
+// Template maps the nodes of dotted graphite paths matching its filter onto
+// collectd fields:
+//
+//	[filter] template [field=value,...]
+//
+// The filter matches paths by node, each node being a glob, and may be
+// omitted to match all paths. Template nodes name the field the path node at
+// the same position is assigned to, host, plugin, plugin_instance, type,
+// type_instance or dsname, or plugin-instance and type-instance for nodes
+// split at the first '-' like in collectd identifiers. Empty template nodes
+// skip path nodes, nodes assigned to the same field are joined with '.' and a
+// trailing '*' assigns all remaining nodes to the last field. The optional
+// field=value pairs set fields the path leaves empty and dstype, gauge by
+// default
+//
+//	servers.*.app.* .host..plugin.type_instance* type=requests,dstype=derive
+type Template struct {
+	filter []string
+	fields []int
+	greedy bool
+	static [numFields]string
+	dstype string
+}
+
+// ParseTemplate parses template definition s
+func ParseTemplate(s string) (*Template, error) {
+	parts := strings.Fields(s)
+	var filter, layout, static string
+	switch len(parts) {
+	case 1:
+		layout = parts[0]
+	case 2:
+		if strings.Contains(parts[1], "=") {
+			layout, static = parts[0], parts[1]
+		} else {
+			filter, layout = parts[0], parts[1]
+		}
+	case 3:
+		filter, layout, static = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid template %q, expected [filter] template [field=value,...]", s)
+	}
+
+	t := &Template{}
+	if filter != "" {
+		t.filter = strings.Split(filter, ".")
+		for _, node := range t.filter {
+			if _, err := path.Match(node, ""); err != nil {
+				return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+			}
+		}
+	}
+	if strings.HasSuffix(layout, "*") {
+		t.greedy = true
+		layout = layout[:len(layout)-1]
+	}
+	for _, name := range strings.Split(layout, ".") {
+		field, found := fieldNames[name]
+		if !found {
+			return nil, fmt.Errorf("invalid template %q: unknown field %q", layout, name)
+		}
+		t.fields = append(t.fields, field)
+	}
+	if static != "" {
+		for _, pair := range strings.Split(static, ",") {
+			eq := strings.IndexByte(pair, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("invalid template field %q, expected field=value", pair)
+			}
+			name, value := pair[:eq], pair[eq+1:]
+			if name == "dstype" {
+				switch value {
+				case "gauge", "counter", "derive", "absolute":
+					t.dstype = value
+					continue
+				}
+				return nil, fmt.Errorf("invalid dstype %q", value)
+			}
+			field, found := fieldNames[name]
+			if !found || field == fieldSkip || field >= fieldPluginCompound {
+				return nil, fmt.Errorf("invalid template field %q", name)
+			}
+			t.static[field] = value
+		}
+	}
+	return t, nil
+}
+
+// matches whether nodes of a path match the filter of t
+func (t *Template) matches(nodes []string) bool {
+	if len(nodes) < len(t.filter) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if ok, _ := path.Match(pattern, nodes[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply assigns nodes to the fields of c
+func (t *Template) apply(nodes []string, c *collectd.Collectd) string {
+	var values [numFields]string
+	for i, node := range nodes {
+		field := fieldSkip
+		switch {
+		case i < len(t.fields):
+			field = t.fields[i]
+		case t.greedy:
+			field = t.fields[len(t.fields)-1]
+		}
+		if field == fieldSkip {
+			continue
+		}
+		if values[field] != "" {
+			values[field] += "."
+		}
+		values[field] += node
+	}
+	split := func(compound string, main, instance int) {
+		if compound == "" {
+			return
+		}
+		if i := strings.IndexByte(compound, '-'); i >= 0 {
+			values[main], values[instance] = compound[:i], compound[i+1:]
+		} else {
+			values[main] = compound
+		}
+	}
+	split(values[fieldPluginCompound], fieldPlugin, fieldPluginInstance)
+	split(values[fieldTypeCompound], fieldType, fieldTypeInstance)
+	for field, value := range t.static {
+		if values[field] == "" {
+			values[field] = value
+		}
+	}
+
+	c.Host = values[fieldHost]
+	c.Plugin = values[fieldPlugin]
+	c.PluginInstance = values[fieldPluginInstance]
+	c.Type = values[fieldType]
+	c.TypeInstance = values[fieldTypeInstance]
+	return values[fieldDsname]
+}
+
+// Mapper maps graphite paths to collectd records by the first matching template
+type Mapper struct {
+	templates []*Template
+	typesDB   *collectd.TypesDB
+}
+
+// NewMapper returns Mapper trying templates in the given order, followed by
+// DefaultTemplate. Data source types of collectd types are looked up in db,
+// which may be nil
+func NewMapper(templates []string, db *collectd.TypesDB) (*Mapper, error) {
+	m := &Mapper{typesDB: db}
+	for _, s := range append(templates, DefaultTemplate) {
+		t, err := ParseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		m.templates = append(m.templates, t)
+	}
+	return m, nil
+}
+
+// Map returns collectd record of a single graphite data point. timestamp is
+// in seconds, the current time is used when it is not positive
+func (m *Mapper) Map(metricPath string, value float64, timestamp float64) collectd.Collectd {
+	nodes := strings.Split(metricPath, ".")
+	t := m.templates[len(m.templates)-1]
+	for _, candidate := range m.templates {
+		if candidate.matches(nodes) {
+			t = candidate
+			break
+		}
+	}
+
+	c := collectd.Collectd{Values: []float64{value}}
+	dsname := t.apply(nodes, &c)
+
+	// the data source of the collectd type if known, template settings otherwise
+	dstype := t.dstype
+	if sources, found := m.typesDB.Get(c.Type); found {
+		for _, ds := range sources {
+			if ds.Name == dsname || (dsname == "" && len(sources) == 1) {
+				dsname, dstype = ds.Name, ds.Type
+				break
+			}
+		}
+	}
+	if dsname == "" {
+		dsname = "value"
+	}
+	if dstype == "" {
+		dstype = "gauge"
+	}
+	c.Dsnames = []string{dsname}
+	c.Dstypes = []string{dstype}
+
+	if timestamp > 0 {
+		c.Time = collectd.TimeFromSeconds(timestamp)
+	} else {
+		c.Time = cdtime.New(time.Now())
+	}
+	return c
+}
@@ -0,0 +1,64 @@
+package graphiteserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/graphite"
+	"github.com/infrawatch/sg-core/pkg/inetserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/streamserver"
+)
+
+// Config of a graphite listener
+type Config struct {
+	// Network "tcp" or "udp"
+	Network string
+	Address string
+	// Pickle receives the pickle protocol instead of plaintext, tcp only
+	Pickle bool
+	// MaxMessageSize and IdleTimeout of tcp connections, see streamserver.Config
+	MaxMessageSize int
+	IdleTimeout    time.Duration
+}
+
+// Listen receives graphite plaintext lines or pickle messages on
+// cfg.Address, maps them to collectd records with mapper and feeds them to
+// pipeline. promIntf and pipeline may be shared with other listeners
+func Listen(ctx context.Context, cfg Config, mapper *graphite.Mapper, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, pipeline *cdmetrics.Pipeline, printStats bool, logger logging.Logger) error {
+	decode := mapper.DecodePlaintext
+	if cfg.Pickle {
+		decode = mapper.DecodePickle
+	}
+	process := func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+		start := time.Now()
+		records, err := decode(msg)
+		lm.ObserveParseDuration(time.Since(start))
+		return pipeline.ProcessRecords(msg, records, err, lm)
+	}
+
+	switch cfg.Network {
+	case "tcp":
+		framing := streamserver.FramingNewline
+		if cfg.Pickle {
+			// pickle messages are prefixed by their 4-byte big endian length
+			framing = streamserver.FramingLength
+		}
+		return streamserver.Listen(ctx, streamserver.Config{
+			Network:        "tcp",
+			Address:        cfg.Address,
+			Framing:        framing,
+			MaxMessageSize: cfg.MaxMessageSize,
+			IdleTimeout:    cfg.IdleTimeout,
+		}, process, pub, promIntf, printStats, logger)
+	case "udp":
+		if cfg.Pickle {
+			return fmt.Errorf("pickle protocol is only supported over tcp")
+		}
+		return inetserver.Listen(ctx, cfg.Address, process, pub, promIntf, printStats, logger)
+	}
+	return fmt.Errorf("unknown network %q, expected tcp or udp", cfg.Network)
+}
@@ -0,0 +1,112 @@
+package graphiteserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/graphite"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pickle.dumps([("host1.cpu-0.cpu-user", (1700000000, 42.5))], protocol=2)
+const pickled = "\x80\x02]q\x00X\x14\x00\x00\x00host1.cpu-0.cpu-userq\x01J\x00\xf1SeG@E@\x00\x00\x00\x00\x00\x86q\x02\x86q\x03a."
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    Config
+		msg    []byte
+		series int
+	}{
+		{
+			name:   "plaintext over tcp",
+			cfg:    Config{Network: "tcp"},
+			msg:    []byte("host1.cpu-0.cpu-user 1 1700000000\nhost1.cpu-1.cpu-user 2 1700000000\nbroken\n"),
+			series: 2,
+		},
+		{
+			name:   "plaintext over udp",
+			cfg:    Config{Network: "udp"},
+			msg:    []byte("host1.cpu-0.cpu-user 1 1700000000\nhost1.cpu-1.cpu-user 2 1700000000\nbroken\n"),
+			series: 2,
+		},
+		{
+			name:   "pickle over tcp",
+			cfg:    Config{Network: "tcp", Pickle: true},
+			msg:    append(binary.BigEndian.AppendUint32(nil, uint32(len(pickled))), pickled...),
+			series: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := logging.NewNopLogger()
+			promIntf := cdmetrics.NewPromIntf()
+			allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+			pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+			mapper, err := graphite.NewMapper(nil, nil)
+			assert.Ok(t, err)
+
+			// find a free port
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			assert.Ok(t, err)
+			test.cfg.Address = pc.LocalAddr().String()
+			pc.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- Listen(ctx, test.cfg, mapper, nil, promIntf, pipeline, false, logger)
+			}()
+
+			var conn net.Conn
+			for i := 0; i < 50; i++ {
+				if conn, err = net.Dial(test.cfg.Network, test.cfg.Address); err == nil {
+					break
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+			assert.Ok(t, err)
+			defer conn.Close()
+
+			// datagrams sent before the listener is up are lost, writes may
+			// fail with connection refused until then
+			lm := promIntf.Listener(test.cfg.Address, test.cfg.Network)
+			for i := 0; i < 50 && lm.GetTotalMetricsReceived() == 0; i++ {
+				_, _ = conn.Write(test.msg)
+				time.Sleep(time.Millisecond * 20)
+			}
+			assert.Assert(t, lm.GetTotalMetricsReceived() >= uint64(test.series), "received %d metrics", lm.GetTotalMetricsReceived())
+
+			registry := prometheus.NewRegistry()
+			assert.Ok(t, registry.Register(allMetrics))
+			families, err := registry.Gather()
+			assert.Ok(t, err)
+			found := false
+			for _, family := range families {
+				if family.GetName() == "collectd_cpu" {
+					found = true
+					assert.Equals(t, test.series, len(family.GetMetric()))
+				}
+			}
+			assert.Assert(t, found, "collectd_cpu not exported")
+
+			cancel()
+			assert.Equals(t, context.Canceled, <-done)
+		})
+	}
+
+	t.Run("rejects pickle over udp", func(t *testing.T) {
+		logger := logging.NewNopLogger()
+		mapper, err := graphite.NewMapper(nil, nil)
+		assert.Ok(t, err)
+		err = Listen(context.Background(), Config{Network: "udp", Pickle: true}, mapper, nil, cdmetrics.NewPromIntf(), nil, false, logger)
+		assert.Assert(t, err != nil, "expected error")
+	})
+}
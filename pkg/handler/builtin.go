@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/ceilometer"
+	"github.com/infrawatch/sg-core/pkg/graphite"
+	"github.com/infrawatch/sg-core/pkg/influx"
+	"github.com/infrawatch/sg-core/pkg/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectorHandler Func with collectors
+type collectorHandler struct {
+	Func
+	collectors []prometheus.Collector
+}
+
+// Collectors implements Handler
+func (h *collectorHandler) Collectors() []prometheus.Collector {
+	return h.collectors
+}
+
+func mustRegister(format string, factory Factory) {
+	if err := Register(format, factory); err != nil {
+		panic(err)
+	}
+}
+
+// built-in formats, storing into the pipeline of the environment unless
+// they export their own collectors
+func init() {
+	// collectd JSON or PUTVAL
+	mustRegister("collectd", func(env Env) (Handler, error) {
+		return Func(env.Pipeline.Process), nil
+	})
+	mustRegister("ceilometer", func(env Env) (Handler, error) {
+		return Func(ceilometer.ProcessFunc(env.Pipeline, env.StaleTime)), nil
+	})
+	// InfluxDB line protocol with nanosecond timestamps
+	mustRegister("influx", func(env Env) (Handler, error) {
+		return Func(influx.ProcessFunc(env.Pipeline, time.Nanosecond, env.StaleTime)), nil
+	})
+	// graphite plaintext mapped with the default template
+	mustRegister("graphite", func(env Env) (Handler, error) {
+		mapper, err := graphite.NewMapper(nil, env.Pipeline.TypesDB)
+		if err != nil {
+			return nil, err
+		}
+		return Func(func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+			start := time.Now()
+			records, err := mapper.DecodePlaintext(msg)
+			lm.ObserveParseDuration(time.Since(start))
+			return env.Pipeline.ProcessRecords(msg, records, err, lm)
+		}), nil
+	})
+	// statsd flushed every statsd.DefaultFlushInterval until env.Context is done
+	mustRegister("statsd", func(env Env) (Handler, error) {
+		if env.Context == nil {
+			return nil, fmt.Errorf("context is required to flush samples")
+		}
+		exporter := statsd.NewExporter(env.Cache, env.Logger)
+		go func() {
+			_ = exporter.Run(env.Context, statsd.DefaultFlushInterval)
+		}()
+		return &collectorHandler{Func: exporter.Process, collectors: []prometheus.Collector{exporter}}, nil
+	})
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handler handles the messages of a format received by a listener. Listeners
+// pass Handle as their process function, so new formats need no changes to
+// the listeners. Concurrent
+type Handler interface {
+	// Handle decodes msg and stores or forwards its contents, accounting to
+	// the metrics lm of the listener msg was received by. Errors of rejected
+	// contents are returned, cdmetrics.ErrEndOfStream stops the listener
+	Handle(msg []byte, lm *cdmetrics.ListenerMetrics) error
+	// Collectors of the handler to register, series stored in the shared
+	// metric store are exported without
+	Collectors() []prometheus.Collector
+}
+
+// Env dependencies handlers are created with
+type Env struct {
+	// Context cancelled on shutdown, stops background work of handlers
+	Context  context.Context
+	Pipeline *cdmetrics.Pipeline
+	Cache    *cacheutil.CacheServer
+	Logger   logging.Logger
+	// StaleTime seconds after which series stored with
+	// Pipeline.ProcessSeries expire without updates, cdmetrics.DefaultStaleTime
+	// when 0
+	StaleTime float64
+}
+
+// Factory creates the handler of a format
+type Factory func(env Env) (Handler, error)
+
+// Func adapts a process function to Handler, without collectors of its own
+type Func func(msg []byte, lm *cdmetrics.ListenerMetrics) error
+
+// Handle implements Handler
+func (f Func) Handle(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+	return f(msg, lm)
+}
+
+// Collectors implements Handler
+func (f Func) Collectors() []prometheus.Collector {
+	return nil
+}
+
+var (
+	mu sync.RWMutex
+	// map[format]
+	factories = make(map[string]Factory)
+)
+
+// Register registers factory of handlers of format. Formats can be
+// registered once
+func Register(format string, factory Factory) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if format == "" || factory == nil {
+		return fmt.Errorf("format name and factory are required")
+	}
+	if _, found := factories[format]; found {
+		return fmt.Errorf("format %q is already registered", format)
+	}
+	factories[format] = factory
+	return nil
+}
+
+// Formats returns the sorted names of registered formats
+func Formats() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	formats := make([]string, 0, len(factories))
+	for format := range factories {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// New creates a handler of format with env
+func New(format string, env Env) (Handler, error) {
+	mu.RLock()
+	factory := factories[format]
+	mu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(Formats(), ", "))
+	}
+	h, err := factory(env)
+	if err != nil {
+		return nil, fmt.Errorf("format %s: %w", format, err)
+	}
+	return h, nil
+}
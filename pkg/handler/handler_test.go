@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newEnv(ctx context.Context) (Env, *cdmetrics.CDMetrics) {
+	logger := logging.NewNopLogger()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	cache := cacheutil.NewCacheServer(logger)
+	return Env{
+		Context:  ctx,
+		Pipeline: cdmetrics.NewPipeline(allMetrics, cache, nil, logger),
+		Cache:    cache,
+		Logger:   logger,
+	}, allMetrics
+}
+
+func TestRegister(t *testing.T) {
+	assert.Equals(t, []string{"ceilometer", "collectd", "graphite", "influx", "statsd"}, Formats())
+
+	assert.Assert(t, Register("collectd", func(env Env) (Handler, error) { return nil, nil }) != nil, "expected duplicate format")
+	assert.Assert(t, Register("", func(env Env) (Handler, error) { return nil, nil }) != nil, "expected missing format name")
+	assert.Assert(t, Register("nil", nil) != nil, "expected missing factory")
+
+	env, _ := newEnv(context.Background())
+	_, err := New("unknown", env)
+	assert.Assert(t, err != nil, "expected unknown format")
+
+	// custom formats are created like the built-in ones
+	received := 0
+	assert.Ok(t, Register("test", func(env Env) (Handler, error) {
+		return Func(func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+			received++
+			return nil
+		}), nil
+	}))
+	h, err := New("test", env)
+	assert.Ok(t, err)
+	assert.Ok(t, h.Handle([]byte("msg"), nil))
+	assert.Equals(t, 1, received)
+	assert.Equals(t, 0, len(h.Collectors()))
+}
+
+func TestBuiltin(t *testing.T) {
+	tests := []struct {
+		format string
+		msg    []byte
+		metric string
+	}{
+		{"collectd", collectd.GenCPUMetric(10, "h", 1), "collectd_cpu_total"},
+		{"ceilometer", []byte(`{"payload":[{"counter_name":"cpu","counter_type":"cumulative","counter_volume":1,"resource_id":"vm"}]}`), "ceilometer_cpu_total"},
+		{"influx", []byte("cpu,host=h usage_idle=1"), "cpu_usage_idle"},
+		{"graphite", []byte("h.cpu-0.cpu-user 1 1700000000"), "collectd_cpu"},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			env, allMetrics := newEnv(context.Background())
+			h, err := New(test.format, env)
+			assert.Ok(t, err)
+			lm := cdmetrics.NewPromIntf().Listener("test", "unixgram")
+			assert.Ok(t, h.Handle(test.msg, lm))
+			assert.Equals(t, uint64(1), lm.GetTotalMetricsReceived())
+
+			registry := prometheus.NewRegistry()
+			assert.Ok(t, registry.Register(allMetrics))
+			families, err := registry.Gather()
+			assert.Ok(t, err)
+			found := false
+			for _, family := range families {
+				found = found || family.GetName() == test.metric
+			}
+			assert.Assert(t, found, "%s not stored", test.metric)
+		})
+	}
+
+	t.Run("decode error reasons", func(t *testing.T) {
+		reasons := strings.Join(cdmetrics.DecodeErrorReasons(), " ")
+		for _, reason := range []string{"malformed_json", "malformed_ceilometer", "malformed_influx", "malformed_graphite", "malformed_statsd"} {
+			assert.Assert(t, strings.Contains(reasons, reason), "%s not registered", reason)
+		}
+	})
+
+	t.Run("statsd", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		env, _ := newEnv(ctx)
+		h, err := New("statsd", env)
+		assert.Ok(t, err)
+		lm := cdmetrics.NewPromIntf().Listener("test", "udp")
+		assert.Ok(t, h.Handle([]byte("requests:1|c"), lm))
+		assert.Equals(t, uint64(1), lm.GetTotalMetricsReceived())
+		assert.Equals(t, 1, len(h.Collectors()))
+
+		env.Context = nil
+		_, err = New("statsd", env)
+		assert.Assert(t, err != nil, "expected missing context")
+	})
+}
@@ -0,0 +1,203 @@
+package httpserver
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+// DefaultPath URL path collectd write_http posts to
+const DefaultPath = "/collectd"
+
+// DefaultMaxBodySize bytes of a request body accepted by default
+const DefaultMaxBodySize = 4 << 20
+
+const shutdownTimeout = 5 * time.Second
+
+// Config of the write_http listener
+type Config struct {
+	Address string
+	// Path URL path accepting POSTs, DefaultPath when empty
+	Path string
+	// Username and Password enable basic authentication when Username is set
+	Username string
+	Password string
+	// CertFile and KeyFile enable TLS when both are set
+	CertFile string
+	KeyFile  string
+	// MaxBodySize bytes of a request body, DefaultMaxBodySize when 0
+	MaxBodySize int64
+}
+
+// Handler accepts POSTs, e.g. collectd write_http JSON arrays or PUTVAL
+// commands, and feeds them to process accounting to listener metrics lm.
+// Rejected payloads are answered with 400, compressed payloads process can
+// not decompress with 415. See ReadBody for the other status codes
+func Handler(cfg Config, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, lm *cdmetrics.ListenerMetrics, logger logging.Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, ok := ReadBody(cfg, rw, r, logger)
+		if !ok {
+			return
+		}
+
+		if pub != nil {
+			pub.Publish(cfg.Address+cfg.Path, body)
+		}
+
+		err := process(body, lm)
+		if err != nil && err != cdmetrics.ErrEndOfStream {
+			status := http.StatusBadRequest
+			var verr *collectd.ValidationError
+			if errors.As(err, &verr) && (verr.Reason == cdmetrics.ReasonCompressionDisabled || verr.Reason == cdmetrics.ReasonDecompress) {
+				status = http.StatusUnsupportedMediaType
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ReadBody returns the body of POST r, decompressed if gzip encoded. Other
+// methods are answered with 405, requests failing basic auth with 401,
+// bodies larger than cfg.MaxBodySize with 413 and other encodings with 415,
+// ok is false then
+func ReadBody(cfg Config, rw http.ResponseWriter, r *http.Request, logger logging.Logger) (body []byte, ok bool) {
+	maxBodySize := cfg.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if cfg.Username != "" && !authorized(r, cfg.Username, cfg.Password) {
+		logger.Warn("unauthorized request", "remote", r.RemoteAddr)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="sg-core"`)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	var reader io.Reader = http.MaxBytesReader(rw, r.Body, maxBodySize)
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		defer gz.Close()
+		// the decompressed body is limited as well
+		reader = http.MaxBytesReader(rw, gz, maxBodySize)
+	default:
+		http.Error(rw, "unsupported content encoding "+encoding, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// authorized compares basic auth credentials of r in constant time
+func authorized(r *http.Request, username, password string) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	return userOk && passOk
+}
+
+// Listen serves POSTs on cfg.Address and feeds them to process, e.g. the
+// Handle function of a handler.Handler, until ctx is cancelled. promIntf may
+// be shared with other listeners
+func Listen(ctx context.Context, cfg Config, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool, logger logging.Logger) error {
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath
+	}
+	return ListenHandler(ctx, cfg, func(cfg Config, lm *cdmetrics.ListenerMetrics) http.Handler {
+		mux := http.NewServeMux()
+		mux.Handle(cfg.Path, Handler(cfg, process, pub, lm, logger))
+		return mux
+	}, promIntf, printStats, logger)
+}
+
+// ListenHandler serves the handler returned by newHandler on cfg.Address
+// until ctx is cancelled, for formats other than collectd. newHandler is
+// passed cfg with the address listened on and the listener metrics lm of
+// cfg.Address and cfg.Path
+func ListenHandler(ctx context.Context, cfg Config, newHandler func(cfg Config, lm *cdmetrics.ListenerMetrics) http.Handler, promIntf *cdmetrics.PromIntf, printStats bool, logger logging.Logger) (err error) {
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return
+	}
+	cfg.Address = ln.Addr().String()
+	tls := cfg.CertFile != "" && cfg.KeyFile != ""
+	logger.Info("listening", "address", cfg.Address, "path", cfg.Path, "tls", tls, "auth", cfg.Username != "")
+
+	promIntfMetrics := promIntf.Listener(cfg.Address+cfg.Path, "http")
+
+	srv := &http.Server{
+		Handler:           newHandler(cfg, promIntfMetrics),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	doneChan := make(chan error, 1)
+
+	go func() {
+		if tls {
+			doneChan <- srv.ServeTLS(ln, cfg.CertFile, cfg.KeyFile)
+		} else {
+			doneChan <- srv.Serve(ln)
+		}
+	}()
+
+	rateTicker := time.NewTicker(time.Second)
+	defer rateTicker.Stop()
+	lastUpdate := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("cancelled")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			_ = srv.Shutdown(shutdownCtx)
+			cancel()
+			err = ctx.Err()
+			goto done
+		case err = <-doneChan:
+			goto done
+		case now := <-rateTicker.C:
+			metricsDelta, msgsDelta := promIntfMetrics.UpdateRates(now.Sub(lastUpdate))
+			lastUpdate = now
+			if printStats {
+				logger.Info("received", "metrics", promIntfMetrics.GetTotalMetricsReceived(), "metrics_delta", metricsDelta,
+					"msgs", promIntfMetrics.GetTotalAmqpReceived(), "msgs_delta", msgsDelta)
+			}
+		}
+	}
+done:
+	return err
+}
@@ -0,0 +1,158 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+func newPipeline(t *testing.T) (*cdmetrics.Pipeline, *cdmetrics.PromIntf) {
+	logger := logging.NewNopLogger()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+	db, err := collectd.LoadTypesDB("../collectd/testdata/types.db")
+	assert.Ok(t, err)
+	pipeline.TypesDB = db
+	return pipeline, cdmetrics.NewPromIntf()
+}
+
+func TestHandler(t *testing.T) {
+	pipeline, promIntf := newPipeline(t)
+	lm := promIntf.Listener("test", "http")
+	cfg := Config{Address: "test", Path: DefaultPath, Username: "collectd", Password: "secret", MaxBodySize: 1024}
+	srv := httptest.NewServer(Handler(cfg, pipeline.Process, nil, lm, logging.NewNopLogger()))
+	defer srv.Close()
+
+	post := func(body string, auth bool) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		assert.Ok(t, err)
+		if auth {
+			req.SetBasicAuth("collectd", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("rejects other methods", func(t *testing.T) {
+		resp, err := http.Get(srv.URL)
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("requires basic auth", func(t *testing.T) {
+		resp := post("[]", false)
+		assert.Equals(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Assert(t, resp.Header.Get("WWW-Authenticate") != "", "missing WWW-Authenticate")
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("[]"))
+		assert.Ok(t, err)
+		req.SetBasicAuth("collectd", "wrong")
+		resp, err = http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("stores JSON", func(t *testing.T) {
+		resp := post(string(collectd.GenCPUMetric(10, "localhost", 3)), true)
+		assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("stores PUTVAL", func(t *testing.T) {
+		resp := post("PUTVAL localhost/load/load interval=10 N:0.1:0.2:0.3\n", true)
+		assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equals(t, uint64(4), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("stores gzip encoded bodies", func(t *testing.T) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte("PUTVAL localhost/load/load interval=10 N:0.1:0.2:0.3\n"))
+		assert.Ok(t, err)
+		assert.Ok(t, gz.Close())
+		req, err := http.NewRequest(http.MethodPost, srv.URL, &buf)
+		assert.Ok(t, err)
+		req.SetBasicAuth("collectd", "secret")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equals(t, uint64(5), lm.GetTotalMetricsReceived())
+
+		req, err = http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("[]"))
+		assert.Ok(t, err)
+		req.SetBasicAuth("collectd", "secret")
+		req.Header.Set("Content-Encoding", "br")
+		resp, err = http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+
+	t.Run("rejects malformed payloads", func(t *testing.T) {
+		errors := lm.GetTotalDecodeErrors()
+		resp := post("not json", true)
+		assert.Equals(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equals(t, errors+1, lm.GetTotalDecodeErrors())
+	})
+
+	t.Run("rejects compressed payloads", func(t *testing.T) {
+		resp := post("\x28\xb5\x2f\xfd\x00", true)
+		assert.Equals(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+
+	t.Run("rejects large bodies", func(t *testing.T) {
+		resp := post(strings.Repeat(" ", 2048), true)
+		assert.Equals(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+}
+
+func TestListen(t *testing.T) {
+	pipeline, promIntf := newPipeline(t)
+
+	// find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	address := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Listen(ctx, Config{Address: address}, pipeline.Process, nil, promIntf, false, logging.NewNopLogger())
+	}()
+
+	url := fmt.Sprintf("http://%s%s", address, DefaultPath)
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Post(url, "application/json", strings.NewReader(string(collectd.GenCPUMetric(10, "localhost", 2)))); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.Ok(t, err)
+	resp.Body.Close()
+	assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equals(t, uint64(2), promIntf.Listener(address+DefaultPath, "http").GetTotalMetricsReceived())
+
+	cancel()
+	assert.Equals(t, context.Canceled, <-done)
+}
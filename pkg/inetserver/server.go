@@ -1,52 +1,38 @@
 package inetserver
 
 import (
-	"bufio"
 	"context"
-	"fmt"
 	"net"
 	"time"
 
-	"github.com/infrawatch/sg-core/pkg/collectd"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
 )
 
-const maxBufferSize = 1024
-
-var msgBuffer []byte
-
-var (
-	msgRecvd = prometheus.NewCounter(prometheus.CounterOpts{
-		Name:        "msg_rcv_total",
-		Help:        "Number of json messages received.",
-		ConstLabels: prometheus.Labels{"version": "1234"},
-	})
-)
-
-func init() {
-	msgBuffer = make([]byte, maxBufferSize)
-}
-
-// Listen ...
-func Listen(ctx context.Context, address string, w *bufio.Writer) (err error) {
-	prometheus.MustRegister(msgRecvd)
+// maxDatagramSize max size of received UDP datagrams
+const maxDatagramSize = 65536
 
+// Listen receives datagrams of up to 64 KiB on UDP address and feeds them
+// to process, e.g. the Handle function of a handler.Handler. promIntf may be
+// shared with other listeners
+func Listen(ctx context.Context, address string, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool, logger logging.Logger) (err error) {
 	pc, err := net.ListenPacket("udp", address)
 	if err != nil {
 		return
 	}
 
 	myAddr := pc.LocalAddr()
-	fmt.Printf("Listening on %s\n", myAddr)
+	logger.Info("listening", "address", myAddr)
 
 	defer pc.Close()
 
-	doneChan := make(chan error, 1)
+	promIntfMetrics := promIntf.Listener(myAddr.String(), "udp")
 
-	count := 0
+	doneChan := make(chan error, 1)
 
 	go func() {
-		cd := new(collectd.Collectd)
+		msgBuffer := make([]byte, maxDatagramSize)
 
 		for {
 			n, _, err := pc.ReadFrom(msgBuffer)
@@ -54,38 +40,36 @@ func Listen(ctx context.Context, address string, w *bufio.Writer) (err error) {
 				doneChan <- err
 				return
 			}
-			msgRecvd.Inc()
 
-			if w != nil {
-				if _, err := w.WriteString(string(append(msgBuffer[:n], "\n"...))); err != nil {
-					panic(err)
-				}
+			if pub != nil {
+				pub.Publish(myAddr.String(), msgBuffer[:n])
 			}
 
-			metric, err := cd.ParseInputByte(msgBuffer)
-			if err != nil {
-				fmt.Printf("Error parsing JSON!\n")
-				doneChan <- err
-			} else if (*metric)[0].Interval < 0.0 {
-				doneChan <- err
+			if err := process(msgBuffer[:n], promIntfMetrics); err == cdmetrics.ErrEndOfStream {
+				doneChan <- nil
 			}
-			count += len(*metric)
 		}
 	}()
 
-	lastCount := 0
+	rateTicker := time.NewTicker(time.Second)
+	defer rateTicker.Stop()
+	lastUpdate := time.Now()
+
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("cancelled")
+			logger.Info("cancelled")
 			err = ctx.Err()
 			goto done
 		case err = <-doneChan:
 			goto done
-		default:
-			time.Sleep(time.Second * 1)
-			fmt.Printf("Rcv'd: %d(%d)\n", count, count-lastCount)
-			lastCount = count
+		case now := <-rateTicker.C:
+			metricsDelta, msgsDelta := promIntfMetrics.UpdateRates(now.Sub(lastUpdate))
+			lastUpdate = now
+			if printStats {
+				logger.Info("received", "metrics", promIntfMetrics.GetTotalMetricsReceived(), "metrics_delta", metricsDelta,
+					"msgs", promIntfMetrics.GetTotalAmqpReceived(), "msgs_delta", msgsDelta)
+			}
 		}
 	}
 done:
@@ -0,0 +1,351 @@
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReasonMalformedInflux reason lines of line protocol are rejected
+const ReasonMalformedInflux = "malformed_influx"
+
+func init() {
+	cdmetrics.RegisterDecodeErrorReasons(ReasonMalformedInflux)
+}
+
+func invalid(format string, args ...interface{}) *collectd.ValidationError {
+	return &collectd.ValidationError{Reason: ReasonMalformedInflux, Err: fmt.Errorf(format, args...)}
+}
+
+// FieldType type of a field value
+type FieldType int
+
+const (
+	// Float fields, values without suffix
+	Float FieldType = iota
+	// Integer fields, values with suffix i
+	Integer
+	// Unsigned fields, values with suffix u
+	Unsigned
+	// Boolean fields, t, true, f, false in any case
+	Boolean
+	// String fields, double quoted values
+	String
+)
+
+// Tag key and value of a point
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field of a point. Value holds numeric and boolean values, booleans as 1
+// and 0, String string values
+type Field struct {
+	Key    string
+	Type   FieldType
+	Value  float64
+	String string
+}
+
+// Point line of line protocol
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	// Time zero when the line has no timestamp
+	Time time.Time
+}
+
+// ParsePrecision returns the duration of a timestamp unit of precision,
+// as in the precision parameter of InfluxDB /write. Empty precision is
+// nanoseconds
+func ParsePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q, expected ns, u, ms, s, m or h", precision)
+}
+
+// Parse appends the points of line protocol msg to points, timestamps are in
+// units of precision. Empty lines and comments are skipped, invalid lines are
+// skipped and their errors returned joined, along with the points of the valid
+// lines
+func Parse(msg []byte, precision time.Duration, points []Point) ([]Point, error) {
+	var errs []error
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		point, err := parseLine(line, precision)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		points = append(points, point)
+	}
+	return points, errors.Join(errs...)
+}
+
+// parseLine parses a line of the form
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(line []byte, precision time.Duration) (p Point, err error) {
+	end := indexUnescaped(line, ' ', false)
+	if end < 0 {
+		return p, invalid("missing fields: %q", line)
+	}
+	key, rest := line[:end], bytes.TrimLeft(line[end:], " ")
+
+	i := indexUnescaped(key, ',', false)
+	if i < 0 {
+		i = len(key)
+	}
+	p.Measurement = unescape(key[:i])
+	if p.Measurement == "" {
+		return p, invalid("missing measurement: %q", line)
+	}
+	for key = key[i:]; len(key) > 0; {
+		key = key[1:]
+		i = indexUnescaped(key, ',', false)
+		if i < 0 {
+			i = len(key)
+		}
+		k, v, ok := cut(key[:i])
+		if !ok || k == "" || v == "" {
+			return p, invalid("%s: invalid tag %q", p.Measurement, key[:i])
+		}
+		p.Tags = append(p.Tags, Tag{Key: k, Value: v})
+		key = key[i:]
+	}
+
+	end = indexUnescaped(rest, ' ', true)
+	if end < 0 {
+		end = len(rest)
+	}
+	fields, timestamp := rest[:end], bytes.TrimSpace(rest[end:])
+	for len(fields) > 0 {
+		i = indexUnescaped(fields, ',', true)
+		if i < 0 {
+			i = len(fields)
+		}
+		field, err := parseField(fields[:i])
+		if err != nil {
+			return p, invalid("%s: %v", p.Measurement, err)
+		}
+		p.Fields = append(p.Fields, field)
+		fields = fields[i:]
+		if len(fields) > 0 {
+			fields = fields[1:]
+		}
+	}
+	if len(p.Fields) == 0 {
+		return p, invalid("%s: missing fields", p.Measurement)
+	}
+
+	if len(timestamp) > 0 {
+		ts, err := strconv.ParseInt(string(timestamp), 10, 64)
+		if err != nil {
+			return p, invalid("%s: invalid timestamp %q", p.Measurement, timestamp)
+		}
+		p.Time = time.Unix(0, ts*int64(precision))
+	}
+	return p, nil
+}
+
+// parseField parses key=value of a field
+func parseField(field []byte) (f Field, err error) {
+	i := indexUnescaped(field, '=', false)
+	if i <= 0 || i == len(field)-1 {
+		return f, fmt.Errorf("invalid field %q", field)
+	}
+	f.Key = unescape(field[:i])
+	value := field[i+1:]
+
+	switch last := value[len(value)-1]; {
+	case value[0] == '"':
+		if len(value) < 2 || last != '"' {
+			return f, fmt.Errorf("%s: unterminated string %q", f.Key, value)
+		}
+		f.Type = String
+		f.String = unescapeString(value[1 : len(value)-1])
+		return f, nil
+	case last == 'i':
+		v, err := strconv.ParseInt(string(value[:len(value)-1]), 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("%s: invalid integer %q", f.Key, value)
+		}
+		f.Type, f.Value = Integer, float64(v)
+		return f, nil
+	case last == 'u':
+		v, err := strconv.ParseUint(string(value[:len(value)-1]), 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("%s: invalid unsigned integer %q", f.Key, value)
+		}
+		f.Type, f.Value = Unsigned, float64(v)
+		return f, nil
+	}
+
+	switch string(value) {
+	case "t", "T", "true", "True", "TRUE":
+		f.Type, f.Value = Boolean, 1
+		return f, nil
+	case "f", "F", "false", "False", "FALSE":
+		f.Type, f.Value = Boolean, 0
+		return f, nil
+	}
+	v, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return f, fmt.Errorf("%s: invalid float %q", f.Key, value)
+	}
+	f.Type, f.Value = Float, v
+	return f, nil
+}
+
+// indexUnescaped returns index of the first c in s not escaped by a
+// backslash and, if quoted is set, not in a double quoted string
+func indexUnescaped(s []byte, c byte, quoted bool) int {
+	inString := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inString = !inString
+		case s[i] == c && !inString:
+			return i
+		}
+	}
+	return -1
+}
+
+// cut splits and unescapes key=value at the first unescaped '='
+func cut(s []byte) (key string, value string, ok bool) {
+	i := indexUnescaped(s, '=', false)
+	if i < 0 {
+		return "", "", false
+	}
+	return unescape(s[:i]), unescape(s[i+1:]), true
+}
+
+// unescape removes backslashes escaping commas, equal signs and spaces of
+// measurements, tags and field keys
+func unescape(s []byte) string {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s)
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '=' || s[i+1] == ' ') {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// unescapeString removes backslashes escaping double quotes and backslashes of string field values
+func unescapeString(s []byte) string {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s)
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// Series returns a gauge series of each numeric and boolean field of p named
+// <measurement>_<field>, or <measurement> for fields named value, with the
+// tags of p as labels. String fields can't be exported as values and are
+// skipped. Points without timestamp are stamped with now
+func (p *Point) Series(series []cdmetrics.Series, now time.Time) []cdmetrics.Series {
+	labelNames := make([]string, len(p.Tags))
+	labelValues := make([]string, len(p.Tags))
+	host := ""
+	for i, tag := range p.Tags {
+		labelNames[i], labelValues[i] = tag.Key, tag.Value
+		if tag.Key == "host" {
+			host = tag.Value
+		}
+	}
+	ts := p.Time
+	if ts.IsZero() {
+		ts = now
+	}
+	for _, field := range p.Fields {
+		if field.Type == String {
+			continue
+		}
+		name := p.Measurement + "_" + field.Key
+		if field.Key == "value" {
+			name = p.Measurement
+		}
+		series = append(series, cdmetrics.Series{
+			Name:        name,
+			LabelNames:  labelNames,
+			LabelValues: labelValues,
+			Value:       field.Value,
+			ValueType:   prometheus.GaugeValue,
+			Time:        ts,
+			Host:        host,
+		})
+	}
+	return series
+}
+
+// Decode parses line protocol msg with timestamps in units of precision and
+// returns the series of its points, see Point.Series. Invalid lines are
+// skipped and their errors returned joined, along with the series of the
+// valid lines
+func Decode(msg []byte, precision time.Duration) ([]cdmetrics.Series, error) {
+	points, err := Parse(msg, precision, nil)
+	now := time.Now()
+	var series []cdmetrics.Series
+	for i := range points {
+		series = points[i].Series(series, now)
+	}
+	return series, err
+}
+
+// ProcessFunc returns a function decoding line protocol messages with
+// timestamps in units of precision and storing their series in pipeline,
+// accounting to listener metrics lm. Series expire after staleTime seconds
+// without points, see Pipeline.ProcessSeries
+func ProcessFunc(pipeline *cdmetrics.Pipeline, precision time.Duration, staleTime float64) func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+	return func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+		start := time.Now()
+		series, err := Decode(msg, precision)
+		lm.ObserveParseDuration(time.Since(start))
+		return pipeline.ProcessSeries(msg, series, staleTime, err, lm)
+	}
+}
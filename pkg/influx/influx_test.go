@@ -0,0 +1,94 @@
+package influx
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		exp  []Point
+	}{
+		{
+			name: "telegraf cpu",
+			line: "cpu,cpu=cpu0,host=h usage_idle=98.5,usage_user=1 1700000000000000000",
+			exp: []Point{{Measurement: "cpu", Tags: []Tag{{"cpu", "cpu0"}, {"host", "h"}},
+				Fields: []Field{{Key: "usage_idle", Value: 98.5}, {Key: "usage_user", Value: 1}},
+				Time:   time.Unix(1700000000, 0)}},
+		},
+		{
+			name: "field types",
+			line: `m i=-3i,u=4u,b=t,B=FALSE,s="a \"b\", c\\"`,
+			exp: []Point{{Measurement: "m", Fields: []Field{
+				{Key: "i", Type: Integer, Value: -3},
+				{Key: "u", Type: Unsigned, Value: 4},
+				{Key: "b", Type: Boolean, Value: 1},
+				{Key: "B", Type: Boolean, Value: 0},
+				{Key: "s", Type: String, String: `a "b", c\`},
+			}}},
+		},
+		{
+			name: "escapes",
+			line: `my\ disk,path=/a\,b\=c\ d used\ pct=1e2`,
+			exp: []Point{{Measurement: "my disk", Tags: []Tag{{"path", "/a,b=c d"}},
+				Fields: []Field{{Key: "used pct", Value: 100}}}},
+		},
+		{
+			name: "comments and empty lines",
+			line: "# comment\n\nm v=1\r\n",
+			exp:  []Point{{Measurement: "m", Fields: []Field{{Key: "v", Value: 1}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			points, err := Parse([]byte(test.line), time.Nanosecond, nil)
+			assert.Ok(t, err)
+			assert.Equals(t, test.exp, points)
+		})
+	}
+
+	t.Run("precision", func(t *testing.T) {
+		precision, err := ParsePrecision("s")
+		assert.Ok(t, err)
+		points, err := Parse([]byte("m v=1 1700000000"), precision, nil)
+		assert.Ok(t, err)
+		assert.Equals(t, time.Unix(1700000000, 0), points[0].Time)
+		_, err = ParsePrecision("d")
+		assert.Assert(t, err != nil, "expected unknown precision")
+	})
+
+	t.Run("skips invalid lines", func(t *testing.T) {
+		points, err := Parse([]byte("a v=1\nnofields\n,t=1 v=1\nb,t v=1\nc v=x\nd v=1.5i\ne s=\"open\nf v=1 ts\ng v=NaN\nh v=2"), time.Nanosecond, nil)
+		assert.Equals(t, 2, len(points))
+		assert.Equals(t, "h", points[1].Measurement)
+
+		var verr *collectd.ValidationError
+		assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+		assert.Equals(t, ReasonMalformedInflux, verr.Reason)
+		assert.Equals(t, 8, len(err.(interface{ Unwrap() []error }).Unwrap()))
+	})
+}
+
+func TestDecode(t *testing.T) {
+	series, err := Decode([]byte(`disk,host=h,path=/ used=10i,free=5u,ro=false,fs="ext4"`+"\ntemperature,host=h value=21.5 1"), time.Second)
+	assert.Ok(t, err)
+	assert.Equals(t, 4, len(series))
+	assert.Equals(t, "disk_used", series[0].Name)
+	assert.Equals(t, []string{"host", "path"}, series[0].LabelNames)
+	assert.Equals(t, []string{"h", "/"}, series[0].LabelValues)
+	assert.Equals(t, "h", series[0].Host)
+	assert.Equals(t, prometheus.GaugeValue, series[0].ValueType)
+	assert.Assert(t, !series[0].Time.IsZero(), "points without timestamp are stamped on arrival")
+	assert.Equals(t, "disk_ro", series[2].Name)
+	assert.Equals(t, 0.0, series[2].Value)
+	assert.Equals(t, "temperature", series[3].Name)
+	assert.Equals(t, 21.5, series[3].Value)
+	assert.Equals(t, time.Unix(1, 0), series[3].Time)
+}
@@ -0,0 +1,81 @@
+package influxserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/httpserver"
+	"github.com/infrawatch/sg-core/pkg/inetserver"
+	"github.com/infrawatch/sg-core/pkg/influx"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+// DefaultPath URL path of InfluxDB 1.x writes
+const DefaultPath = "/write"
+
+// Config of an InfluxDB line protocol listener
+type Config struct {
+	// Network "http" or "udp"
+	Network string
+	// HTTP options of the http listener, HTTP.Address is ignored
+	HTTP    httpserver.Config
+	Address string
+	// Precision of timestamps received over udp, http requests pass theirs
+	// in the precision parameter
+	Precision time.Duration
+	// StaleTime seconds after which series without points expire,
+	// cdmetrics.DefaultStaleTime when 0
+	StaleTime float64
+}
+
+// Handler serves InfluxDB 1.x POST /write requests at cfg.Path, DefaultPath
+// when empty, and GET /ping, feeding line protocol to pipeline accounting to
+// listener metrics lm. Series expire after staleTime seconds without points.
+// See httpserver.Handler for authentication, limits and status codes
+func Handler(cfg httpserver.Config, staleTime float64, pub *bus.Publisher, lm *cdmetrics.ListenerMetrics, pipeline *cdmetrics.Pipeline, logger logging.Logger) http.Handler {
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, func(rw http.ResponseWriter, r *http.Request) {
+		precision, err := influx.ParsePrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpserver.Handler(cfg, influx.ProcessFunc(pipeline, precision, staleTime), pub, lm, logger).ServeHTTP(rw, r)
+	})
+	// clients check the connection with /ping
+	mux.HandleFunc("/ping", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// Listen receives InfluxDB line protocol on cfg.Address, over http or udp,
+// and stores its series in pipeline. promIntf and pipeline may be shared
+// with other listeners
+func Listen(ctx context.Context, cfg Config, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, pipeline *cdmetrics.Pipeline, printStats bool, logger logging.Logger) error {
+	switch cfg.Network {
+	case "http":
+		httpCfg := cfg.HTTP
+		httpCfg.Address = cfg.Address
+		if httpCfg.Path == "" {
+			httpCfg.Path = DefaultPath
+		}
+		return httpserver.ListenHandler(ctx, httpCfg, func(httpCfg httpserver.Config, lm *cdmetrics.ListenerMetrics) http.Handler {
+			return Handler(httpCfg, cfg.StaleTime, pub, lm, pipeline, logger)
+		}, promIntf, printStats, logger)
+	case "udp":
+		precision := cfg.Precision
+		if precision == 0 {
+			precision = time.Nanosecond
+		}
+		return inetserver.Listen(ctx, cfg.Address, influx.ProcessFunc(pipeline, precision, cfg.StaleTime), pub, promIntf, printStats, logger)
+	}
+	return fmt.Errorf("unknown network %q, expected http or udp", cfg.Network)
+}
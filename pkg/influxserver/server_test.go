@@ -0,0 +1,127 @@
+package influxserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/httpserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newPipeline() (*cdmetrics.Pipeline, *prometheus.Registry) {
+	logger := logging.NewNopLogger()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	allMetrics.UseTimestamp = true
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(allMetrics)
+	return cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger), registry
+}
+
+// timestamps returns timestamps in milliseconds of the series of metric name by value of label host
+func timestamps(t *testing.T, registry *prometheus.Registry, name string) map[string]int64 {
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+	found := map[string]int64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "host" {
+					found[label.GetValue()] = m.GetTimestampMs()
+				}
+			}
+		}
+	}
+	return found
+}
+
+func TestHandler(t *testing.T) {
+	pipeline, registry := newPipeline()
+	lm := cdmetrics.NewPromIntf().Listener("test", "http")
+	srv := httptest.NewServer(Handler(httpserver.Config{}, cdmetrics.DefaultStaleTime, nil, lm, pipeline, logging.NewNopLogger()))
+	defer srv.Close()
+
+	post := func(query string, body string) int {
+		resp, err := http.Post(srv.URL+DefaultPath+query, "text/plain", strings.NewReader(body))
+		assert.Ok(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("ping", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/ping")
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("stores fields", func(t *testing.T) {
+		assert.Equals(t, http.StatusNoContent, post("?db=telegraf&precision=s", "cpu,host=a usage_idle=90 1700000000\ncpu,host=b usage_idle=80 1700000001"))
+		assert.Equals(t, map[string]int64{"a": 1700000000000, "b": 1700000001000}, timestamps(t, registry, "cpu_usage_idle"))
+		assert.Equals(t, uint64(2), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("rejects malformed lines", func(t *testing.T) {
+		assert.Equals(t, http.StatusBadRequest, post("", "mem,host=a used=1i\nbroken"))
+		assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+	})
+
+	t.Run("rejects unknown precision", func(t *testing.T) {
+		assert.Equals(t, http.StatusBadRequest, post("?precision=d", "mem,host=a used=1i"))
+	})
+}
+
+func TestListen(t *testing.T) {
+	for _, network := range []string{"http", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			logger := logging.NewNopLogger()
+			promIntf := cdmetrics.NewPromIntf()
+			pipeline, registry := newPipeline()
+
+			// find a free port
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Ok(t, err)
+			cfg := Config{Network: network, Address: ln.Addr().String(), Precision: time.Second}
+			ln.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- Listen(ctx, cfg, nil, promIntf, pipeline, false, logger)
+			}()
+
+			line := "disk,host=h,path=/ used=1 1700000000\n"
+			for i := 0; i < 50 && len(timestamps(t, registry, "disk_used")) == 0; i++ {
+				time.Sleep(time.Millisecond * 20)
+				if network == "http" {
+					resp, err := http.Post("http://"+cfg.Address+"/write?precision=s", "text/plain", strings.NewReader(line))
+					if err == nil {
+						resp.Body.Close()
+					}
+					continue
+				}
+				// datagrams sent before the listener is up are lost
+				conn, err := net.Dial("udp", cfg.Address)
+				assert.Ok(t, err)
+				_, _ = conn.Write([]byte(line))
+				conn.Close()
+			}
+			assert.Equals(t, map[string]int64{"h": 1700000000000}, timestamps(t, registry, "disk_used"))
+
+			cancel()
+			assert.Equals(t, context.Canceled, <-done)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// LevelHandler HTTP handler for changing log level at runtime. GET returns the
+// current level, PUT or POST sets the level given in the "level" query
+// parameter or in the request body when writable, they are forbidden otherwise
+func LevelHandler(l Logger, writable bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if !writable {
+				http.Error(w, "log level changes are disabled", http.StatusForbidden)
+				return
+			}
+			name := r.URL.Query().Get("level")
+			if name == "" {
+				body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				name = strings.TrimSpace(string(body))
+			}
+			level, err := ParseLevel(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.SetLevel(level)
+			l.Info("log level changed", "level", level)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, l.GetLevel())
+	})
+}
@@ -0,0 +1,276 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level logging severity
+type Level int32
+
+// available logging levels
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DEBUG || l > ERROR {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts level name to Level
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level: %s", name)
+}
+
+// Format output encoding of log records
+type Format int
+
+// available output formats
+const (
+	LOGFMT Format = iota
+	JSON
+)
+
+// ParseFormat converts format name to Format
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "logfmt":
+		return LOGFMT, nil
+	case "json":
+		return JSON, nil
+	}
+	return LOGFMT, fmt.Errorf("unknown log format: %s", name)
+}
+
+// Logger leveled structured logger. Context is passed as alternating key and value
+// arguments, eg. logger.Info("metric deleted", "metric", name). Concurrent
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// With returns logger which adds keyvals to every record
+	With(keyvals ...interface{}) Logger
+	SetLevel(level Level)
+	GetLevel() Level
+}
+
+// RateLimit limits repetitive messages to Burst records of the same level and
+// message per Interval. Suppressed record count is reported with the next
+// record let through. Zero Burst disables limiting
+type RateLimit struct {
+	Burst    int
+	Interval time.Duration
+}
+
+type window struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+type limiter struct {
+	RateLimit
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+// allow returns whether record can be written and how many were suppressed before it
+func (l *limiter) allow(level Level, msg string) (bool, int) {
+	if l.Burst <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := level.String() + msg
+	now := time.Now()
+	w := l.windows[key]
+	if w == nil {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	if now.Sub(w.start) >= l.Interval {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= l.Burst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return true, suppressed
+}
+
+// shared state of a logger and loggers derived from it with With
+type core struct {
+	level   int32
+	format  Format
+	mu      sync.Mutex
+	out     io.Writer
+	limiter *limiter
+}
+
+type logger struct {
+	*core
+	keyvals []interface{}
+}
+
+// NewLogger logger factory
+func NewLogger(level Level, format Format, out io.Writer, rateLimit RateLimit) Logger {
+	return &logger{
+		core: &core{
+			level:  int32(level),
+			format: format,
+			out:    out,
+			limiter: &limiter{
+				RateLimit: rateLimit,
+				windows:   make(map[string]*window),
+			},
+		},
+	}
+}
+
+// NewNopLogger logger which discards everything
+func NewNopLogger() Logger {
+	return NewLogger(ERROR+1, LOGFMT, ioutil.Discard, RateLimit{})
+}
+
+func (l *logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(DEBUG, msg, keyvals)
+}
+
+func (l *logger) Info(msg string, keyvals ...interface{}) {
+	l.log(INFO, msg, keyvals)
+}
+
+func (l *logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(WARN, msg, keyvals)
+}
+
+func (l *logger) Error(msg string, keyvals ...interface{}) {
+	l.log(ERROR, msg, keyvals)
+}
+
+func (l *logger) With(keyvals ...interface{}) Logger {
+	kv := make([]interface{}, 0, len(l.keyvals)+len(keyvals))
+	kv = append(kv, l.keyvals...)
+	kv = append(kv, keyvals...)
+	return &logger{core: l.core, keyvals: kv}
+}
+
+func (l *logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *logger) GetLevel() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.GetLevel() {
+		return
+	}
+	ok, suppressed := l.limiter.allow(level, msg)
+	if !ok {
+		return
+	}
+
+	kv := make([]interface{}, 0, 6+len(l.keyvals)+len(keyvals)+2)
+	kv = append(kv, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	kv = append(kv, l.keyvals...)
+	kv = append(kv, keyvals...)
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(MISSING)")
+	}
+	if suppressed > 0 {
+		kv = append(kv, "suppressed", suppressed)
+	}
+
+	var buf bytes.Buffer
+	if l.format == JSON {
+		encodeJSON(&buf, kv)
+	} else {
+		encodeLogfmt(&buf, kv)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(buf.Bytes())
+}
+
+func encodeJSON(buf *bytes.Buffer, kv []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(kv[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		val := kv[i+1]
+		switch v := val.(type) {
+		case error:
+			val = v.Error()
+		case fmt.Stringer:
+			val = v.String()
+		}
+		b, err := json.Marshal(val)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprintf("%+v", val))
+		}
+		buf.Write(b)
+	}
+	buf.WriteString("}\n")
+}
+
+func encodeLogfmt(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(kv[i]))
+		buf.WriteByte('=')
+
+		var val string
+		switch v := kv[i+1].(type) {
+		case string:
+			val = v
+		case error:
+			val = v.Error()
+		case float64:
+			val = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			val = fmt.Sprintf("%+v", v)
+		}
+		if val == "" || strings.ContainsAny(val, " =\"\t\n") {
+			val = strconv.Quote(val)
+		}
+		buf.WriteString(val)
+	}
+	buf.WriteByte('\n')
+}
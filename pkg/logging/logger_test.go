@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+func TestLogger(t *testing.T) {
+	t.Run("level filtering", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := NewLogger(WARN, LOGFMT, &buf, RateLimit{})
+		l.Info("dropped")
+		l.Warn("kept")
+		assert.Equals(t, 1, strings.Count(buf.String(), "\n"))
+
+		l.SetLevel(DEBUG)
+		l.Debug("kept too")
+		assert.Equals(t, 2, strings.Count(buf.String(), "\n"))
+		assert.Equals(t, DEBUG, l.GetLevel())
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := NewLogger(DEBUG, LOGFMT, &buf, RateLimit{}).With("component", "test")
+		l.Info("metric deleted", "metric", "collectd_cpu", "inactive", 1.5, "err", errors.New("some error"))
+		out := buf.String()
+		assert.Assert(t, strings.Contains(out, `level=info msg="metric deleted" component=test metric=collectd_cpu inactive=1.5 err="some error"`), "unexpected output: %s", out)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := NewLogger(DEBUG, JSON, &buf, RateLimit{})
+		l.Error("failed", "count", 3, "err", errors.New("boom"))
+		rec := map[string]interface{}{}
+		assert.Ok(t, json.Unmarshal(buf.Bytes(), &rec))
+		assert.Equals(t, "error", rec["level"])
+		assert.Equals(t, "failed", rec["msg"])
+		assert.Equals(t, 3.0, rec["count"])
+		assert.Equals(t, "boom", rec["err"])
+	})
+
+	t.Run("rate limiting", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := NewLogger(DEBUG, LOGFMT, &buf, RateLimit{Burst: 2, Interval: time.Millisecond * 200})
+		for i := 0; i < 10; i++ {
+			l.Warn("repeated")
+		}
+		l.Warn("other")
+		assert.Equals(t, 3, strings.Count(buf.String(), "\n"))
+
+		time.Sleep(time.Millisecond * 250)
+		l.Warn("repeated")
+		assert.Assert(t, strings.Contains(buf.String(), "suppressed=8"), "missing suppressed count: %s", buf.String())
+	})
+}
+
+func TestLevelHandler(t *testing.T) {
+	for _, writable := range []bool{false, true} {
+		l := NewLogger(INFO, LOGFMT, &bytes.Buffer{}, RateLimit{})
+		h := LevelHandler(l, writable)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/loglevel", nil))
+		assert.Equals(t, http.StatusOK, rec.Code)
+		assert.Equals(t, "info\n", rec.Body.String())
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/loglevel?level=debug", nil))
+		if !writable {
+			assert.Equals(t, http.StatusForbidden, rec.Code)
+			assert.Equals(t, INFO, l.GetLevel())
+			continue
+		}
+		assert.Equals(t, http.StatusOK, rec.Code)
+		assert.Equals(t, DEBUG, l.GetLevel())
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/loglevel", strings.NewReader("bogus")))
+		assert.Equals(t, http.StatusBadRequest, rec.Code)
+	}
+}
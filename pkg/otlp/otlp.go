@@ -0,0 +1,560 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+// Reasons OTLP requests or data points are rejected
+const (
+	ReasonMalformedOTLP   = "malformed_otlp"
+	ReasonUnsupportedOTLP = "unsupported_otlp"
+)
+
+func invalid(reason string, format string, args ...interface{}) *collectd.ValidationError {
+	return &collectd.ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// MetricType data type of a metric
+type MetricType int
+
+const (
+	// Unsupported exponential histograms and summaries
+	Unsupported MetricType = iota
+	// Gauge last values
+	Gauge
+	// Sum of increments, monotonic or not
+	Sum
+	// Histogram with explicit buckets
+	Histogram
+)
+
+// Temporality aggregation temporality of sums and histograms
+type Temporality int
+
+const (
+	// TemporalityUnspecified not set by the client
+	TemporalityUnspecified Temporality = iota
+	// TemporalityDelta changes since the last export
+	TemporalityDelta
+	// TemporalityCumulative totals since the start time
+	TemporalityCumulative
+)
+
+// KeyValue attribute. Values are rendered as strings, array and map values
+// are not supported and dropped
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// NumberPoint data point of gauges and sums
+type NumberPoint struct {
+	Attributes   []KeyValue
+	TimeUnixNano uint64
+	Value        float64
+}
+
+// HistogramPoint data point of explicit bucket histograms. BucketCounts
+// holds a count per bucket, one more than ExplicitBounds
+type HistogramPoint struct {
+	Attributes     []KeyValue
+	TimeUnixNano   uint64
+	Count          uint64
+	Sum            float64
+	BucketCounts   []uint64
+	ExplicitBounds []float64
+}
+
+// Metric of a resource. Points holds the data points of gauges and sums,
+// HistogramPoints of histograms. Unsupported metrics only count their
+// data points in UnsupportedPoints
+type Metric struct {
+	Name              string
+	Description       string
+	Unit              string
+	Type              MetricType
+	Temporality       Temporality
+	Monotonic         bool
+	Points            []NumberPoint
+	HistogramPoints   []HistogramPoint
+	UnsupportedPoints int
+}
+
+// ResourceMetrics metrics of all scopes of a resource
+type ResourceMetrics struct {
+	Resource []KeyValue
+	Metrics  []Metric
+}
+
+// ExportRequest OTLP ExportMetricsServiceRequest, limited to the parts
+// translated to series
+type ExportRequest struct {
+	ResourceMetrics []ResourceMetrics
+}
+
+// fieldError wraps err with the message and field it occurred in
+func fieldError(message string, field int, err error) error {
+	return fmt.Errorf("%s field %d: %w", message, field, err)
+}
+
+// Decode decodes a protobuf encoded ExportMetricsServiceRequest. Unknown
+// fields are skipped
+func Decode(msg []byte) (*ExportRequest, error) {
+	req := &ExportRequest{}
+	r := reader{msg}
+	for {
+		field, wireType, ok, err := r.next()
+		if err != nil {
+			return nil, invalid(ReasonMalformedOTLP, "request: %v", err)
+		}
+		if !ok {
+			return req, nil
+		}
+		if field != 1 {
+			err = r.skip(wireType)
+		} else if err = expect(field, wireType, wireBytes); err == nil {
+			var b []byte
+			if b, err = r.bytes(); err == nil {
+				var rm ResourceMetrics
+				err = decodeResourceMetrics(b, &rm)
+				req.ResourceMetrics = append(req.ResourceMetrics, rm)
+			}
+		}
+		if err != nil {
+			return nil, invalid(ReasonMalformedOTLP, "%v", fieldError("request", field, err))
+		}
+	}
+}
+
+// decodeMessage calls fn with each field of message msg, fn skips fields it
+// does not decode
+func decodeMessage(name string, msg []byte, fn func(r *reader, field int, wireType int) error) error {
+	r := reader{msg}
+	for {
+		field, wireType, ok, err := r.next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := fn(&r, field, wireType); err != nil {
+			return fieldError(name, field, err)
+		}
+	}
+}
+
+// submessage decodes the length delimited message of field with decode
+func submessage(r *reader, field int, wireType int, decode func(b []byte) error) error {
+	if err := expect(field, wireType, wireBytes); err != nil {
+		return err
+	}
+	b, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	return decode(b)
+}
+
+func decodeResourceMetrics(msg []byte, rm *ResourceMetrics) error {
+	return decodeMessage("resource metrics", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1: // resource
+			return submessage(r, field, wireType, func(b []byte) error {
+				return decodeMessage("resource", b, func(r *reader, field int, wireType int) error {
+					if field == 1 {
+						return submessage(r, field, wireType, func(b []byte) error {
+							return decodeAttribute(b, &rm.Resource)
+						})
+					}
+					return r.skip(wireType)
+				})
+			})
+		case 2: // scope metrics
+			return submessage(r, field, wireType, func(b []byte) error {
+				return decodeMessage("scope metrics", b, func(r *reader, field int, wireType int) error {
+					if field == 2 {
+						return submessage(r, field, wireType, func(b []byte) error {
+							var m Metric
+							err := decodeMetric(b, &m)
+							rm.Metrics = append(rm.Metrics, m)
+							return err
+						})
+					}
+					return r.skip(wireType)
+				})
+			})
+		}
+		return r.skip(wireType)
+	})
+}
+
+func decodeMetric(msg []byte, m *Metric) error {
+	return decodeMessage("metric", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1, 2, 3: // name, description, unit
+			if err := expect(field, wireType, wireBytes); err != nil {
+				return err
+			}
+			b, err := r.bytes()
+			switch field {
+			case 1:
+				m.Name = string(b)
+			case 2:
+				m.Description = string(b)
+			case 3:
+				m.Unit = string(b)
+			}
+			return err
+		case 5: // gauge
+			m.Type = Gauge
+			return submessage(r, field, wireType, func(b []byte) error { return decodeNumberData(b, m) })
+		case 7: // sum
+			m.Type = Sum
+			return submessage(r, field, wireType, func(b []byte) error { return decodeNumberData(b, m) })
+		case 9: // histogram
+			m.Type = Histogram
+			return submessage(r, field, wireType, func(b []byte) error { return decodeHistogramData(b, m) })
+		case 10, 11: // exponential histogram, summary
+			m.Type = Unsupported
+			return submessage(r, field, wireType, func(b []byte) error {
+				return decodeMessage("data", b, func(r *reader, field int, wireType int) error {
+					if field == 1 {
+						m.UnsupportedPoints++
+					}
+					return r.skip(wireType)
+				})
+			})
+		}
+		return r.skip(wireType)
+	})
+}
+
+// decodeTemporality decodes aggregation_temporality and is_monotonic fields of sums and histograms
+func decodeTemporality(r *reader, field int, wireType int, m *Metric) error {
+	if err := expect(field, wireType, wireVarint); err != nil {
+		return err
+	}
+	v, err := r.varint()
+	if field == 2 {
+		m.Temporality = Temporality(v)
+	} else {
+		m.Monotonic = v != 0
+	}
+	return err
+}
+
+func decodeNumberData(msg []byte, m *Metric) error {
+	return decodeMessage("data", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1:
+			return submessage(r, field, wireType, func(b []byte) error {
+				var p NumberPoint
+				err := decodeNumberPoint(b, &p)
+				m.Points = append(m.Points, p)
+				return err
+			})
+		case 2, 3:
+			if m.Type == Sum {
+				return decodeTemporality(r, field, wireType, m)
+			}
+		}
+		return r.skip(wireType)
+	})
+}
+
+func decodeNumberPoint(msg []byte, p *NumberPoint) error {
+	return decodeMessage("data point", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 3, 4, 6: // time_unix_nano, as_double, as_int
+			if err := expect(field, wireType, wireFixed64); err != nil {
+				return err
+			}
+			v, err := r.fixed64()
+			switch field {
+			case 3:
+				p.TimeUnixNano = v
+			case 4:
+				p.Value = math.Float64frombits(v)
+			case 6:
+				p.Value = float64(int64(v))
+			}
+			return err
+		case 7:
+			return submessage(r, field, wireType, func(b []byte) error { return decodeAttribute(b, &p.Attributes) })
+		}
+		return r.skip(wireType)
+	})
+}
+
+func decodeHistogramData(msg []byte, m *Metric) error {
+	return decodeMessage("data", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1:
+			return submessage(r, field, wireType, func(b []byte) error {
+				var p HistogramPoint
+				err := decodeHistogramPoint(b, &p)
+				m.HistogramPoints = append(m.HistogramPoints, p)
+				return err
+			})
+		case 2:
+			return decodeTemporality(r, field, wireType, m)
+		}
+		return r.skip(wireType)
+	})
+}
+
+func decodeHistogramPoint(msg []byte, p *HistogramPoint) error {
+	return decodeMessage("histogram data point", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 3, 4, 5: // time_unix_nano, count, sum
+			if err := expect(field, wireType, wireFixed64); err != nil {
+				return err
+			}
+			v, err := r.fixed64()
+			switch field {
+			case 3:
+				p.TimeUnixNano = v
+			case 4:
+				p.Count = v
+			case 5:
+				p.Sum = math.Float64frombits(v)
+			}
+			return err
+		case 6, 7: // bucket_counts, explicit_bounds, packed or not
+			values, err := repeatedFixed64(r, wireType)
+			for _, v := range values {
+				if field == 6 {
+					p.BucketCounts = append(p.BucketCounts, v)
+				} else {
+					p.ExplicitBounds = append(p.ExplicitBounds, math.Float64frombits(v))
+				}
+			}
+			return err
+		case 9:
+			return submessage(r, field, wireType, func(b []byte) error { return decodeAttribute(b, &p.Attributes) })
+		}
+		return r.skip(wireType)
+	})
+}
+
+// repeatedFixed64 decodes a packed or a single element of a repeated fixed64 or double field
+func repeatedFixed64(r *reader, wireType int) ([]uint64, error) {
+	switch wireType {
+	case wireFixed64:
+		v, err := r.fixed64()
+		return []uint64{v}, err
+	case wireBytes:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(b)%8 != 0 {
+			return nil, fmt.Errorf("packed length %d is not a multiple of 8", len(b))
+		}
+		packed := reader{b}
+		values := make([]uint64, 0, len(b)/8)
+		for len(packed.b) > 0 {
+			v, _ := packed.fixed64()
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("wire type %d, expected %d or %d", wireType, wireFixed64, wireBytes)
+}
+
+// decodeAttribute appends KeyValue msg to attributes unless its value is not supported
+func decodeAttribute(msg []byte, attributes *[]KeyValue) error {
+	var kv KeyValue
+	supported := false
+	err := decodeMessage("attribute", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1:
+			if err := expect(field, wireType, wireBytes); err != nil {
+				return err
+			}
+			b, err := r.bytes()
+			kv.Key = string(b)
+			return err
+		case 2:
+			return submessage(r, field, wireType, func(b []byte) error {
+				var err error
+				kv.Value, supported, err = decodeAnyValue(b)
+				return err
+			})
+		}
+		return r.skip(wireType)
+	})
+	if err == nil && supported {
+		*attributes = append(*attributes, kv)
+	}
+	return err
+}
+
+// decodeAnyValue returns scalar AnyValue msg as string, ok is false for array and map values
+func decodeAnyValue(msg []byte) (value string, ok bool, err error) {
+	err = decodeMessage("value", msg, func(r *reader, field int, wireType int) error {
+		switch field {
+		case 1, 7: // string, bytes
+			if err := expect(field, wireType, wireBytes); err != nil {
+				return err
+			}
+			b, err := r.bytes()
+			value, ok = string(b), true
+			if field == 7 {
+				value = base64.StdEncoding.EncodeToString(b)
+			}
+			return err
+		case 2, 3: // bool, int
+			if err := expect(field, wireType, wireVarint); err != nil {
+				return err
+			}
+			v, err := r.varint()
+			value, ok = strconv.FormatInt(int64(v), 10), true
+			if field == 2 {
+				value = strconv.FormatBool(v != 0)
+			}
+			return err
+		case 4: // double
+			if err := expect(field, wireType, wireFixed64); err != nil {
+				return err
+			}
+			v, err := r.double()
+			value, ok = strconv.FormatFloat(v, 'g', -1, 64), true
+			return err
+		}
+		ok = false
+		return r.skip(wireType)
+	})
+	return
+}
+
+// Marshal encodes req as protobuf ExportMetricsServiceRequest, with a single
+// scope per resource and attribute values as strings
+func (req *ExportRequest) Marshal() []byte {
+	var b []byte
+	for _, rm := range req.ResourceMetrics {
+		var resource []byte
+		for _, kv := range rm.Resource {
+			resource = appendBytes(resource, 1, marshalAttribute(kv))
+		}
+		var scope []byte
+		for i := range rm.Metrics {
+			scope = appendBytes(scope, 2, rm.Metrics[i].marshal())
+		}
+		var rmb []byte
+		rmb = appendBytes(rmb, 1, resource)
+		rmb = appendBytes(rmb, 2, scope)
+		b = appendBytes(b, 1, rmb)
+	}
+	return b
+}
+
+func marshalAttribute(kv KeyValue) []byte {
+	b := appendBytes(nil, 1, []byte(kv.Key))
+	return appendBytes(b, 2, appendBytes(nil, 1, []byte(kv.Value)))
+}
+
+func (m *Metric) marshal() []byte {
+	b := appendBytes(nil, 1, []byte(m.Name))
+	if m.Description != "" {
+		b = appendBytes(b, 2, []byte(m.Description))
+	}
+	if m.Unit != "" {
+		b = appendBytes(b, 3, []byte(m.Unit))
+	}
+	var data []byte
+	switch m.Type {
+	case Gauge, Sum:
+		for _, p := range m.Points {
+			var pb []byte
+			pb = appendFixed64(pb, 3, p.TimeUnixNano)
+			pb = appendFixed64(pb, 4, math.Float64bits(p.Value))
+			for _, kv := range p.Attributes {
+				pb = appendBytes(pb, 7, marshalAttribute(kv))
+			}
+			data = appendBytes(data, 1, pb)
+		}
+	case Histogram:
+		for _, p := range m.HistogramPoints {
+			var pb []byte
+			pb = appendFixed64(pb, 3, p.TimeUnixNano)
+			pb = appendFixed64(pb, 4, p.Count)
+			pb = appendFixed64(pb, 5, math.Float64bits(p.Sum))
+			var counts, bounds []byte
+			for _, c := range p.BucketCounts {
+				counts = binary.LittleEndian.AppendUint64(counts, c)
+			}
+			for _, bound := range p.ExplicitBounds {
+				bounds = binary.LittleEndian.AppendUint64(bounds, math.Float64bits(bound))
+			}
+			pb = appendBytes(pb, 6, counts)
+			pb = appendBytes(pb, 7, bounds)
+			for _, kv := range p.Attributes {
+				pb = appendBytes(pb, 9, marshalAttribute(kv))
+			}
+			data = appendBytes(data, 1, pb)
+		}
+	}
+	if m.Type != Gauge {
+		data = appendVarint(data, 2, uint64(m.Temporality))
+	}
+	if m.Type == Sum && m.Monotonic {
+		data = appendVarint(data, 3, 1)
+	}
+	switch m.Type {
+	case Gauge:
+		b = appendBytes(b, 5, data)
+	case Sum:
+		b = appendBytes(b, 7, data)
+	case Histogram:
+		b = appendBytes(b, 9, data)
+	}
+	return b
+}
+
+// MarshalResponse encodes an ExportMetricsServiceResponse, with partial
+// success if data points were rejected
+func MarshalResponse(rejected int, message string) []byte {
+	if rejected == 0 {
+		return []byte{}
+	}
+	partial := appendVarint(nil, 1, uint64(rejected))
+	partial = appendBytes(partial, 2, []byte(message))
+	return appendBytes(nil, 1, partial)
+}
+
+// DecodeResponse decodes an ExportMetricsServiceResponse, returning the
+// rejected data points and error message of partial success
+func DecodeResponse(msg []byte) (rejected int, message string, err error) {
+	err = decodeMessage("response", msg, func(r *reader, field int, wireType int) error {
+		if field != 1 {
+			return r.skip(wireType)
+		}
+		return submessage(r, field, wireType, func(b []byte) error {
+			return decodeMessage("partial success", b, func(r *reader, field int, wireType int) error {
+				switch field {
+				case 1:
+					if err := expect(field, wireType, wireVarint); err != nil {
+						return err
+					}
+					v, err := r.varint()
+					rejected = int(v)
+					return err
+				case 2:
+					if err := expect(field, wireType, wireBytes); err != nil {
+						return err
+					}
+					b, err := r.bytes()
+					message = string(b)
+					return err
+				}
+				return r.skip(wireType)
+			})
+		})
+	})
+	return
+}
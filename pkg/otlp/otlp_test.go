@@ -0,0 +1,169 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var request = &ExportRequest{ResourceMetrics: []ResourceMetrics{{
+	Resource: []KeyValue{{"service.name", "api"}, {"host.name", "h"}, {"process.pid", "42"}},
+	Metrics: []Metric{
+		{Name: "queue.size", Type: Gauge, Points: []NumberPoint{
+			{Attributes: []KeyValue{{"queue", "a"}}, TimeUnixNano: 1700000000000000000, Value: 3},
+		}},
+		{Name: "http.requests", Type: Sum, Temporality: TemporalityCumulative, Monotonic: true, Points: []NumberPoint{
+			{Attributes: []KeyValue{{"code", "200"}, {"service.name", "override"}}, TimeUnixNano: 1700000000000000000, Value: 10},
+		}},
+		{Name: "latency", Unit: "s", Type: Histogram, Temporality: TemporalityCumulative, HistogramPoints: []HistogramPoint{
+			{TimeUnixNano: 1700000000000000000, Count: 6, Sum: 2.5, BucketCounts: []uint64{1, 2, 3}, ExplicitBounds: []float64{0.1, 1}},
+		}},
+	},
+}}}
+
+func TestDecode(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		req, err := Decode(request.Marshal())
+		assert.Ok(t, err)
+		assert.Equals(t, request, req)
+	})
+
+	t.Run("wire variants", func(t *testing.T) {
+		// int value, unpacked buckets, typed attribute values, scope and
+		// unknown fields as other clients send them
+		anyValue := func(field int, v []byte) []byte {
+			switch field {
+			case 1:
+				return appendBytes(nil, 1, v)
+			case 4:
+				return appendFixed64(nil, 4, binary.LittleEndian.Uint64(v))
+			}
+			return appendVarint(nil, field, binary.LittleEndian.Uint64(v))
+		}
+		attribute := func(key string, field int, v []byte) []byte {
+			return appendBytes(appendBytes(nil, 1, []byte(key)), 2, anyValue(field, v))
+		}
+		u64 := func(v uint64) []byte { return binary.LittleEndian.AppendUint64(nil, v) }
+
+		point := appendFixed64(nil, 2, 1)
+		point = appendFixed64(point, 3, 2)
+		point = appendFixed64(point, 6, uint64(math.MaxUint64)) // as_int -1
+		point = appendBytes(point, 7, attribute("ok", 2, u64(1)))
+		point = appendBytes(point, 7, attribute("ratio", 4, u64(math.Float64bits(0.5))))
+		point = appendBytes(point, 7, appendBytes(appendBytes(nil, 1, []byte("list")), 2, appendBytes(nil, 5, nil)))
+		point = appendVarint(point, 8, 0)
+		sum := appendBytes(nil, 1, point)
+		sum = appendVarint(sum, 2, uint64(TemporalityCumulative))
+		sum = appendVarint(sum, 3, 0)
+
+		hpoint := appendFixed64(nil, 3, 2)
+		hpoint = appendFixed64(hpoint, 4, 1)
+		hpoint = appendFixed64(hpoint, 6, 0)
+		hpoint = appendFixed64(hpoint, 6, 1)
+		hpoint = appendFixed64(hpoint, 7, math.Float64bits(1))
+		hpoint = appendFixed64(hpoint, 11, math.Float64bits(1))
+		histogram := appendBytes(nil, 1, hpoint)
+		histogram = appendVarint(histogram, 2, uint64(TemporalityCumulative))
+
+		summary := appendBytes(appendBytes(nil, 1, nil), 1, nil)
+
+		metrics := appendBytes(nil, 2, appendBytes(appendBytes(nil, 1, []byte("temp")), 7, sum))
+		metrics = appendBytes(metrics, 2, appendBytes(appendBytes(nil, 1, []byte("size")), 9, histogram))
+		metrics = appendBytes(metrics, 2, appendBytes(appendBytes(nil, 1, []byte("quantiles")), 11, summary))
+		scope := appendBytes(nil, 1, appendBytes(nil, 1, []byte("scope")))
+		scope = append(scope, metrics...)
+		resource := appendBytes(nil, 1, attribute("pid", 3, u64(7)))
+		resource = appendVarint(resource, 2, 0)
+		rm := appendBytes(nil, 1, resource)
+		rm = appendBytes(rm, 2, scope)
+		rm = appendBytes(rm, 3, []byte("https://opentelemetry.io/schemas/1.21.0"))
+
+		req, err := Decode(appendBytes(nil, 1, rm))
+		assert.Ok(t, err)
+		assert.Equals(t, &ExportRequest{ResourceMetrics: []ResourceMetrics{{
+			Resource: []KeyValue{{"pid", "7"}},
+			Metrics: []Metric{
+				{Name: "temp", Type: Sum, Temporality: TemporalityCumulative, Points: []NumberPoint{
+					{Attributes: []KeyValue{{"ok", "true"}, {"ratio", "0.5"}}, TimeUnixNano: 2, Value: -1},
+				}},
+				{Name: "size", Type: Histogram, Temporality: TemporalityCumulative, HistogramPoints: []HistogramPoint{
+					{TimeUnixNano: 2, Count: 1, BucketCounts: []uint64{0, 1}, ExplicitBounds: []float64{1}},
+				}},
+				{Name: "quantiles", UnsupportedPoints: 2},
+			},
+		}}}, req)
+	})
+
+	t.Run("rejects malformed requests", func(t *testing.T) {
+		valid := request.Marshal()
+		for _, msg := range [][]byte{valid[:len(valid)-1], {0x08}, {0x00}, appendVarint(nil, 1, 1)} {
+			_, err := Decode(msg)
+			var verr *collectd.ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error for %x, got %v", msg, err)
+			assert.Equals(t, ReasonMalformedOTLP, verr.Reason)
+		}
+	})
+}
+
+func TestTranslator(t *testing.T) {
+	translator := NewTranslator(DefaultResourceAttributes)
+
+	t.Run("translates gauges, sums and histograms", func(t *testing.T) {
+		series, rejected, err := translator.Series(request, nil)
+		assert.Ok(t, err)
+		assert.Equals(t, 0, rejected)
+		assert.Equals(t, 7, len(series))
+
+		ts := time.Unix(1700000000, 0)
+		assert.Equals(t, "queue.size", series[0].Name)
+		assert.Equals(t, []string{"queue", "service.name", "host.name"}, series[0].LabelNames)
+		assert.Equals(t, []string{"a", "api", "h"}, series[0].LabelValues)
+		assert.Equals(t, prometheus.GaugeValue, series[0].ValueType)
+		assert.Equals(t, ts, series[0].Time)
+		assert.Equals(t, "h", series[0].Host)
+
+		// data point attributes take precedence over resource attributes
+		assert.Equals(t, "http.requests_total", series[1].Name)
+		assert.Equals(t, []string{"code", "service.name", "host.name"}, series[1].LabelNames)
+		assert.Equals(t, []string{"200", "override", "h"}, series[1].LabelValues)
+		assert.Equals(t, prometheus.CounterValue, series[1].ValueType)
+
+		buckets := map[string]float64{}
+		for _, s := range series[2:5] {
+			assert.Equals(t, "latency_bucket", s.Name)
+			assert.Equals(t, "le", s.LabelNames[len(s.LabelNames)-1])
+			buckets[s.LabelValues[len(s.LabelValues)-1]] = s.Value
+		}
+		assert.Equals(t, map[string]float64{"0.1": 1, "1": 3, "+Inf": 6}, buckets)
+		assert.Equals(t, "latency_sum", series[5].Name)
+		assert.Equals(t, 2.5, series[5].Value)
+		assert.Equals(t, "latency_count", series[6].Name)
+		assert.Equals(t, 6.0, series[6].Value)
+		assert.Equals(t, []string{"service.name", "host.name"}, series[6].LabelNames)
+	})
+
+	t.Run("rejects unsupported data points", func(t *testing.T) {
+		req := &ExportRequest{ResourceMetrics: []ResourceMetrics{{Metrics: []Metric{
+			{Name: "delta", Type: Sum, Temporality: TemporalityDelta, Monotonic: true, Points: []NumberPoint{{Value: 1}, {Value: 2}}},
+			{Name: "quantiles", UnsupportedPoints: 1},
+			{Name: "broken", Type: Histogram, Temporality: TemporalityCumulative, HistogramPoints: []HistogramPoint{{BucketCounts: []uint64{1}, ExplicitBounds: []float64{1}}}},
+			{Name: "empty", Type: Gauge},
+			{Type: Gauge, Points: []NumberPoint{{Value: 1}}},
+			{Name: "ok", Type: Gauge, Points: []NumberPoint{{Value: 1}}},
+		}}}}
+		series, rejected, err := translator.Series(req, nil)
+		assert.Equals(t, 1, len(series))
+		assert.Assert(t, !series[0].Time.IsZero(), "data points without time are stamped on arrival")
+		assert.Equals(t, 5, rejected)
+		assert.Equals(t, 4, len(err.(interface{ Unwrap() []error }).Unwrap()))
+		var verr *collectd.ValidationError
+		assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+		assert.Equals(t, ReasonUnsupportedOTLP, verr.Reason)
+	})
+}
@@ -0,0 +1,170 @@
+package otlp
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultResourceAttributes resource attributes exported as labels by default
+var DefaultResourceAttributes = []string{"service.name", "service.namespace", "service.instance.id", "host.name"}
+
+// hostAttribute resource attribute accounted in the host metrics
+const hostAttribute = "host.name"
+
+func init() {
+	cdmetrics.RegisterDecodeErrorReasons(ReasonMalformedOTLP, ReasonUnsupportedOTLP)
+}
+
+// Translator translates OTLP metrics to series of the metric store
+type Translator struct {
+	// map[attribute], resource attributes exported as labels
+	resourceAttributes map[string]bool
+}
+
+// NewTranslator Translator factory, resource attributes in allowlist are
+// exported as labels of all series of the resource
+func NewTranslator(allowlist []string) *Translator {
+	t := &Translator{resourceAttributes: make(map[string]bool)}
+	for _, attribute := range allowlist {
+		t.resourceAttributes[attribute] = true
+	}
+	return t
+}
+
+// labels returns label names and values of data point attributes followed
+// by the resource labels the data point does not set itself
+func labels(attributes []KeyValue, resource []KeyValue) (names []string, values []string) {
+	names = make([]string, 0, len(attributes)+len(resource))
+	values = make([]string, 0, len(attributes)+len(resource))
+	for _, kv := range attributes {
+		names = append(names, kv.Key)
+		values = append(values, kv.Value)
+	}
+next:
+	for _, kv := range resource {
+		for _, name := range names[:len(attributes)] {
+			if name == kv.Key {
+				continue next
+			}
+		}
+		names = append(names, kv.Key)
+		values = append(values, kv.Value)
+	}
+	return
+}
+
+// timestamp returns time of unix nanoseconds ts, now when not set
+func timestamp(ts uint64, now time.Time) time.Time {
+	if ts == 0 {
+		return now
+	}
+	return time.Unix(0, int64(ts))
+}
+
+// Series appends the series of all data points in req to series and returns
+// them along with the count of rejected data points. Gauges and non-monotonic
+// sums are exported as gauges, monotonic sums as counters named with suffix
+// _total and histograms as counters <name>_bucket with label le, <name>_sum
+// and <name>_count. Sums and histograms must be cumulative. Rejected data
+// points are skipped and their errors returned joined
+func (t *Translator) Series(req *ExportRequest, series []cdmetrics.Series) ([]cdmetrics.Series, int, error) {
+	now := time.Now()
+	rejected := 0
+	var errs []error
+	for _, rm := range req.ResourceMetrics {
+		var resource []KeyValue
+		host := ""
+		for _, kv := range rm.Resource {
+			if t.resourceAttributes[kv.Key] {
+				resource = append(resource, kv)
+			}
+			if kv.Key == hostAttribute {
+				host = kv.Value
+			}
+		}
+
+		for i := range rm.Metrics {
+			m := &rm.Metrics[i]
+			points := len(m.Points) + len(m.HistogramPoints) + m.UnsupportedPoints
+			if points == 0 {
+				continue
+			}
+			switch {
+			case m.Name == "":
+				errs = append(errs, invalid(ReasonMalformedOTLP, "metric without name"))
+				rejected += points
+				continue
+			case m.Type == Unsupported:
+				errs = append(errs, invalid(ReasonUnsupportedOTLP, "%s: exponential histograms and summaries are not supported", m.Name))
+				rejected += points
+				continue
+			case m.Type != Gauge && m.Temporality != TemporalityCumulative:
+				errs = append(errs, invalid(ReasonUnsupportedOTLP, "%s: only cumulative temporality is supported", m.Name))
+				rejected += points
+				continue
+			}
+
+			name := m.Name
+			valueType := prometheus.GaugeValue
+			if m.Type == Sum && m.Monotonic {
+				valueType = prometheus.CounterValue
+				if !strings.HasSuffix(name, "_total") {
+					name += "_total"
+				}
+			}
+			for _, p := range m.Points {
+				labelNames, labelValues := labels(p.Attributes, resource)
+				series = append(series, cdmetrics.Series{
+					Name:        name,
+					LabelNames:  labelNames,
+					LabelValues: labelValues,
+					Value:       p.Value,
+					ValueType:   valueType,
+					Time:        timestamp(p.TimeUnixNano, now),
+					Host:        host,
+				})
+			}
+
+			for _, p := range m.HistogramPoints {
+				if len(p.BucketCounts) != len(p.ExplicitBounds)+1 {
+					errs = append(errs, invalid(ReasonMalformedOTLP, "%s: %d buckets for %d bounds", name, len(p.BucketCounts), len(p.ExplicitBounds)))
+					rejected++
+					continue
+				}
+				labelNames, labelValues := labels(p.Attributes, resource)
+				ts := timestamp(p.TimeUnixNano, now)
+				add := func(name string, value float64, le string) {
+					s := cdmetrics.Series{
+						Name:        name,
+						LabelNames:  labelNames,
+						LabelValues: labelValues,
+						Value:       value,
+						ValueType:   prometheus.CounterValue,
+						Time:        ts,
+						Host:        host,
+					}
+					if le != "" {
+						s.LabelNames = append(labelNames[:len(labelNames):len(labelNames)], "le")
+						s.LabelValues = append(labelValues[:len(labelValues):len(labelValues)], le)
+					}
+					series = append(series, s)
+				}
+				cumulative := uint64(0)
+				for j, bound := range p.ExplicitBounds {
+					cumulative += p.BucketCounts[j]
+					add(name+"_bucket", float64(cumulative), strconv.FormatFloat(bound, 'f', -1, 64))
+				}
+				add(name+"_bucket", float64(p.Count), strconv.FormatFloat(math.Inf(1), 'f', -1, 64))
+				add(name+"_sum", p.Sum, "")
+				add(name+"_count", float64(p.Count), "")
+			}
+		}
+	}
+	return series, rejected, errors.Join(errs...)
+}
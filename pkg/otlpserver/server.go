@@ -0,0 +1,94 @@
+package otlpserver
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/httpserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/otlp"
+)
+
+// DefaultPath URL path of OTLP/HTTP metric exports
+const DefaultPath = "/v1/metrics"
+
+const contentType = "application/x-protobuf"
+
+// countErrors returns the number of errors joined in err
+func countErrors(err error) int {
+	if err == nil {
+		return 0
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		n := 0
+		for _, err := range joined.Unwrap() {
+			n += countErrors(err)
+		}
+		return n
+	}
+	return 1
+}
+
+// Handler serves OTLP/HTTP protobuf metric exports, translating them with
+// translator and storing the series in pipeline accounting to listener
+// metrics lm. Requests are answered with 200 and rejected data points are
+// reported as partial success, undecodable requests get 400 and JSON
+// encoded requests 415. See httpserver.ReadBody for the other status codes
+func Handler(cfg httpserver.Config, translator *otlp.Translator, staleTime float64, pub *bus.Publisher, lm *cdmetrics.ListenerMetrics, pipeline *cdmetrics.Pipeline, logger logging.Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, ok := httpserver.ReadBody(cfg, rw, r, logger)
+		if !ok {
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != contentType {
+			http.Error(rw, "unsupported content type, expected "+contentType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if pub != nil {
+			pub.Publish(cfg.Address+cfg.Path, body)
+		}
+
+		start := time.Now()
+		req, err := otlp.Decode(body)
+		if err != nil {
+			lm.ObserveParseDuration(time.Since(start))
+			_ = pipeline.ProcessSeries(body, nil, staleTime, err, lm)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, rejected, err := translator.Series(req, nil)
+		lm.ObserveParseDuration(time.Since(start))
+		// errors of series the store rejects are returned along with err
+		storeErr := pipeline.ProcessSeries(body, series, staleTime, err, lm)
+		rejected += countErrors(storeErr) - countErrors(err)
+
+		message := ""
+		if storeErr != nil {
+			message = storeErr.Error()
+		}
+		rw.Header().Set("Content-Type", contentType)
+		rw.WriteHeader(http.StatusOK)
+		if _, err := rw.Write(otlp.MarshalResponse(rejected, message)); err != nil {
+			logger.Debug("failed to write response", "err", err)
+		}
+	})
+}
+
+// Listen serves OTLP/HTTP metric exports at cfg.Path, DefaultPath when
+// empty, until ctx is cancelled. promIntf and pipeline may be shared with
+// other listeners
+func Listen(ctx context.Context, cfg httpserver.Config, translator *otlp.Translator, staleTime float64, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, pipeline *cdmetrics.Pipeline, printStats bool, logger logging.Logger) error {
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath
+	}
+	return httpserver.ListenHandler(ctx, cfg, func(cfg httpserver.Config, lm *cdmetrics.ListenerMetrics) http.Handler {
+		mux := http.NewServeMux()
+		mux.Handle(cfg.Path, Handler(cfg, translator, staleTime, pub, lm, pipeline, logger))
+		return mux
+	}, promIntf, printStats, logger)
+}
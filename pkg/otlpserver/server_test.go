@@ -0,0 +1,161 @@
+package otlpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/httpserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/otlp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var request = &otlp.ExportRequest{ResourceMetrics: []otlp.ResourceMetrics{{
+	Resource: []otlp.KeyValue{{Key: "service.name", Value: "api"}, {Key: "process.pid", Value: "42"}},
+	Metrics: []otlp.Metric{
+		{Name: "http.requests", Type: otlp.Sum, Temporality: otlp.TemporalityCumulative, Monotonic: true, Points: []otlp.NumberPoint{
+			{Attributes: []otlp.KeyValue{{Key: "code", Value: "200"}}, Value: 10},
+		}},
+		{Name: "latency", Type: otlp.Histogram, Temporality: otlp.TemporalityCumulative, HistogramPoints: []otlp.HistogramPoint{
+			{Count: 3, Sum: 0.3, BucketCounts: []uint64{1, 2}, ExplicitBounds: []float64{0.1}},
+		}},
+		{Name: "delta", Type: otlp.Sum, Temporality: otlp.TemporalityDelta, Points: []otlp.NumberPoint{{Value: 1}}},
+	},
+}}}
+
+func newPipeline() (*cdmetrics.Pipeline, *prometheus.Registry) {
+	logger := logging.NewNopLogger()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(allMetrics)
+	return cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger), registry
+}
+
+// gather returns labels of the series of metric name by their value
+func gather(t *testing.T, registry *prometheus.Registry, name string) map[float64]map[string]string {
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+	found := map[float64]map[string]string{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			found[m.GetCounter().GetValue()+m.GetGauge().GetValue()] = labels
+		}
+	}
+	return found
+}
+
+// export posts req to url as an OTLP/HTTP client does and returns status
+// and decoded response
+func export(t *testing.T, url string, contentType string, req *otlp.ExportRequest) (int, int, string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(req.Marshal())
+	assert.Ok(t, err)
+	assert.Ok(t, gz.Close())
+	httpReq, err := http.NewRequest(http.MethodPost, url, &buf)
+	assert.Ok(t, err)
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(httpReq)
+	assert.Ok(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Ok(t, err)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, 0, string(body)
+	}
+	assert.Equals(t, contentType, resp.Header.Get("Content-Type"))
+	rejected, message, err := otlp.DecodeResponse(body)
+	assert.Ok(t, err)
+	return resp.StatusCode, rejected, message
+}
+
+func TestHandler(t *testing.T) {
+	pipeline, registry := newPipeline()
+	lm := cdmetrics.NewPromIntf().Listener("test", "http")
+	translator := otlp.NewTranslator(otlp.DefaultResourceAttributes)
+	srv := httptest.NewServer(Handler(httpserver.Config{}, translator, cdmetrics.DefaultStaleTime, nil, lm, pipeline, logging.NewNopLogger()))
+	defer srv.Close()
+
+	t.Run("stores sums and histograms", func(t *testing.T) {
+		status, rejected, message := export(t, srv.URL, "application/x-protobuf", request)
+		assert.Equals(t, http.StatusOK, status)
+		assert.Equals(t, 1, rejected)
+		assert.Assert(t, message != "", "missing partial success message")
+		assert.Equals(t, map[float64]map[string]string{10: {"code": "200", "service_name": "api"}},
+			gather(t, registry, "http_requests_total"))
+		assert.Equals(t, map[float64]map[string]string{1: {"le": "0.1", "service_name": "api"}, 3: {"le": "+Inf", "service_name": "api"}},
+			gather(t, registry, "latency_bucket"))
+		assert.Equals(t, uint64(5), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+	})
+
+	t.Run("reports series rejected by the store", func(t *testing.T) {
+		gauge := &otlp.ExportRequest{ResourceMetrics: []otlp.ResourceMetrics{{Metrics: []otlp.Metric{
+			{Name: "http.requests_total", Type: otlp.Gauge, Points: []otlp.NumberPoint{{Value: 1}}},
+		}}}}
+		status, rejected, _ := export(t, srv.URL, "application/x-protobuf", gauge)
+		assert.Equals(t, http.StatusOK, status)
+		assert.Equals(t, 1, rejected)
+	})
+
+	t.Run("rejects malformed and JSON requests", func(t *testing.T) {
+		resp, err := http.Post(srv.URL, "application/x-protobuf", bytes.NewReader([]byte{0x0a, 0x05}))
+		assert.Ok(t, err)
+		resp.Body.Close()
+		assert.Equals(t, http.StatusBadRequest, resp.StatusCode)
+
+		status, _, _ := export(t, srv.URL, "application/json", request)
+		assert.Equals(t, http.StatusUnsupportedMediaType, status)
+	})
+}
+
+func TestListen(t *testing.T) {
+	logger := logging.NewNopLogger()
+	pipeline, registry := newPipeline()
+
+	// find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	cfg := httpserver.Config{Address: ln.Addr().String()}
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Listen(ctx, cfg, otlp.NewTranslator(nil), cdmetrics.DefaultStaleTime, nil, cdmetrics.NewPromIntf(), pipeline, false, logger)
+	}()
+
+	client := &http.Client{Timeout: time.Second}
+	for i := 0; i < 50; i++ {
+		resp, err := client.Post("http://"+cfg.Address+DefaultPath, "application/x-protobuf", bytes.NewReader(request.Marshal()))
+		if err == nil {
+			resp.Body.Close()
+			assert.Equals(t, http.StatusOK, resp.StatusCode)
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	// resource attributes are only exported when allowed
+	assert.Equals(t, map[float64]map[string]string{10: {"code": "200"}}, gather(t, registry, "http_requests_total"))
+
+	cancel()
+	assert.Equals(t, context.Canceled, <-done)
+}
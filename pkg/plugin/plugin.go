@@ -0,0 +1,131 @@
+// Package plugin loads message handlers and transports built out of tree
+// from Go plugins.
+//
+// A plugin is a main package built with -buildmode=plugin against the same
+// sg-core sources and Go toolchain as the server. It exports
+//
+//	var SGCoreAPIVersion = plugin.APIVersion
+//	func Init(config []byte) error
+//
+// Init receives the raw JSON config block of the plugin and registers its
+// formats with handler.Register and its transports with transport.Register,
+// see examples/plugin
+package plugin
+
+import (
+	"fmt"
+	"os"
+	goplugin "plugin"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// APIVersion version of the plugin API, incremented on incompatible changes
+// of the symbols plugins export or of the packages they use
+const APIVersion = 1
+
+// symbols plugins export
+const (
+	VersionSymbol = "SGCoreAPIVersion"
+	InitSymbol    = "Init"
+)
+
+// Config of a plugin in the plugins file
+type Config struct {
+	// Path of the .so file
+	Path string `json:"path"`
+	// Config JSON block passed to Init as is
+	Config jsoniter.RawMessage `json:"config"`
+}
+
+// LoadConfig reads the plugins of the JSON file at path, of the form
+//
+//	{"plugins": [{"path": "/usr/lib/sg-core/example.so", "config": {...}}]}
+func LoadConfig(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Plugins []Config `json:"plugins"`
+	}
+	if err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, cfg := range file.Plugins {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("%s: plugin %d: missing path", path, i)
+		}
+	}
+	return file.Plugins, nil
+}
+
+// Load opens the plugin at cfg.Path, checks it was built against APIVersion
+// and calls its Init with cfg.Config. A plugin can be loaded once
+func Load(cfg Config) error {
+	p, err := goplugin.Open(cfg.Path)
+	if err != nil {
+		return fmt.Errorf("could not load plugin %s: %w%s", cfg.Path, err, hint(err))
+	}
+	if err := initialize(p, cfg.Config); err != nil {
+		return fmt.Errorf("plugin %s: %w", cfg.Path, err)
+	}
+	return nil
+}
+
+// LoadAll loads plugins in order, stopping at the first failing
+func LoadAll(plugins []Config) error {
+	for _, cfg := range plugins {
+		if err := Load(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hint explains common causes of plugin.Open errors
+func hint(err error) string {
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "different version of package"):
+		return ", rebuild the plugin with the Go toolchain, build flags and sg-core sources of the server"
+	case strings.Contains(msg, "not implemented"):
+		return ", plugins need a server built with cgo on linux, freebsd or darwin"
+	case strings.Contains(msg, "already loaded"):
+		return ", another plugin of the same package path is loaded"
+	}
+	return ""
+}
+
+// symbols of an opened plugin, *plugin.Plugin
+type symbols interface {
+	Lookup(name string) (goplugin.Symbol, error)
+}
+
+// initialize checks the API version of p and calls its Init with config
+func initialize(p symbols, config []byte) error {
+	sym, err := p.Lookup(VersionSymbol)
+	if err != nil {
+		return fmt.Errorf("missing %s, not an sg-core plugin", VersionSymbol)
+	}
+	version, ok := sym.(*int)
+	if !ok {
+		return fmt.Errorf("%s has type %T, expected int", VersionSymbol, sym)
+	}
+	if *version != APIVersion {
+		return fmt.Errorf("built against plugin API version %d, server supports %d", *version, APIVersion)
+	}
+
+	sym, err = p.Lookup(InitSymbol)
+	if err != nil {
+		return fmt.Errorf("missing %s", InitSymbol)
+	}
+	initFunc, ok := sym.(func([]byte) error)
+	if !ok {
+		return fmt.Errorf("%s has type %T, expected func([]byte) error", InitSymbol, sym)
+	}
+	if err := initFunc(config); err != nil {
+		return fmt.Errorf("%s failed: %w", InitSymbol, err)
+	}
+	return nil
+}
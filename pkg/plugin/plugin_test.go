@@ -0,0 +1,132 @@
+package plugin_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/handler"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/plugin"
+	"github.com/infrawatch/sg-core/pkg/transport"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// flags of plugin builds, matching the flags of the test binary
+var buildFlags = []string{"-buildmode=plugin"}
+
+// buildPlugin builds the plugin of package pkg and returns the path of the .so
+func buildPlugin(t *testing.T, pkg string) string {
+	if testing.CoverMode() != "" {
+		t.Skip("plugins can't be loaded by coverage instrumented binaries")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	path := filepath.Join(t.TempDir(), filepath.Base(pkg)+".so")
+	out, err := exec.Command("go", append(append([]string{"build"}, buildFlags...), "-o", path, pkg)...).CombinedOutput()
+	assert.Assert(t, err == nil, "could not build %s: %v\n%s", pkg, err, out)
+	return path
+}
+
+func writeConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "plugins.json")
+	assert.Ok(t, os.WriteFile(path, []byte(config), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	plugins, err := plugin.LoadConfig(writeConfig(t, `{"plugins": [{"path": "a.so", "config":{"prefix": "a_"}}, {"path": "b.so"}]}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(plugins))
+	assert.Equals(t, "a.so", plugins[0].Path)
+	assert.Equals(t, `{"prefix": "a_"}`, string(plugins[0].Config))
+	assert.Equals(t, 0, len(plugins[1].Config))
+
+	_, err = plugin.LoadConfig(writeConfig(t, `{"plugins": [{"config": {}}]}`))
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), "missing path"), "expected missing path, got %v", err)
+	_, err = plugin.LoadConfig(writeConfig(t, `{"plugins": [`))
+	assert.Assert(t, err != nil, "expected invalid JSON")
+	_, err = plugin.LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Assert(t, err != nil, "expected missing file")
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("example", func(t *testing.T) {
+		path := buildPlugin(t, "../../examples/plugin")
+		assert.Ok(t, plugin.LoadAll([]plugin.Config{{Path: path, Config: []byte(`{"format": "example", "prefix": "site_", "transport": "example"}`)}}))
+
+		logger := logging.NewNopLogger()
+		allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+		cache := cacheutil.NewCacheServer(logger)
+		h, err := handler.New("example", handler.Env{Pipeline: cdmetrics.NewPipeline(allMetrics, cache, nil, logger), Cache: cache, Logger: logger})
+		assert.Ok(t, err)
+		lm := cdmetrics.NewPromIntf().Listener("test", "udp")
+		assert.Assert(t, h.Handle([]byte("requests 3\nbroken\n"), lm) != nil, "expected malformed line")
+		assert.Equals(t, uint64(1), lm.GetTotalMetricsReceived())
+
+		registry := prometheus.NewRegistry()
+		assert.Ok(t, registry.Register(allMetrics))
+		families, err := registry.Gather()
+		assert.Ok(t, err)
+		found := false
+		for _, family := range families {
+			found = found || family.GetName() == "site_requests"
+		}
+		assert.Assert(t, found, "site_requests not stored")
+
+		// the transport passes the lines of a file to the handler
+		file := filepath.Join(t.TempDir(), "lines")
+		assert.Ok(t, os.WriteFile(file, []byte("requests 4\nerrors 1\n"), 0o600))
+		tr, err := transport.New("example", transport.Env{Address: file, Logger: logger})
+		assert.Ok(t, err)
+		promIntf := cdmetrics.NewPromIntf()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- tr.Listen(ctx, h.Handle, nil, promIntf, false)
+		}()
+		lm = promIntf.Listener(file, "file")
+		for i := 0; i < 100 && lm.GetTotalMetricsReceived() < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		assert.Equals(t, context.Canceled, <-done)
+		assert.Equals(t, uint64(2), lm.GetTotalMetricsReceived())
+		_, err = transport.New("example", transport.Env{Logger: logger})
+		assert.Assert(t, err != nil, "expected missing path")
+
+		// Init registering the format again fails
+		err = plugin.Load(plugin.Config{Path: path, Config: []byte(`{"format": "example"}`)})
+		assert.Assert(t, err != nil && strings.Contains(err.Error(), "already registered"), "expected duplicate format, got %v", err)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		notPlugin := filepath.Join(t.TempDir(), "not.so")
+		assert.Ok(t, os.WriteFile(notPlugin, []byte("not a plugin"), 0o600))
+		tests := []struct {
+			name string
+			path string
+			err  string
+		}{
+			{"missing file", filepath.Join(t.TempDir(), "missing.so"), "could not load plugin"},
+			{"not a plugin", notPlugin, "could not load plugin"},
+			{"missing symbols", buildPlugin(t, "./testdata/empty"), "not an sg-core plugin"},
+			{"version mismatch", buildPlugin(t, "./testdata/badversion"), "plugin API version 2, server supports 1"},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				err := plugin.Load(plugin.Config{Path: test.path})
+				assert.Assert(t, err != nil && strings.Contains(err.Error(), test.err), "expected %q, got %v", test.err, err)
+				assert.Assert(t, strings.Contains(err.Error(), test.path), "expected path in %v", err)
+			})
+		}
+	})
+}
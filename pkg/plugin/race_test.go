@@ -0,0 +1,8 @@
+//go:build race
+
+package plugin_test
+
+// plugins loaded by the tests must be built with the race detector too
+func init() {
+	buildFlags = append(buildFlags, "-race")
+}
@@ -0,0 +1,12 @@
+// plugin built against a future plugin API version
+package main
+
+import "github.com/infrawatch/sg-core/pkg/plugin"
+
+var SGCoreAPIVersion = plugin.APIVersion + 1
+
+func Init(data []byte) error {
+	return nil
+}
+
+func main() {}
@@ -0,0 +1,4 @@
+// plugin not exporting the symbols of sg-core plugins
+package main
+
+func main() {}
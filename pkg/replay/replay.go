@@ -0,0 +1,159 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/capture"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/handler"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultFormat of records of captures without format
+const defaultFormat = "collectd"
+
+// messageTime returns collectd time of the first metric in msg or zero time
+func messageTime(msg []byte) time.Time {
+	ts := jsoniter.Get(msg, 0, "time")
+	if ts.LastError() != nil {
+		return time.Time{}
+	}
+	secs := ts.ToFloat64()
+	return time.Unix(0, int64(secs*1e9))
+}
+
+// Clock paces replayed messages. Speed 1 replays at original timing, 2 twice
+// as fast and so on. Speed <= 0 replays as fast as possible
+type Clock struct {
+	speed     float64
+	firstMsg  time.Time
+	firstWall time.Time
+}
+
+// NewClock Clock factory
+func NewClock(speed float64) *Clock {
+	return &Clock{speed: speed}
+}
+
+// Wait blocks until message recorded at msgTime is due
+func (c *Clock) Wait(ctx context.Context, msgTime time.Time) error {
+	if c.speed <= 0 || msgTime.IsZero() {
+		return nil
+	}
+	if c.firstMsg.IsZero() {
+		c.firstMsg, c.firstWall = msgTime, time.Now()
+		return nil
+	}
+	due := c.firstWall.Add(time.Duration(float64(msgTime.Sub(c.firstMsg)) / c.speed))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// handlers creates the handler of each replayed format once
+type handlers struct {
+	env        handler.Env
+	registerer prometheus.Registerer
+	// map[format]
+	handlers map[string]handler.Handler
+}
+
+// get returns the handler of format. Records without format and of formats
+// which are not registered, e.g. of a plugin not loaded, are collectd
+func (hs *handlers) get(format string) (handler.Handler, error) {
+	if format == "" {
+		format = defaultFormat
+	}
+	if h, found := hs.handlers[format]; found {
+		return h, nil
+	}
+	h, err := handler.New(format, hs.env)
+	if err != nil {
+		if format == defaultFormat {
+			return nil, err
+		}
+		hs.env.Logger.Warn("replaying records of format as collectd", "format", format, "err", err)
+		if h, err = hs.get(defaultFormat); err != nil {
+			return nil, err
+		}
+	} else if hs.registerer != nil {
+		for _, c := range h.Collectors() {
+			if err := hs.registerer.Register(c); err != nil {
+				hs.env.Logger.Warn("could not register collector of format", "format", format, "err", err)
+			}
+		}
+	}
+	hs.handlers[format] = h
+	return h, nil
+}
+
+// Listen feeds every message recorded in capture file path to the handler of
+// its recorded format created with env, collectd for captures without format.
+// Collectors of the handlers are registered to registerer unless nil.
+// dictionary is needed for captures compressed with one. Framed captures are
+// paced by receive time, legacy ones by collectd time. Returns nil once the
+// whole file is replayed
+func Listen(ctx context.Context, path string, speed float64, dictionary []byte, promIntf *cdmetrics.PromIntf, env handler.Env, registerer prometheus.Registerer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	promIntfMetrics := promIntf.Listener(path, "replay")
+	clock := NewClock(speed)
+	hs := &handlers{env: env, registerer: registerer, handlers: make(map[string]handler.Handler)}
+	logger := env.Logger
+
+	logger.Info("replaying", "file", path, "speed", speed)
+	start := time.Now()
+
+	reader, err := capture.NewReader(f, dictionary)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// legacy captures carry no receive time, pace them by collectd time
+		msgTime := rec.Time
+		if msgTime.IsZero() {
+			msgTime = messageTime(rec.Msg)
+		}
+		if err := clock.Wait(ctx, msgTime); err != nil {
+			return err
+		}
+		h, err := hs.get(rec.Format)
+		if err != nil {
+			return err
+		}
+		_ = h.Handle(rec.Msg, promIntfMetrics)
+	}
+
+	logger.Info("replay finished", "file", path, "msgs", promIntfMetrics.GetTotalAmqpReceived(),
+		"metrics", promIntfMetrics.GetTotalMetricsReceived(), "decode_errors", promIntfMetrics.GetTotalDecodeErrors(),
+		"duration", time.Since(start).Seconds())
+	return nil
+}
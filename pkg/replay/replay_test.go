@@ -0,0 +1,136 @@
+package replay
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/capture"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/handler"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/zstdutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const legacyCapture = `[{"values":[7.5],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5.000,"host":"host0","plugin":"cpu","plugin_instance":"0","type":"percent","type_instance":"user"}]
+[{"values":[7.7],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.5,"interval":5.000,"host":"host0","plugin":"cpu","plugin_instance":"0","type":"percent","type_instance":"system"}]
+
+[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682812.0,"interval":5.000,"host":"host1","plugin":"cpu","plugin_instance":"0","type":"percent","type_instance":"user"}]
+[{"values":[1],"dstypes":["gauge"],
+`
+
+func replayCapture(t *testing.T, speed float64) (*cdmetrics.ListenerMetrics, time.Duration) {
+	path := filepath.Join(t.TempDir(), "cd-capture.txt")
+	assert.Ok(t, ioutil.WriteFile(path, []byte(legacyCapture), 0644))
+
+	logger := logging.NewNopLogger()
+	promIntf := cdmetrics.NewPromIntf()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+
+	start := time.Now()
+	assert.Ok(t, Listen(context.Background(), path, speed, nil, promIntf, handler.Env{Pipeline: pipeline, Logger: logger}, nil))
+	return promIntf.Listener(path, "replay"), time.Since(start)
+}
+
+func TestReplay(t *testing.T) {
+	t.Run("as fast as possible", func(t *testing.T) {
+		lm, elapsed := replayCapture(t, 0)
+		assert.Equals(t, uint64(4), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+		assert.Assert(t, elapsed < time.Millisecond*500, "replay took %v", elapsed)
+	})
+
+	t.Run("speed multiplier", func(t *testing.T) {
+		// recorded over 1s, replayed at 4x
+		_, elapsed := replayCapture(t, 4)
+		assert.Assert(t, elapsed >= time.Millisecond*250, "replay too fast: %v", elapsed)
+		assert.Assert(t, elapsed < time.Millisecond*750, "replay too slow: %v", elapsed)
+	})
+
+	framed := func(t *testing.T, compression capture.Compression, ext string, dict []byte) *cdmetrics.ListenerMetrics {
+		logger := logging.NewNopLogger()
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		b := bus.New(logger)
+		w, err := capture.NewWriter(capture.Config{Path: path, Compression: compression, Dictionary: dict}, b, logger)
+		assert.Ok(t, err)
+		pub := b.Publisher("collectd")
+		for _, line := range strings.Split(legacyCapture, "\n")[:4] {
+			pub.Publish("/tmp/smartgateway", []byte(line))
+		}
+		assert.Ok(t, w.Close())
+
+		promIntf := cdmetrics.NewPromIntf()
+		pipeline := cdmetrics.NewPipeline(cdmetrics.NewCDMetrics(0, logger), cacheutil.NewCacheServer(logger), nil, logger)
+		err = Listen(context.Background(), path+ext, 1, dict, promIntf, handler.Env{Pipeline: pipeline, Logger: logger}, nil)
+		assert.Ok(t, err)
+		return promIntf.Listener(path+ext, "replay")
+	}
+
+	t.Run("framed compressed capture", func(t *testing.T) {
+		lm := framed(t, capture.GZIP, ".gz", nil)
+		assert.Equals(t, uint64(4), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("zstd capture with dictionary", func(t *testing.T) {
+		dict, err := zstdutil.LoadDictionary("../../tmp/dictionary")
+		assert.Ok(t, err)
+		lm := framed(t, capture.ZSTD, ".zst", dict)
+		assert.Equals(t, uint64(4), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(3), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("records dispatched by format", func(t *testing.T) {
+		logger := logging.NewNopLogger()
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		b := bus.New(logger)
+		w, err := capture.NewWriter(capture.Config{Path: path}, b, logger)
+		assert.Ok(t, err)
+		collectdMsg := []byte(strings.Split(legacyCapture, "\n")[0])
+		b.Publisher("collectd").Publish("/tmp/smartgateway", collectdMsg)
+		b.Publisher("influx").Publish("127.0.0.1:8089", []byte("cpu,host=h usage_idle=1,usage_user=2"))
+		// formats of plugins which are not loaded are replayed as collectd
+		b.Publisher("unloaded").Publish("/tmp/smartgateway", collectdMsg)
+		b.Publish(bus.Message{Time: time.Now(), Source: "/tmp/smartgateway", Data: collectdMsg})
+		assert.Ok(t, w.Close())
+
+		promIntf := cdmetrics.NewPromIntf()
+		allMetrics := cdmetrics.NewCDMetrics(0, logger)
+		pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+		assert.Ok(t, Listen(context.Background(), path, 0, nil, promIntf, handler.Env{Pipeline: pipeline, Logger: logger}, nil))
+		lm := promIntf.Listener(path, "replay")
+		assert.Equals(t, uint64(4), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(5), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(0), lm.GetTotalDecodeErrors())
+
+		registry := prometheus.NewRegistry()
+		assert.Ok(t, registry.Register(allMetrics))
+		families, err := registry.Gather()
+		assert.Ok(t, err)
+		names := map[string]bool{}
+		for _, family := range families {
+			names[family.GetName()] = true
+		}
+		assert.Assert(t, names["cpu_usage_idle"], "influx record not replayed as influx")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cd-capture.txt")
+		assert.Ok(t, ioutil.WriteFile(path, []byte(strings.Repeat(legacyCapture[:strings.Index(legacyCapture, "\n")+1], 2)), 0644))
+		logger := logging.NewNopLogger()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		pipeline := cdmetrics.NewPipeline(cdmetrics.NewCDMetrics(0, logger), cacheutil.NewCacheServer(logger), nil, logger)
+		err := Listen(ctx, path, 0, nil, cdmetrics.NewPromIntf(), handler.Env{Pipeline: pipeline, Logger: logger}, nil)
+		assert.Equals(t, context.Canceled, err)
+	})
+}
@@ -0,0 +1,420 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultFlushInterval interval aggregated samples are exported at, as in etsy statsd
+const DefaultFlushInterval = 10 * time.Second
+
+// DefaultTTL time after which series without samples expire
+const DefaultTTL = 5 * time.Minute
+
+// maxObservations of a series per flush interval, further timer and
+// histogram samples are dropped
+const maxObservations = 10000
+
+func init() {
+	cdmetrics.RegisterDecodeErrorReasons(ReasonMalformedStatsd, ReasonReservedLabel)
+}
+
+// TimerType Prometheus type timers and histograms are exported as
+type TimerType int
+
+const (
+	// TimerHistogram cumulative buckets
+	TimerHistogram TimerType = iota
+	// TimerSummary quantiles over a sliding window
+	TimerSummary
+)
+
+// ParseTimerType returns timer type of name, histogram or summary
+func ParseTimerType(name string) (TimerType, error) {
+	switch name {
+	case "histogram":
+		return TimerHistogram, nil
+	case "summary":
+		return TimerSummary, nil
+	}
+	return TimerHistogram, fmt.Errorf("unknown timer type %q, expected histogram or summary", name)
+}
+
+// DefaultObjectives quantiles of timer summaries and their allowed errors
+var DefaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+// aggregate samples of a series received during the current flush interval
+type aggregate struct {
+	name        string
+	labelNames  []string
+	labelValues []string
+	// counter sum or gauge value
+	value float64
+	// gauge value was set, not only changed
+	set bool
+	// relative gauge changes
+	delta        float64
+	observations []float64
+	members      map[string]struct{}
+}
+
+// observer histogram or summary of a timer series
+type observer interface {
+	prometheus.Collector
+	prometheus.Observer
+}
+
+// series exported StatsD series
+type series struct {
+	// unix nanoseconds of the last flush updating the series, accessed atomically
+	lastUpdate int64
+
+	name        string
+	typ         Type
+	labelValues []string
+	desc        *prometheus.Desc
+	value       float64
+	observer    observer
+	ttl         time.Duration
+
+	deleteFn func()
+}
+
+// Expired implements cacheutil.Expiry
+func (s *series) Expired() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastUpdate))) >= s.ttl
+}
+
+// Delete implements cacheutil.Expiry
+func (s *series) Delete() {
+	s.deleteFn()
+}
+
+// Exporter aggregates StatsD samples per flush interval and exports the
+// results as Prometheus metrics. Sample names and tag keys are sanitized, a
+// name is exported with a single type. Counters and gauges keep their value
+// across flushes, sets export the count of unique members of the last flush
+// interval they received members in. Series expire through cache after TTL without samples. Concurrent
+type Exporter struct {
+	mu sync.Mutex
+	// map[seriesKey], samples since the last flush
+	pending map[string]*aggregate
+	// map[seriesKey]
+	series map[string]*series
+	// map[name], type and number of series of each exported name
+	families map[string]*family
+
+	cache  *cacheutil.CacheServer
+	logger logging.Logger
+
+	// TTL after which series without samples expire
+	TTL time.Duration
+	// TimerType of timers and histograms
+	TimerType TimerType
+	// Buckets of timer histograms, in seconds for timers
+	Buckets []float64
+	// Objectives of timer summaries
+	Objectives map[float64]float64
+
+	seriesCountDesc *prometheus.Desc
+}
+
+type family struct {
+	typ    Type
+	series int
+	// samples pending for the name which aren't exported yet
+	pending int
+}
+
+// NewExporter Exporter factory
+func NewExporter(cache *cacheutil.CacheServer, logger logging.Logger) *Exporter {
+	return &Exporter{
+		pending:    make(map[string]*aggregate),
+		series:     make(map[string]*series),
+		families:   make(map[string]*family),
+		cache:      cache,
+		logger:     logger,
+		TTL:        DefaultTTL,
+		TimerType:  TimerHistogram,
+		Buckets:    prometheus.DefBuckets,
+		Objectives: DefaultObjectives,
+		seriesCountDesc: prometheus.NewDesc("sg_statsd_series_count",
+			"Count of StatsD series currently exported.",
+			nil, nil,
+		),
+	}
+}
+
+// seriesKey returns key of name and labels and the sanitized label names and values
+func seriesKey(name string, tags []Tag) (key string, labelNames []string, labelValues []string) {
+	sorted := make([]Tag, len(tags))
+	copy(sorted, tags)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for i, tag := range sorted {
+		labelName := cdmetrics.SanitizeLabelName(tag.Key)
+		// the last of repeated tags wins
+		if i+1 < len(sorted) && cdmetrics.SanitizeLabelName(sorted[i+1].Key) == labelName {
+			continue
+		}
+		labelNames = append(labelNames, labelName)
+		labelValues = append(labelValues, cdmetrics.SanitizeLabelValue(tag.Value))
+	}
+	key = name + "\xff" + strings.Join(labelNames, "\xff") + "\xfe" + strings.Join(labelValues, "\xff")
+	return
+}
+
+// Add aggregates sample until the next flush
+func (e *Exporter) Add(s *Sample) error {
+	if s.Type == Counter && s.Value < 0 {
+		return invalid("%s: negative counter value %v", s.Name, s.Value)
+	}
+	if s.Type != Set && (math.IsNaN(s.Value) || math.IsInf(s.Value, 0)) {
+		return invalid("%s: non-finite value", s.Name)
+	}
+	name := cdmetrics.SanitizeMetricName(s.Name)
+	key, labelNames, labelValues := seriesKey(name, s.Tags)
+	if s.Type == Timer || s.Type == Histogram {
+		// client_golang panics on constant labels of its own
+		for _, l := range labelNames {
+			if l == "le" || l == "quantile" {
+				return &collectd.ValidationError{Reason: ReasonReservedLabel,
+					Err: fmt.Errorf("%s: tag %s is reserved in histograms and summaries", name, l)}
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f := e.families[name]
+	if f == nil {
+		f = &family{typ: s.Type}
+		e.families[name] = f
+	} else if f.typ != s.Type {
+		return &collectd.ValidationError{Reason: cdmetrics.ReasonNameCollision,
+			Err: fmt.Errorf("%s of type %s collides with a metric of type %s", name, s.Type, f.typ)}
+	}
+
+	agg := e.pending[key]
+	if agg == nil {
+		agg = &aggregate{name: name, labelNames: labelNames, labelValues: labelValues}
+		e.pending[key] = agg
+		f.pending++
+	}
+	switch s.Type {
+	case Counter:
+		agg.value += s.Value / s.SampleRate
+	case Gauge:
+		if s.Relative {
+			agg.delta += s.Value
+		} else {
+			agg.set, agg.value, agg.delta = true, s.Value, 0
+		}
+	case Timer, Histogram:
+		v := s.Value
+		if s.Type == Timer {
+			v /= 1000
+		}
+		// sampled values stand for 1/rate observations
+		for n := int(math.Round(1 / s.SampleRate)); n > 0 && len(agg.observations) < maxObservations; n-- {
+			agg.observations = append(agg.observations, v)
+		}
+	case Set:
+		if agg.members == nil {
+			agg.members = make(map[string]struct{})
+		}
+		agg.members[s.SetValue] = struct{}{}
+	}
+	return nil
+}
+
+// Flush exports the samples aggregated since the last flush
+func (e *Exporter) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for key, agg := range e.pending {
+		f := e.families[agg.name]
+		f.pending--
+		s := e.series[key]
+		if s == nil {
+			s = e.newSeries(key, agg, f.typ)
+			f.series++
+		}
+		switch s.typ {
+		case Counter:
+			s.value += agg.value
+		case Gauge:
+			if agg.set {
+				s.value = agg.value
+			}
+			s.value += agg.delta
+		case Timer, Histogram:
+			for _, v := range agg.observations {
+				s.observer.Observe(v)
+			}
+		case Set:
+			s.value = float64(len(agg.members))
+		}
+		atomic.StoreInt64(&s.lastUpdate, now)
+	}
+	e.pending = make(map[string]*aggregate)
+}
+
+// newSeries creates and registers series of key
+func (e *Exporter) newSeries(key string, agg *aggregate, typ Type) *series {
+	name, labelNames, labelValues := agg.name, agg.labelNames, agg.labelValues
+	help := fmt.Sprintf("StatsD %s %s.", typ, name)
+
+	s := &series{
+		name:        name,
+		typ:         typ,
+		labelValues: labelValues,
+		desc:        prometheus.NewDesc(name, help, labelNames, nil),
+		ttl:         e.TTL,
+	}
+	if typ == Timer || typ == Histogram {
+		constLabels := prometheus.Labels{}
+		for i, labelName := range labelNames {
+			constLabels[labelName] = labelValues[i]
+		}
+		if e.TimerType == TimerSummary {
+			s.observer = prometheus.NewSummary(prometheus.SummaryOpts{
+				Name: name, Help: help, ConstLabels: constLabels, Objectives: e.Objectives,
+			})
+		} else {
+			s.observer = prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name: name, Help: help, ConstLabels: constLabels, Buckets: e.Buckets,
+			})
+		}
+	}
+	e.series[key] = s
+
+	s.deleteFn = func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.series[key] != s {
+			return
+		}
+		delete(e.series, key)
+		if f := e.families[name]; f != nil {
+			f.series--
+			if f.series == 0 && f.pending == 0 {
+				delete(e.families, name)
+			}
+		}
+		e.logger.Debug("statsd series deleted", "metric", name, "labels", labelValues)
+	}
+	e.cache.Register(s)
+	return s
+}
+
+// Run flushes every interval until ctx is cancelled, then flushes a last time
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.Flush()
+			return ctx.Err()
+		case <-ticker.C:
+			e.Flush()
+		}
+	}
+}
+
+// Process parses StatsD msg and adds its samples, accounting to listener
+// metrics lm. Invalid lines and samples are skipped, counted and their errors
+// returned
+func (e *Exporter) Process(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+	lm.IncTotalAmqpReceived()
+	lm.AddBytesReceived(len(msg))
+
+	start := time.Now()
+	samples, err := Parse(msg, nil)
+	lm.ObserveParseDuration(time.Since(start))
+	errs := []error{}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	start = time.Now()
+	added := 0
+	for i := range samples {
+		if err := e.Add(&samples[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		added++
+	}
+	lm.AddTotalReceived(added)
+	lm.ObserveProcessDuration(time.Since(start))
+
+	err = errors.Join(errs...)
+	if err != nil {
+		e.reject(err, lm)
+	}
+	return err
+}
+
+// reject counts each of joined errors err as decode error
+func (e *Exporter) reject(err error, lm *cdmetrics.ListenerMetrics) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			e.reject(err, lm)
+		}
+		return
+	}
+	reason := ReasonMalformedStatsd
+	var verr *collectd.ValidationError
+	if errors.As(err, &verr) {
+		reason = verr.Reason
+	}
+	lm.IncDecodeError(reason)
+	e.logger.Debug("rejected statsd sample", "reason", reason, "err", err)
+}
+
+// Describe implements prometheus.Collector
+// Descriptors are created as samples arrive, so only static descriptors are described
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.seriesCountDesc
+}
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.series {
+		switch s.typ {
+		case Timer, Histogram:
+			s.observer.Collect(ch)
+			continue
+		}
+		valueType := prometheus.GaugeValue
+		if s.typ == Counter {
+			valueType = prometheus.CounterValue
+		}
+		m, err := prometheus.NewConstMetric(s.desc, valueType, s.value, s.labelValues...)
+		if err != nil {
+			e.logger.Debug("skipping invalid metric", "err", err)
+			continue
+		}
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(e.seriesCountDesc, prometheus.GaugeValue, float64(len(e.series)))
+}
@@ -0,0 +1,138 @@
+package statsd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newExporter() (*Exporter, *cdmetrics.ListenerMetrics) {
+	logger := logging.NewNopLogger()
+	return NewExporter(cacheutil.NewCacheServer(logger), logger), cdmetrics.NewPromIntf().Listener("test", "udp")
+}
+
+// gather returns metric families exported by e by name
+func gather(t *testing.T, e *Exporter) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	assert.Ok(t, registry.Register(e))
+	families, err := registry.Gather()
+	assert.Ok(t, err)
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+func TestExporter(t *testing.T) {
+	t.Run("aggregates per flush interval", func(t *testing.T) {
+		e, lm := newExporter()
+		assert.Ok(t, e.Process([]byte("requests:1|c|#env:prod\nrequests:1|c|@0.5|#env:prod\ntemp:20|g\ntemp:+2|g\nusers:a|s\nusers:b|s\nusers:a|s"), lm))
+
+		// nothing is exported before the flush
+		assert.Assert(t, gather(t, e)["requests"] == nil, "exported before flush")
+
+		e.Flush()
+		families := gather(t, e)
+		requests := families["requests"].GetMetric()
+		assert.Equals(t, 1, len(requests))
+		assert.Equals(t, 3.0, requests[0].GetCounter().GetValue())
+		assert.Equals(t, "env", requests[0].GetLabel()[0].GetName())
+		assert.Equals(t, "prod", requests[0].GetLabel()[0].GetValue())
+		assert.Equals(t, 22.0, families["temp"].GetMetric()[0].GetGauge().GetValue())
+		assert.Equals(t, 2.0, families["users"].GetMetric()[0].GetGauge().GetValue())
+		assert.Equals(t, 3.0, families["sg_statsd_series_count"].GetMetric()[0].GetGauge().GetValue())
+		assert.Equals(t, uint64(7), lm.GetTotalMetricsReceived())
+
+		// counters and gauges carry on across flushes
+		assert.Ok(t, e.Process([]byte("requests:2|c|#env:prod\ntemp:-5|g"), lm))
+		e.Flush()
+		families = gather(t, e)
+		assert.Equals(t, 5.0, families["requests"].GetMetric()[0].GetCounter().GetValue())
+		assert.Equals(t, 17.0, families["temp"].GetMetric()[0].GetGauge().GetValue())
+	})
+
+	t.Run("exports timers as histograms in seconds", func(t *testing.T) {
+		e, lm := newExporter()
+		assert.Ok(t, e.Process([]byte("latency:100|ms|#route:index\nlatency:300:2000|ms|#route:index\nsize:7|h"), lm))
+		e.Flush()
+		families := gather(t, e)
+		histogram := families["latency"].GetMetric()[0].GetHistogram()
+		assert.Equals(t, uint64(3), histogram.GetSampleCount())
+		assert.Equals(t, 2.4, histogram.GetSampleSum())
+		assert.Equals(t, "route", families["latency"].GetMetric()[0].GetLabel()[0].GetName())
+		assert.Equals(t, 7.0, families["size"].GetMetric()[0].GetHistogram().GetSampleSum())
+	})
+
+	t.Run("exports timers as summaries", func(t *testing.T) {
+		e, lm := newExporter()
+		e.TimerType = TimerSummary
+		assert.Ok(t, e.Process([]byte("latency:100|ms|@0.25"), lm))
+		e.Flush()
+		summary := gather(t, e)["latency"].GetMetric()[0].GetSummary()
+		assert.Equals(t, uint64(4), summary.GetSampleCount())
+		assert.Equals(t, 3, len(summary.GetQuantile()))
+	})
+
+	t.Run("rejects type collisions and invalid values", func(t *testing.T) {
+		e, lm := newExporter()
+		err := e.Process([]byte("requests:1|c\nrequests:1|g\nbytes:-1|c\nbad line"), lm)
+		var verr *collectd.ValidationError
+		assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+		assert.Equals(t, uint64(3), lm.GetTotalDecodeErrors())
+		assert.Equals(t, uint64(1), lm.GetTotalMetricsReceived())
+	})
+
+	t.Run("rejects reserved labels of timers and histograms", func(t *testing.T) {
+		for _, summary := range []bool{false, true} {
+			e, lm := newExporter()
+			if summary {
+				e.TimerType = TimerSummary
+			}
+			err := e.Process([]byte("req.time:12|ms|#le:5\nreq.size:3|h|#quantile:1\nreq.count:1|c|#le:5"), lm)
+			var verr *collectd.ValidationError
+			assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+			assert.Equals(t, ReasonReservedLabel, verr.Reason)
+			assert.Equals(t, uint64(2), lm.GetTotalDecodeErrors())
+			e.Flush()
+			families := gather(t, e)
+			assert.Assert(t, families["req_count"] != nil, "expected req_count, got %v", families)
+			assert.Assert(t, families["req_time"] == nil && families["req_size"] == nil, "unexpected families %v", families)
+		}
+	})
+
+	t.Run("sanitizes names and tags", func(t *testing.T) {
+		e, lm := newExporter()
+		assert.Ok(t, e.Process([]byte("app.requests-ok:1|c|#host.name:a,host.name:b"), lm))
+		e.Flush()
+		metrics := gather(t, e)["app_requests_ok"].GetMetric()
+		assert.Equals(t, 1, len(metrics))
+		assert.Equals(t, "host_name", metrics[0].GetLabel()[0].GetName())
+		assert.Equals(t, "b", metrics[0].GetLabel()[0].GetValue())
+	})
+
+	t.Run("expires series without samples", func(t *testing.T) {
+		e, lm := newExporter()
+		e.TTL = time.Millisecond
+		assert.Ok(t, e.Process([]byte("requests:1|c\nlatency:1|ms"), lm))
+		e.Flush()
+		time.Sleep(2 * time.Millisecond)
+		for _, s := range e.series {
+			assert.Assert(t, s.Expired(), "%s not expired", s.name)
+			s.Delete()
+		}
+		assert.Equals(t, 0, len(e.series))
+		assert.Equals(t, 0, len(e.families))
+
+		// a name may come back with another type
+		assert.Ok(t, e.Process([]byte("requests:1|g"), lm))
+	})
+}
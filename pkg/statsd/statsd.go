@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+// ReasonMalformedStatsd reason StatsD lines are rejected
+const ReasonMalformedStatsd = "malformed_statsd"
+
+// ReasonReservedLabel reason timers and histograms tagged with le or
+// quantile, the labels of buckets and quantiles, are rejected
+const ReasonReservedLabel = "reserved_label"
+
+// Type of a StatsD metric
+type Type int
+
+const (
+	// Counter c, summed up
+	Counter Type = iota
+	// Gauge g, set or changed by signed values
+	Gauge
+	// Timer ms, observed in seconds
+	Timer
+	// Histogram h and d (DogStatsD distribution), observed as they are
+	Histogram
+	// Set s, unique values counted per flush interval
+	Set
+)
+
+var typeNames = map[string]Type{
+	"c":  Counter,
+	"g":  Gauge,
+	"ms": Timer,
+	"h":  Histogram,
+	"d":  Histogram,
+	"s":  Set,
+}
+
+func (t Type) String() string {
+	switch t {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Timer:
+		return "timer"
+	case Histogram:
+		return "histogram"
+	}
+	return "set"
+}
+
+// Tag DogStatsD tag, exported as label
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Sample single StatsD value
+type Sample struct {
+	Name string
+	Type Type
+	// Value of counters, gauges, timers and histograms
+	Value float64
+	// Relative gauge change, the value carried a sign
+	Relative bool
+	// SetValue member of a set
+	SetValue string
+	// SampleRate in (0, 1], values are weighted by its inverse
+	SampleRate float64
+	Tags       []Tag
+}
+
+func invalid(format string, args ...interface{}) *collectd.ValidationError {
+	return &collectd.ValidationError{Reason: ReasonMalformedStatsd, Err: fmt.Errorf(format, args...)}
+}
+
+// Parse parses StatsD msg, one metric per line, with DogStatsD extensions:
+//
+//	name:value[:value...]|type[|@rate][|#tag:value,tag...]
+//
+// Samples are appended to samples. Invalid lines are skipped and their
+// errors returned joined. DogStatsD events and service checks are ignored
+func Parse(msg []byte, samples []Sample) ([]Sample, error) {
+	var errs []error
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc|")) {
+			continue
+		}
+		var err error
+		if samples, err = parseLine(line, samples); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return samples, errors.Join(errs...)
+}
+
+func parseLine(line []byte, samples []Sample) ([]Sample, error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 {
+		return samples, invalid("missing name in %q", line)
+	}
+	name := string(line[:colon])
+	fields := bytes.Split(line[colon+1:], []byte{'|'})
+	if len(fields) < 2 {
+		return samples, invalid("%s: missing type", name)
+	}
+	typ, found := typeNames[string(fields[1])]
+	if !found {
+		return samples, invalid("%s: unknown type %q", name, fields[1])
+	}
+
+	rate := 1.0
+	var tags []Tag
+	for _, field := range fields[2:] {
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case '@':
+			var err error
+			if rate, err = strconv.ParseFloat(string(field[1:]), 64); err != nil || rate <= 0 || rate > 1 {
+				return samples, invalid("%s: invalid sample rate %q", name, field[1:])
+			}
+		case '#':
+			for _, tag := range bytes.Split(field[1:], []byte{','}) {
+				// tags without value carry no label value
+				if i := bytes.IndexByte(tag, ':'); i > 0 {
+					tags = append(tags, Tag{Key: string(tag[:i]), Value: string(tag[i+1:])})
+				}
+			}
+		}
+		// other DogStatsD fields, like container ids and timestamps, are ignored
+	}
+
+	// DogStatsD packs several values of one metric into a line
+	n := len(samples)
+	for _, value := range bytes.Split(fields[0], []byte{':'}) {
+		s := Sample{Name: name, Type: typ, SampleRate: rate, Tags: tags}
+		if typ == Set {
+			s.SetValue = string(value)
+		} else {
+			f, err := strconv.ParseFloat(string(value), 64)
+			if err != nil {
+				return samples[:n], invalid("%s: invalid value %q", name, value)
+			}
+			s.Value = f
+			s.Relative = typ == Gauge && len(value) > 0 && (value[0] == '+' || value[0] == '-')
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		exp  []Sample
+	}{
+		{
+			name: "counter",
+			line: "requests:1|c",
+			exp:  []Sample{{Name: "requests", Type: Counter, Value: 1, SampleRate: 1}},
+		},
+		{
+			name: "sampled counter with tags",
+			line: "requests:2|c|@0.5|#env:prod,flag,region:eu",
+			exp: []Sample{{Name: "requests", Type: Counter, Value: 2, SampleRate: 0.5,
+				Tags: []Tag{{"env", "prod"}, {"region", "eu"}}}},
+		},
+		{
+			name: "gauges",
+			line: "temp:21.5|g\ntemp:-1|g\ntemp:+2|g",
+			exp: []Sample{
+				{Name: "temp", Type: Gauge, Value: 21.5, SampleRate: 1},
+				{Name: "temp", Type: Gauge, Value: -1, Relative: true, SampleRate: 1},
+				{Name: "temp", Type: Gauge, Value: 2, Relative: true, SampleRate: 1},
+			},
+		},
+		{
+			name: "multi value timer",
+			line: "latency:250:500|ms",
+			exp: []Sample{
+				{Name: "latency", Type: Timer, Value: 250, SampleRate: 1},
+				{Name: "latency", Type: Timer, Value: 500, SampleRate: 1},
+			},
+		},
+		{
+			name: "distribution",
+			line: "size:3|d|#shard:1|c:abc|T1700000000",
+			exp:  []Sample{{Name: "size", Type: Histogram, Value: 3, SampleRate: 1, Tags: []Tag{{"shard", "1"}}}},
+		},
+		{
+			name: "set",
+			line: "users:alice|s",
+			exp:  []Sample{{Name: "users", Type: Set, SetValue: "alice", SampleRate: 1}},
+		},
+		{
+			name: "events and service checks are ignored",
+			line: "_e{5,4}:title|text\n_sc|check|0\n\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			samples, err := Parse([]byte(test.line), nil)
+			assert.Ok(t, err)
+			assert.Equals(t, test.exp, samples)
+		})
+	}
+
+	t.Run("skips invalid lines", func(t *testing.T) {
+		samples, err := Parse([]byte("a:1|c\nnoname\n:1|c\nb:1\nc:1|x\nd:x|g\ne:1|c|@2\nf:1|c"), nil)
+		assert.Equals(t, 2, len(samples))
+		assert.Equals(t, "f", samples[1].Name)
+
+		var verr *collectd.ValidationError
+		assert.Assert(t, errors.As(err, &verr), "expected validation error, got %v", err)
+		assert.Equals(t, ReasonMalformedStatsd, verr.Reason)
+		assert.Equals(t, 6, len(err.(interface{ Unwrap() []error }).Unwrap()))
+	})
+}
@@ -0,0 +1,43 @@
+package statsdserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/inetserver"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/statsd"
+	"github.com/infrawatch/sg-core/pkg/streamserver"
+)
+
+// Config of a StatsD listener
+type Config struct {
+	// Network "tcp" or "udp"
+	Network string
+	Address string
+	// MaxMessageSize and IdleTimeout of tcp connections, see streamserver.Config
+	MaxMessageSize int
+	IdleTimeout    time.Duration
+}
+
+// Listen receives StatsD lines on cfg.Address and adds them to exporter,
+// which is flushed separately. promIntf and exporter may be shared with
+// other listeners
+func Listen(ctx context.Context, cfg Config, exporter *statsd.Exporter, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool, logger logging.Logger) error {
+	switch cfg.Network {
+	case "tcp":
+		return streamserver.Listen(ctx, streamserver.Config{
+			Network:        "tcp",
+			Address:        cfg.Address,
+			Framing:        streamserver.FramingNewline,
+			MaxMessageSize: cfg.MaxMessageSize,
+			IdleTimeout:    cfg.IdleTimeout,
+		}, exporter.Process, pub, promIntf, printStats, logger)
+	case "udp":
+		return inetserver.Listen(ctx, cfg.Address, exporter.Process, pub, promIntf, printStats, logger)
+	}
+	return fmt.Errorf("unknown network %q, expected tcp or udp", cfg.Network)
+}
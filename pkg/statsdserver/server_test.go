@@ -0,0 +1,72 @@
+package statsdserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/infrawatch/sg-core/pkg/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestListen(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			logger := logging.NewNopLogger()
+			promIntf := cdmetrics.NewPromIntf()
+			exporter := statsd.NewExporter(cacheutil.NewCacheServer(logger), logger)
+
+			// find a free port
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			assert.Ok(t, err)
+			cfg := Config{Network: network, Address: pc.LocalAddr().String()}
+			pc.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- Listen(ctx, cfg, exporter, nil, promIntf, false, logger)
+			}()
+
+			var conn net.Conn
+			for i := 0; i < 50; i++ {
+				if conn, err = net.Dial(network, cfg.Address); err == nil {
+					break
+				}
+				time.Sleep(time.Millisecond * 20)
+			}
+			assert.Ok(t, err)
+			defer conn.Close()
+
+			// datagrams sent before the listener is up are lost, writes may
+			// fail with connection refused until then
+			lm := promIntf.Listener(cfg.Address, network)
+			for i := 0; i < 50 && lm.GetTotalMetricsReceived() == 0; i++ {
+				_, _ = conn.Write([]byte("requests:1|c|#env:prod\n"))
+				time.Sleep(time.Millisecond * 20)
+			}
+			exporter.Flush()
+
+			registry := prometheus.NewRegistry()
+			assert.Ok(t, registry.Register(exporter))
+			families, err := registry.Gather()
+			assert.Ok(t, err)
+			found := false
+			for _, family := range families {
+				if family.GetName() == "requests" {
+					found = true
+					assert.Assert(t, family.GetMetric()[0].GetCounter().GetValue() >= 1, "requests not counted")
+				}
+			}
+			assert.Assert(t, found, "requests not exported")
+
+			cancel()
+			assert.Equals(t, context.Canceled, <-done)
+		})
+	}
+}
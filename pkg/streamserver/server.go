@@ -0,0 +1,307 @@
+package streamserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+// DefaultMaxMessageSize bytes of a single framed message
+const DefaultMaxMessageSize = 1 << 20
+
+// DefaultIdleTimeout after which connections without messages are closed
+const DefaultIdleTimeout = 5 * time.Minute
+
+const readBufferSize = 64 * 1024
+
+var errMessageTooLarge = errors.New("message exceeds max message size")
+
+// Framing of messages on a stream connection
+type Framing int
+
+const (
+	// FramingNewline one message per line, as newline delimited JSON or PUTVAL
+	FramingNewline Framing = iota
+	// FramingLength each message prefixed by its length as 4-byte big endian integer
+	FramingLength
+)
+
+var framingNames = map[Framing]string{
+	FramingNewline: "newline",
+	FramingLength:  "length",
+}
+
+func (f Framing) String() string {
+	return framingNames[f]
+}
+
+// ParseFraming returns framing of name
+func ParseFraming(name string) (Framing, error) {
+	for framing, s := range framingNames {
+		if s == name {
+			return framing, nil
+		}
+	}
+	return FramingNewline, fmt.Errorf("unknown framing %q, expected newline or length", name)
+}
+
+// Config of a stream listener
+type Config struct {
+	// Network "tcp" or "unix"
+	Network string
+	Address string
+	Framing Framing
+	// MaxMessageSize bytes of a message, DefaultMaxMessageSize when 0.
+	// Connections sending larger messages are closed
+	MaxMessageSize int
+	// IdleTimeout closes connections without messages for this long, 0 disables
+	IdleTimeout time.Duration
+	// MaxConnections concurrent connections, further connections are closed
+	// right away. 0 is unlimited
+	MaxConnections int
+}
+
+type server struct {
+	cfg      Config
+	process  func(msg []byte, lm *cdmetrics.ListenerMetrics) error
+	source   string
+	pub      *bus.Publisher
+	lm       *cdmetrics.ListenerMetrics
+	logger   logging.Logger
+	doneChan chan error
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+// Listen accepts stream connections on cfg.Address and feeds the framed
+// messages to process, e.g. the Handle function of a handler.Handler. Each
+// connection is read by its own goroutine, a connection is only read while
+// its previous message is processed, so slow processing pushes back on the
+// sender. promIntf may be shared with other listeners
+func Listen(ctx context.Context, cfg Config, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool, logger logging.Logger) (err error) {
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if cfg.Network == "unix" {
+		os.Remove(cfg.Address)
+		defer os.Remove(cfg.Address)
+	}
+	ln, err := net.Listen(cfg.Network, cfg.Address)
+	if err != nil {
+		return
+	}
+
+	myAddr := ln.Addr().String()
+	logger.Info("listening", "address", myAddr, "network", cfg.Network, "framing", cfg.Framing)
+
+	s := &server{
+		cfg:      cfg,
+		process:  process,
+		source:   myAddr,
+		pub:      pub,
+		lm:       promIntf.Listener(myAddr, cfg.Network),
+		logger:   logger,
+		doneChan: make(chan error, 1),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	defer s.close(ln)
+
+	go s.accept(ln)
+
+	rateTicker := time.NewTicker(time.Second)
+	defer rateTicker.Stop()
+	lastUpdate := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("cancelled")
+			err = ctx.Err()
+			goto done
+		case err = <-s.doneChan:
+			goto done
+		case now := <-rateTicker.C:
+			metricsDelta, msgsDelta := s.lm.UpdateRates(now.Sub(lastUpdate))
+			lastUpdate = now
+			if printStats {
+				logger.Info("received", "metrics", s.lm.GetTotalMetricsReceived(), "metrics_delta", metricsDelta,
+					"msgs", s.lm.GetTotalAmqpReceived(), "msgs_delta", msgsDelta, "connections", s.lm.GetOpenConnections())
+			}
+		}
+	}
+done:
+	return err
+}
+
+// done ends Listen with err, unless it is already ending
+func (s *server) done(err error) {
+	select {
+	case s.doneChan <- err:
+	default:
+	}
+}
+
+// close stops accepting, closes open connections and waits for their goroutines
+func (s *server) close(ln net.Listener) {
+	ln.Close()
+	s.mu.Lock()
+	s.shutdown = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *server) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.done(err)
+			return
+		}
+		s.lm.ConnectionOpened()
+
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			conn.Close()
+			s.lm.ConnectionClosed(cdmetrics.ConnReasonShutdown, 0)
+			return
+		}
+		if s.cfg.MaxConnections > 0 && len(s.conns) >= s.cfg.MaxConnections {
+			s.mu.Unlock()
+			conn.Close()
+			s.lm.ConnectionClosed(cdmetrics.ConnReasonLimit, 0)
+			s.logger.Warn("connection limit reached", "remote", conn.RemoteAddr(), "max", s.cfg.MaxConnections)
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serve(conn)
+	}
+}
+
+func (s *server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	start := time.Now()
+
+	var next func() ([]byte, error)
+	if s.cfg.Framing == FramingLength {
+		next = s.lengthFramer(conn)
+	} else {
+		next = s.newlineFramer(conn)
+	}
+
+	var msgs, bytes int
+	var err error
+	for {
+		if s.cfg.IdleTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(s.cfg.IdleTimeout))
+		}
+		var msg []byte
+		if msg, err = next(); err != nil {
+			break
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		msgs++
+		bytes += len(msg)
+
+		if s.pub != nil {
+			s.pub.Publish(s.source, msg)
+		}
+		if err := s.process(msg, s.lm); err == cdmetrics.ErrEndOfStream {
+			s.done(nil)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.conns, conn)
+	shutdown := s.shutdown
+	s.mu.Unlock()
+	conn.Close()
+
+	reason := cdmetrics.ConnReasonError
+	var netErr net.Error
+	switch {
+	case shutdown:
+		reason = cdmetrics.ConnReasonShutdown
+	case err == io.EOF:
+		reason = cdmetrics.ConnReasonEOF
+	case err == errMessageTooLarge || errors.Is(err, bufio.ErrTooLong):
+		reason = cdmetrics.ConnReasonMessageTooLarge
+		s.logger.Warn("closing connection", "remote", conn.RemoteAddr(), "err", err, "max", s.cfg.MaxMessageSize)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = cdmetrics.ConnReasonIdleTimeout
+	default:
+		s.logger.Warn("connection failed", "remote", conn.RemoteAddr(), "err", err)
+	}
+	s.lm.ConnectionClosed(reason, time.Since(start))
+	s.logger.Debug("connection closed", "remote", conn.RemoteAddr(), "reason", reason,
+		"msgs", msgs, "bytes", bytes, "duration", time.Since(start))
+}
+
+// newlineFramer returns reader of newline delimited messages of conn. A
+// message is only valid until the next read
+func (s *server) newlineFramer(conn net.Conn) func() ([]byte, error) {
+	// the buffer holds the delimiter too, its initial size must not exceed
+	// the max or the max is not enforced below it
+	limit := s.cfg.MaxMessageSize + 1
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, min(readBufferSize, limit)), limit)
+	return func() ([]byte, error) {
+		if scanner.Scan() {
+			return scanner.Bytes(), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// lengthFramer returns reader of length prefixed messages of conn. A message
+// is only valid until the next read
+func (s *server) lengthFramer(conn net.Conn) func() ([]byte, error) {
+	r := bufio.NewReaderSize(conn, readBufferSize)
+	var header [4]byte
+	var buf []byte
+	return func() ([]byte, error) {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n > uint32(s.cfg.MaxMessageSize) {
+			return nil, errMessageTooLarge
+		}
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf, nil
+	}
+}
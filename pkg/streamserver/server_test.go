@@ -0,0 +1,177 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+// start runs Listen with cfg and returns its listener metrics and a connected client
+func start(t *testing.T, cfg Config) (*cdmetrics.ListenerMetrics, func() net.Conn) {
+	logger := logging.NewNopLogger()
+	promIntf := cdmetrics.NewPromIntf()
+	allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+	pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
+
+	if cfg.Network == "tcp" {
+		// find a free port
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Ok(t, err)
+		cfg.Address = ln.Addr().String()
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Listen(ctx, cfg, pipeline.Process, nil, promIntf, false, logger)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.Equals(t, context.Canceled, <-done)
+	})
+
+	dial := func() net.Conn {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial(cfg.Network, cfg.Address); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		assert.Ok(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	return promIntf.Listener(cfg.Address, cfg.Network), dial
+}
+
+func waitFor(cond func() bool) {
+	for i := 0; i < 100 && !cond(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func lengthPrefixed(msg []byte) []byte {
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestParseFraming(t *testing.T) {
+	for _, framing := range []Framing{FramingNewline, FramingLength} {
+		parsed, err := ParseFraming(framing.String())
+		assert.Ok(t, err)
+		assert.Equals(t, framing, parsed)
+	}
+	_, err := ParseFraming("crlf")
+	assert.Assert(t, err != nil, "expected error for unknown framing")
+}
+
+func TestListen(t *testing.T) {
+	t.Run("newline framing over tcp", func(t *testing.T) {
+		lm, dial := start(t, Config{Network: "tcp", Framing: FramingNewline})
+		conn := dial()
+
+		// newline framed messages must be single line
+		msg := bytes.ReplaceAll(collectd.GenCPUMetric(10, "localhost", 3), []byte("\n"), nil)
+		_, err := conn.Write(append(append(append(msg, '\n'), msg...), "\nnot json\n\n"...))
+		assert.Ok(t, err)
+
+		waitFor(func() bool { return lm.GetTotalAmqpReceived() >= 3 })
+		assert.Equals(t, uint64(3), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(6), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+		assert.Equals(t, int64(1), lm.GetOpenConnections())
+	})
+
+	t.Run("length framing over unix stream", func(t *testing.T) {
+		address := filepath.Join(t.TempDir(), "sg.sock")
+		lm, dial := start(t, Config{Network: "unix", Address: address, Framing: FramingLength})
+
+		// concurrent connections
+		msg := collectd.GenCPUMetric(10, "localhost", 2)
+		for i := 0; i < 3; i++ {
+			_, err := dial().Write(append(lengthPrefixed(msg), lengthPrefixed(msg)...))
+			assert.Ok(t, err)
+		}
+
+		waitFor(func() bool { return lm.GetTotalAmqpReceived() >= 6 })
+		assert.Equals(t, uint64(6), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(12), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(3), lm.GetTotalConnections())
+	})
+
+	t.Run("closes connections exceeding max message size", func(t *testing.T) {
+		lm, dial := start(t, Config{Network: "tcp", Framing: FramingLength, MaxMessageSize: 16})
+		conn := dial()
+
+		_, err := conn.Write(lengthPrefixed(collectd.GenCPUMetric(10, "localhost", 1)))
+		assert.Ok(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equals(t, io.EOF, err)
+
+		waitFor(func() bool { return lm.GetOpenConnections() == 0 })
+		assert.Equals(t, int64(0), lm.GetOpenConnections())
+		assert.Equals(t, uint64(0), lm.GetTotalAmqpReceived())
+	})
+
+	t.Run("closes connections exceeding max message size with newline framing", func(t *testing.T) {
+		lm, dial := start(t, Config{Network: "tcp", Framing: FramingNewline, MaxMessageSize: 16})
+		conn := dial()
+
+		// a message of exactly the max size is accepted
+		_, err := conn.Write([]byte("not json, 16 b..\n"))
+		assert.Ok(t, err)
+		waitFor(func() bool { return lm.GetTotalAmqpReceived() >= 1 })
+		assert.Equals(t, uint64(1), lm.GetTotalAmqpReceived())
+
+		_, err = conn.Write(append(bytes.ReplaceAll(collectd.GenCPUMetric(10, "localhost", 1), []byte("\n"), nil), '\n'))
+		assert.Ok(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		// reset instead of EOF as the rest of the message is not read
+		_, err = conn.Read(make([]byte, 1))
+		assert.Assert(t, err != nil, "expected closed connection")
+
+		waitFor(func() bool { return lm.GetOpenConnections() == 0 })
+		assert.Equals(t, int64(0), lm.GetOpenConnections())
+		assert.Equals(t, uint64(1), lm.GetTotalAmqpReceived())
+	})
+
+	t.Run("closes idle connections", func(t *testing.T) {
+		lm, dial := start(t, Config{Network: "tcp", IdleTimeout: 50 * time.Millisecond})
+		conn := dial()
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equals(t, io.EOF, err)
+
+		waitFor(func() bool { return lm.GetOpenConnections() == 0 })
+		assert.Equals(t, int64(0), lm.GetOpenConnections())
+	})
+
+	t.Run("limits concurrent connections", func(t *testing.T) {
+		lm, dial := start(t, Config{Network: "tcp", MaxConnections: 1})
+		dial()
+		waitFor(func() bool { return lm.GetOpenConnections() == 1 })
+
+		conn := dial()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equals(t, io.EOF, err)
+		assert.Equals(t, int64(1), lm.GetOpenConnections())
+	})
+}
@@ -0,0 +1,92 @@
+// Package transport registers listeners built out of tree, which plugins
+// provide like formats, see pkg/plugin. The built-in listeners are subcommands
+// of the server and not registered
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+// Transport receives messages like the built-in listeners, decoding is left
+// to the handler of the format passed to Listen
+type Transport interface {
+	// Listen receives messages until ctx is cancelled, publishing each to pub
+	// unless nil and passing it to process, the Handle function of a
+	// handler.Handler, with the metrics of the listener in promIntf. Returns
+	// ctx.Err() when cancelled
+	Listen(ctx context.Context, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool) error
+}
+
+// Env configuration transports are created with
+type Env struct {
+	// Address to listen on, its syntax is up to the transport
+	Address string
+	Logger  logging.Logger
+}
+
+// Factory creates a transport
+type Factory func(env Env) (Transport, error)
+
+// Func adapts a listen function to Transport
+type Func func(ctx context.Context, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool) error
+
+// Listen implements Transport
+func (f Func) Listen(ctx context.Context, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool) error {
+	return f(ctx, process, pub, promIntf, printStats)
+}
+
+var (
+	mu sync.RWMutex
+	// map[name]
+	factories = make(map[string]Factory)
+)
+
+// Register registers factory of transport name. Transports can be
+// registered once
+func Register(name string, factory Factory) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" || factory == nil {
+		return fmt.Errorf("transport name and factory are required")
+	}
+	if _, found := factories[name]; found {
+		return fmt.Errorf("transport %q is already registered", name)
+	}
+	factories[name] = factory
+	return nil
+}
+
+// Names returns the sorted names of registered transports
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates transport name with env
+func New(name string, env Env) (Transport, error) {
+	mu.RLock()
+	factory := factories[name]
+	mu.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown transport %q, registered are: %s", name, strings.Join(Names(), ", "))
+	}
+	t, err := factory(env)
+	if err != nil {
+		return nil, fmt.Errorf("transport %s: %w", name, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+	"github.com/infrawatch/sg-core/pkg/bus"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
+	"github.com/infrawatch/sg-core/pkg/logging"
+)
+
+func TestRegister(t *testing.T) {
+	env := Env{Address: "test-address", Logger: logging.NewNopLogger()}
+	_, err := New("test", env)
+	assert.Assert(t, err != nil, "expected unknown transport")
+
+	assert.Ok(t, Register("test", func(env Env) (Transport, error) {
+		return Func(func(ctx context.Context, process func(msg []byte, lm *cdmetrics.ListenerMetrics) error, pub *bus.Publisher, promIntf *cdmetrics.PromIntf, printStats bool) error {
+			return process([]byte(env.Address), promIntf.Listener(env.Address, "test"))
+		}), nil
+	}))
+	assert.Assert(t, Register("test", func(env Env) (Transport, error) { return nil, nil }) != nil, "expected duplicate transport")
+	assert.Assert(t, Register("", func(env Env) (Transport, error) { return nil, nil }) != nil, "expected missing transport name")
+	assert.Assert(t, Register("nil", nil) != nil, "expected missing factory")
+	assert.Equals(t, []string{"test"}, Names())
+
+	tr, err := New("test", env)
+	assert.Ok(t, err)
+	received := ""
+	assert.Ok(t, tr.Listen(context.Background(), func(msg []byte, lm *cdmetrics.ListenerMetrics) error {
+		received = string(msg)
+		return nil
+	}, nil, cdmetrics.NewPromIntf(), false))
+	assert.Equals(t, "test-address", received)
+}
@@ -2,45 +2,75 @@ package unixserver
 
 import (
 	"context"
+	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/infrawatch/sg-core/pkg/assert"
 	"github.com/infrawatch/sg-core/pkg/cacheutil"
+	"github.com/infrawatch/sg-core/pkg/cdmetrics"
 	"github.com/infrawatch/sg-core/pkg/collectd"
+	"github.com/infrawatch/sg-core/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func TestCDMetrics(t *testing.T) {
-	t.Run("CDMetrics expiration", func(t *testing.T) {
-		cd := &collectd.Collectd{
-			Values:   []float64{1.59},
-			Host:     "localhost",
-			Dstypes:  []string{"gauge"},
-			Dsnames:  []string{"dsname0"},
-			Plugin:   "interface",
-			Type:     "ingress",
-			Interval: 0.2, //expire happens at 5x this interval
-		}
+func TestListen(t *testing.T) {
+	t.Run("stores received metrics", func(t *testing.T) {
+		address := filepath.Join(t.TempDir(), "sg.sock")
+		logger := logging.NewNopLogger()
 
-		cdmetrics := NewCDMetrics()
-		// ch := make(chan prometheus.Metric)
+		promIntf := cdmetrics.NewPromIntf()
+		allMetrics := cdmetrics.NewCDMetrics(cdmetrics.DefaultHostGracePeriod, logger)
+		pipeline := cdmetrics.NewPipeline(allMetrics, cacheutil.NewCacheServer(logger), nil, logger)
 
-		cs := cacheutil.NewCacheServer()
-		cs.Interval = 1
-		ctx := context.Background()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
 		go func() {
-			err := cs.Run(ctx)
-			assert.Ok(t, err)
+			_ = Listen(ctx, address, pipeline.Process, nil, promIntf, false, logger)
 		}()
 
-		cdmetrics.updateOrAddMetrics(cd, cs, 1.0)
-		assert.Equals(t, 1, len(cdmetrics.metrics))
-		for i := 0; i < 3; i++ {
-			// go cdmetrics.Collect(ch)
-			time.Sleep(time.Second * 1)
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("unixgram", address); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 20)
 		}
+		assert.Ok(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(collectd.GenCPUMetric(10, "localhost", 3))
+		assert.Ok(t, err)
+		_, err = conn.Write([]byte("not json"))
+		assert.Ok(t, err)
+		// datagrams larger than a page are received whole
+		large := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":10,"host":"` + strings.Repeat("h", 8192) + `","plugin":"load","type":"load"}]`
+		_, err = conn.Write([]byte(large))
+		assert.Ok(t, err)
 
-		assert.Equals(t, 0, len(cdmetrics.metrics))
+		lm := promIntf.Listener(address, "unixgram")
+		for i := 0; i < 50 && lm.GetTotalAmqpReceived() < 3; i++ {
+			time.Sleep(time.Millisecond * 20)
+		}
+		assert.Equals(t, uint64(3), lm.GetTotalAmqpReceived())
+		assert.Equals(t, uint64(4), lm.GetTotalMetricsReceived())
+		assert.Equals(t, uint64(1), lm.GetTotalDecodeErrors())
+
+		registry := prometheus.NewRegistry()
+		assert.Ok(t, registry.Register(allMetrics))
+		families, err := registry.Gather()
+		assert.Ok(t, err)
+		found := false
+		for _, family := range families {
+			if family.GetName() == "collectd_cpu_total" {
+				found = true
+				assert.Equals(t, 3, len(family.GetMetric()))
+			}
+		}
+		assert.Assert(t, found, "collectd_cpu_total not exported")
 	})
 }
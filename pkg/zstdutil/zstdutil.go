@@ -0,0 +1,105 @@
+package zstdutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultDictionarySize max size of trained dictionaries
+const DefaultDictionarySize = 112640
+
+// maxDecodedSize largest accepted decompressed message
+const maxDecodedSize = 16 * 1024 * 1024
+
+var (
+	frameMagic      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	dictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+)
+
+// IsCompressed whether msg starts with a zstd frame
+func IsCompressed(msg []byte) bool {
+	return bytes.HasPrefix(msg, frameMagic)
+}
+
+// DictionaryID returns id of zstd dictionary dict
+func DictionaryID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || !bytes.HasPrefix(dict, dictionaryMagic) {
+		return 0, fmt.Errorf("not a zstd dictionary")
+	}
+	return binary.LittleEndian.Uint32(dict[4:8]), nil
+}
+
+// LoadDictionary reads zstd dictionary from path
+func LoadDictionary(path string) ([]byte, error) {
+	dict, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := DictionaryID(dict); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return dict, nil
+}
+
+// EncoderOptions zstd encoder options using dict when not empty
+func EncoderOptions(dict []byte) []zstd.EOption {
+	if len(dict) == 0 {
+		return nil
+	}
+	return []zstd.EOption{zstd.WithEncoderDict(dict)}
+}
+
+// DecoderOptions zstd decoder options using dict when not empty
+func DecoderOptions(dict []byte) []zstd.DOption {
+	opts := []zstd.DOption{zstd.WithDecoderMaxMemory(maxDecodedSize)}
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	return opts
+}
+
+// Codec compresses and decompresses single messages, optionally with a
+// trained dictionary. Concurrent
+type Codec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewCodec Codec factory, dict may be nil
+func NewCodec(dict []byte) (*Codec, error) {
+	enc, err := zstd.NewWriter(nil, EncoderOptions(dict)...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, DecoderOptions(dict)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{enc: enc, dec: dec}, nil
+}
+
+// Compress appends compressed src to dst
+func (c *Codec) Compress(dst []byte, src []byte) []byte {
+	return c.enc.EncodeAll(src, dst)
+}
+
+// Decompress appends decompressed src to dst
+func (c *Codec) Decompress(dst []byte, src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, dst)
+}
+
+// TrainDictionary builds zstd dictionary of at most size bytes from samples
+func TrainDictionary(samples [][]byte, size int) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no samples to train dictionary from")
+	}
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: size,
+		HashBytes:   6,
+	})
+}
@@ -0,0 +1,94 @@
+package zstdutil
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/infrawatch/sg-core/pkg/assert"
+)
+
+func captureSamples(t *testing.T) [][]byte {
+	f, err := os.Open("../../cd-capture.txt")
+	assert.Ok(t, err)
+	defer f.Close()
+
+	samples := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(samples) < 200 {
+		if len(scanner.Bytes()) > 0 {
+			samples = append(samples, append([]byte{}, scanner.Bytes()...))
+		}
+	}
+	assert.Ok(t, scanner.Err())
+	return samples
+}
+
+func TestCodec(t *testing.T) {
+	msg := []byte(`[{"values":[7.5],"dstypes":["gauge"],"dsnames":["value"],"time":1580682811.0,"interval":5.000,"host":"host0","plugin":"cpu","plugin_instance":"0","type":"percent","type_instance":"user"}]`)
+
+	t.Run("load dictionary", func(t *testing.T) {
+		dict, err := LoadDictionary("../../tmp/dictionary")
+		assert.Ok(t, err)
+		id, err := DictionaryID(dict)
+		assert.Ok(t, err)
+		assert.Assert(t, id != 0, "expected dictionary id")
+
+		_, err = LoadDictionary("../../cd-capture.txt")
+		assert.Assert(t, err != nil, "expected error loading non dictionary")
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		dict, err := LoadDictionary("../../tmp/dictionary")
+		assert.Ok(t, err)
+		for _, d := range [][]byte{nil, dict} {
+			codec, err := NewCodec(d)
+			assert.Ok(t, err)
+			compressed := codec.Compress(nil, msg)
+			assert.Assert(t, IsCompressed(compressed), "missing zstd frame magic")
+			assert.Assert(t, !IsCompressed(msg), "plain message detected as compressed")
+			decompressed, err := codec.Decompress(nil, compressed)
+			assert.Ok(t, err)
+			assert.Equals(t, msg, decompressed)
+		}
+	})
+
+	t.Run("dictionary mismatch", func(t *testing.T) {
+		dict, err := LoadDictionary("../../tmp/dictionary")
+		assert.Ok(t, err)
+		trained, err := NewCodec(dict)
+		assert.Ok(t, err)
+		plain, err := NewCodec(nil)
+		assert.Ok(t, err)
+		_, err = plain.Decompress(nil, trained.Compress(nil, msg))
+		assert.Assert(t, err != nil, "expected error decompressing without dictionary")
+	})
+
+	t.Run("train dictionary", func(t *testing.T) {
+		samples := captureSamples(t)
+		dict, err := TrainDictionary(samples, 16*1024)
+		assert.Ok(t, err)
+		_, err = DictionaryID(dict)
+		assert.Ok(t, err)
+
+		trained, err := NewCodec(dict)
+		assert.Ok(t, err)
+		plain, err := NewCodec(nil)
+		assert.Ok(t, err)
+		var withDict, withoutDict int
+		for _, s := range samples {
+			compressed := trained.Compress(nil, s)
+			withDict += len(compressed)
+			withoutDict += len(plain.Compress(nil, s))
+			decompressed, err := trained.Decompress(nil, compressed)
+			assert.Ok(t, err)
+			assert.Assert(t, bytes.Equal(s, decompressed), "round trip mismatch")
+		}
+		assert.Assert(t, withDict < withoutDict, "dictionary did not help: %d >= %d", withDict, withoutDict)
+
+		_, err = TrainDictionary(nil, 1024)
+		assert.Assert(t, err != nil, "expected error without samples")
+	})
+}